@@ -0,0 +1,56 @@
+// Package atomicfile replaces files so a power cut leaves either the old or
+// the new contents, never a mix
+package atomicfile
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+)
+
+// Mode of a file Write creates, one it replaces keeps its own
+const defaultMode = 0644
+
+// Write replaces path with data. The data goes to a temporary file in the
+// same directory that's synced and renamed over path, then the directory is
+// synced so the rename itself is on disk.
+func Write(path string, data []byte) (err error) {
+  mode := os.FileMode(defaultMode)
+  if fi, statErr := os.Stat(path); statErr == nil {
+    mode = fi.Mode().Perm()
+  }
+
+  dir := filepath.Dir(path)
+  tmp, err := ioutil.TempFile(dir, filepath.Base(path) + ".*.tmp")
+  if err != nil {
+    return
+  }
+  defer os.Remove(tmp.Name())
+
+  if err = tmp.Chmod(mode); err != nil {
+    tmp.Close()
+    return
+  }
+  if _, err = tmp.Write(data); err != nil {
+    tmp.Close()
+    return
+  }
+  if err = tmp.Sync(); err != nil {
+    tmp.Close()
+    return
+  }
+  if err = tmp.Close(); err != nil {
+    return
+  }
+  if err = os.Rename(tmp.Name(), path); err != nil {
+    return
+  }
+
+  d, err := os.Open(dir)
+  if err != nil {
+    return
+  }
+  defer d.Close()
+  err = d.Sync()
+  return
+}
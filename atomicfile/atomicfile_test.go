@@ -0,0 +1,59 @@
+package atomicfile
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+func TestWrite(t *testing.T) {
+  dir, err := ioutil.TempDir("", "atomicfile")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  path := filepath.Join(dir, "file.json")
+  for _, contents := range []string{"first", "second, longer than the first", ""} {
+    if err := Write(path, []byte(contents)); err != nil {
+      t.Fatal(err)
+    }
+    if data, err := ioutil.ReadFile(path); err != nil || string(data) != contents {
+      t.Errorf("read back %q, %v, want %q", data, err, contents)
+    }
+  }
+
+  entries, err := ioutil.ReadDir(dir)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(entries) != 1 {
+    t.Errorf("temporary files left behind, %d entries", len(entries))
+  }
+
+  // A new file gets the default mode, a replaced one keeps its own
+  mode := func(p string) os.FileMode {
+    fi, err := os.Stat(p)
+    if err != nil {
+      t.Fatal(err)
+    }
+    return fi.Mode().Perm()
+  }
+  if m := mode(path); m != defaultMode {
+    t.Errorf("new file has mode %o, want %o", m, defaultMode)
+  }
+  if err := os.Chmod(path, 0640); err != nil {
+    t.Fatal(err)
+  }
+  if err := Write(path, []byte("third")); err != nil {
+    t.Fatal(err)
+  }
+  if m := mode(path); m != 0640 {
+    t.Errorf("replaced file has mode %o, want 640", m)
+  }
+
+  if err := Write(filepath.Join(dir, "missing", "file.json"), nil); err == nil {
+    t.Error("write to a missing directory succeeded")
+  }
+}
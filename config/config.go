@@ -1,25 +1,206 @@
 package config
 import(
+  "fmt"
   "os"
+  "time"
   "gopkg.in/yaml.v3"
 )
 
+type ServerConfig struct {
+  Host string `yaml:"host"`
+  Port string `yaml:"port"`
+  Ssl bool `yaml:"ssl"`
+  SslVerify bool `yaml:"ssl_verify"`
+  StationId string `yaml:"station_id"`
+}
+
+type CredentialsConfig struct {
+  ApiKey string `yaml:"api_key"`
+}
+
+// OutboxConfig where readings a sink fails to take are queued for retrying
+type OutboxConfig struct {
+  // Directory the queue is kept in, no queue if empty
+  Path string `yaml:"path"`
+  // Disk space the queue may use before the oldest readings are dropped
+  MaxBytes int64 `yaml:"max_bytes"`
+  MinBackoff time.Duration `yaml:"min_backoff"`
+  MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+// BatchConfig when readings collected for a batch are sent, whichever of
+// the size and interval comes first
+type BatchConfig struct {
+  MaxReadings int `yaml:"max_readings"`
+  Interval time.Duration `yaml:"interval"`
+}
+
+// SinkConfig settings for one place readings are reported to, which fields
+// are used depends on the type
+type SinkConfig struct {
+  Type string `yaml:"type"`
+  Name string `yaml:"name"`
+
+  // station_api
+  Server ServerConfig `yaml:"server"`
+  Credentials CredentialsConfig `yaml:"credentials"`
+  // Readings are posted one at a time unless batching is set
+  Batch BatchConfig `yaml:"batch"`
+  Gzip bool `yaml:"gzip"`
+
+  // log
+  Path string `yaml:"path"`
+  Format string `yaml:"format"`
+
+  // wunderground and aprs, url is only needed to send somewhere other
+  // than the usual servers, for aprs it's the APRS-IS host:port and
+  // password is the passcode
+  StationID string `yaml:"station_id"`
+  Password string `yaml:"password"`
+  Url string `yaml:"url"`
+  Interval time.Duration `yaml:"interval"`
+  RapidFire bool `yaml:"rapid_fire"`
+  Callsign string `yaml:"callsign"`
+  Latitude float64 `yaml:"latitude"`
+  Longitude float64 `yaml:"longitude"`
+
+  // mqtt, url is the broker host:port and username and password are
+  // optional
+  Username string `yaml:"username"`
+  TopicPrefix string `yaml:"topic_prefix"`
+  DiscoveryPrefix string `yaml:"discovery_prefix"`
+
+  // influxdb, url is http(s)://host:port for the v2 write API, which needs
+  // the org, bucket and token, or udp://host:port. station_id tags every
+  // point and batch and gzip work as for station_api.
+  Org string `yaml:"org"`
+  Bucket string `yaml:"bucket"`
+  Token string `yaml:"token"`
+  Measurement string `yaml:"measurement"`
+
+  // Any type
+  Outbox OutboxConfig `yaml:"outbox"`
+}
+
 type Config struct {
-  Server struct {
-    Host string `yaml:"host"`
-    Port string `yaml:"port"`
-    Ssl bool `yaml:"ssl"`
-    SslVerify bool `yaml:"ssl_verify"`
-    StationId string `yaml:"station_id"`
-  } `yaml:"server"`
-  Credentials struct {
-    ApiKey string `yaml:"api_key"`
-  } `yaml:"credentials"`
+  // Station API used when no sinks are listed
+  Server ServerConfig `yaml:"server"`
+  Credentials CredentialsConfig `yaml:"credentials"`
+  Reporting struct {
+    // How often health is reported, 0 turns health reports off
+    HealthInterval time.Duration `yaml:"health_interval"`
+    // Readings waiting to be reported are shared between the workers by
+    // sensor, up to queue_size in total. Each sink also has a queue of its
+    // own this big. When a sink falls that far behind its oldest reading is
+    // dropped with drop_oldest, otherwise the workers wait for it and the
+    // overflow policy applies to the shared queue.
+    Workers int `yaml:"workers"`
+    QueueSize int `yaml:"queue_size"`
+    // What to do with a reading when the queue is full, drop_oldest, block
+    // or spill
+    Overflow string `yaml:"overflow"`
+    SpillPath string `yaml:"spill_path"`
+    SpillMaxBytes int64 `yaml:"spill_max_bytes"`
+  } `yaml:"reporting"`
+  Sinks []SinkConfig `yaml:"sinks"`
+  Metrics struct {
+    // Address to serve Prometheus metrics on, nothing is served if empty
+    Listen string `yaml:"listen"`
+    Path string `yaml:"path"`
+  } `yaml:"metrics"`
+  // Corrections for sensors that read off, by sensor name as logged. Rain
+  // is RainClicks with only a gain, each tip is scaled by it.
+  Calibration []struct {
+    Sensor string `yaml:"sensor"`
+    // Only calibrate this transmitter, 0 for every transmitter
+    Transmitter int `yaml:"transmitter"`
+    Offset float64 `yaml:"offset"`
+    Gain float64 `yaml:"gain"`
+    // Coefficients from the constant term up, used instead of offset and
+    // gain
+    Polynomial []float64 `yaml:"polynomial"`
+  } `yaml:"calibration"`
+  Weather struct {
+    // How long a value counts towards the current conditions after it's
+    // received
+    MaxAge time.Duration `yaml:"max_age"`
+  } `yaml:"weather"`
+  Receiver struct {
+    Band string `yaml:"band"`
+    Transmitters []int `yaml:"transmitters"`
+  } `yaml:"receiver"`
+  Rain struct {
+    Bucket string `yaml:"bucket"`
+    Timezone string `yaml:"timezone"`
+    DayStart string `yaml:"day_start"`
+    YearStartMonth int `yaml:"year_start_month"`
+  } `yaml:"rain"`
+  Wind struct {
+    // How often wind averages and gusts are derived
+    Interval time.Duration `yaml:"interval"`
+    // Anemometer fitted, vp2 or vue
+    Anemometer string `yaml:"anemometer"`
+    // Degrees to add to the direction when the vane isn't lined up with north
+    DirOffset float64 `yaml:"dir_offset"`
+    // Speeds as sent and what they really are in mph, to correct an
+    // anemometer against a reference
+    SpeedCorrection []struct {
+      Raw float64 `yaml:"raw"`
+      Mph float64 `yaml:"mph"`
+    } `yaml:"speed_correction"`
+  } `yaml:"wind"`
+  State struct {
+    Path string `yaml:"path"`
+    CheckpointInterval time.Duration `yaml:"checkpoint_interval"`
+  } `yaml:"state"`
+  Bands []struct {
+    Name string `yaml:"name"`
+    Channels []int `yaml:"channels"`
+    HopPattern []int `yaml:"hop_pattern"`
+  } `yaml:"bands"`
+  Radio struct {
+    Driver string `yaml:"driver"`
+    SpiPort string `yaml:"spi_port"`
+    ResetPin string `yaml:"reset_pin"`
+    InterruptPin string `yaml:"interrupt_pin"`
+    Simulation struct {
+      TransmitterID int `yaml:"transmitter_id"`
+      PacketLoss float64 `yaml:"packet_loss"`
+      CorruptRate float64 `yaml:"corrupt_rate"`
+      Rssi float64 `yaml:"rssi"`
+      FreqErr int `yaml:"freq_err"`
+      BatteryLow bool `yaml:"battery_low"`
+      NoUVSensor bool `yaml:"no_uv_sensor"`
+      NoSolarSensor bool `yaml:"no_solar_sensor"`
+    } `yaml:"simulation"`
+  } `yaml:"radio"`
 }
 
 
 func ReadConfig(path string) (Config, error) {
   var cfg Config
+  cfg.Reporting.HealthInterval = 5 * time.Minute
+  cfg.Reporting.Workers = 4
+  cfg.Reporting.QueueSize = 1000
+  cfg.Reporting.Overflow = "drop_oldest"
+  cfg.Reporting.SpillPath = "elements_spill"
+  cfg.Metrics.Path = "/metrics"
+  cfg.Weather.MaxAge = 10 * time.Minute
+  cfg.Wind.Interval = time.Minute
+  cfg.Receiver.Band = "US"
+  cfg.Receiver.Transmitters = []int{1}
+  cfg.Rain.Bucket = "0.01in"
+  cfg.Rain.Timezone = "Local"
+  cfg.Rain.DayStart = "00:00"
+  cfg.Rain.YearStartMonth = 1
+  cfg.State.Path = "elements_state.json"
+  cfg.State.CheckpointInterval = time.Minute
+  cfg.Radio.Driver = "rfm69"
+  cfg.Radio.SpiPort = "/dev/spidev0.0"
+  cfg.Radio.ResetPin = "GPIO4"
+  cfg.Radio.InterruptPin = "GPIO5"
+  cfg.Radio.Simulation.TransmitterID = 1
+  cfg.Radio.Simulation.Rssi = -60
 
   f, err := os.Open(path)
   if err != nil {
@@ -27,6 +208,45 @@ func ReadConfig(path string) (Config, error) {
   }
   defer f.Close()
   decoder := yaml.NewDecoder(f)
-  err = decoder.Decode(&cfg)
+  if err = decoder.Decode(&cfg); err != nil {
+    return cfg, err
+  }
+  err = cfg.validate()
   return cfg, err
 }
+
+// validate checks the settings nothing later on would catch
+func (c Config) validate() error {
+  if len(c.Receiver.Transmitters) == 0 {
+    return fmt.Errorf("receiver.transmitters lists no transmitters")
+  }
+  seen := make(map[int]bool)
+  for _, id := range c.Receiver.Transmitters {
+    if id < 1 || id > 8 {
+      return fmt.Errorf("receiver.transmitters has %d, IDs run from 1 to 8", id)
+    }
+    if seen[id] {
+      return fmt.Errorf("receiver.transmitters has %d more than once", id)
+    }
+    seen[id] = true
+  }
+  if c.Reporting.HealthInterval < 0 {
+    return fmt.Errorf("reporting.health_interval is negative, use 0 to turn health reports off")
+  }
+  return nil
+}
+
+// ReportingSinks the sinks to report to, configs that predate the sinks list
+// report to the station API given by server and credentials
+func (c Config) ReportingSinks() []SinkConfig {
+  if len(c.Sinks) > 0 || c.Server.Host == "" {
+    return c.Sinks
+  }
+
+  return []SinkConfig{{
+    Type: "station_api",
+    Name: "station_api",
+    Server: c.Server,
+    Credentials: c.Credentials,
+  }}
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+func readConfigString(t *testing.T, yaml string) (Config, error) {
+  dir, err := ioutil.TempDir("", "elements")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "config.yml")
+  if err := ioutil.WriteFile(path, []byte(yaml), 0644); err != nil {
+    t.Fatal(err)
+  }
+  return ReadConfig(path)
+}
+
+func TestReadConfigTransmitters(t *testing.T) {
+  tests := []struct {
+    yaml string
+    ok bool
+  }{
+    {"radio:\n  driver: simulated\n", true},
+    {"receiver:\n  transmitters: [1, 3, 8]\n", true},
+    {"receiver:\n  transmitters: []\n", false},
+    {"receiver:\n  transmitters: [0]\n", false},
+    {"receiver:\n  transmitters: [9]\n", false},
+    {"receiver:\n  transmitters: [2, 2]\n", false},
+  }
+
+  for _, test := range tests {
+    _, err := readConfigString(t, test.yaml)
+    if (err == nil) != test.ok {
+      t.Errorf("%q: got error %v", test.yaml, err)
+    }
+  }
+}
+
+func TestReadConfigHealthInterval(t *testing.T) {
+  tests := []struct {
+    yaml string
+    want time.Duration
+    ok bool
+  }{
+    {"radio:\n  driver: simulated\n", 5 * time.Minute, true},
+    {"reporting:\n  health_interval: 30s\n", 30 * time.Second, true},
+    {"reporting:\n  health_interval: 0s\n", 0, true},
+    {"reporting:\n  health_interval: -1m\n", 0, false},
+  }
+
+  for _, tt := range tests {
+    cfg, err := readConfigString(t, tt.yaml)
+    if (err == nil) != tt.ok {
+      t.Errorf("%q: got error %v", tt.yaml, err)
+      continue
+    }
+    if tt.ok && cfg.Reporting.HealthInterval != tt.want {
+      t.Errorf("%q: got %s, want %s", tt.yaml, cfg.Reporting.HealthInterval, tt.want)
+    }
+  }
+}
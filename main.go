@@ -1,30 +1,253 @@
 package main
 
 import (
+  "fmt"
   "os"
+  "os/signal"
+  "syscall"
   "time"
   "log"
   "flag"
   "periph.io/x/periph/host"
 
+  "github.com/NeilBetham/elements/metrics"
   "github.com/NeilBetham/elements/radios"
+  "github.com/NeilBetham/elements/radios/simulated"
   "github.com/NeilBetham/elements/protocol"
+  "github.com/NeilBetham/elements/rain"
   "github.com/NeilBetham/elements/reporting"
+  "github.com/NeilBetham/elements/state"
+  "github.com/NeilBetham/elements/weather"
+  "github.com/NeilBetham/elements/wind"
   "github.com/NeilBetham/elements/config"
 )
 
-func reportReading(r protocol.Reading, rp reporting.Reporter) {
-  err := rp.ReportReading(r)
+func loadBand(c config.Config) (protocol.Band, error) {
+  for _, b := range c.Bands {
+    err := protocol.RegisterBand(protocol.Band{
+      Name: b.Name,
+      Channels: b.Channels,
+      HopPattern: b.HopPattern,
+    })
+    if err != nil {
+      return protocol.Band{}, err
+    }
+  }
+  return protocol.LookupBand(c.Receiver.Band)
+}
+
+func openRadio(c config.Config, band protocol.Band) (radios.Radio, error) {
+  switch c.Radio.Driver {
+  case "simulated":
+    sim := c.Radio.Simulation
+    iss := simulated.NewISS(simulated.Config{
+      Band: band,
+      TransmitterID: sim.TransmitterID,
+      PacketLoss: sim.PacketLoss,
+      CorruptRate: sim.CorruptRate,
+      Rssi: sim.Rssi,
+      FreqErr: sim.FreqErr,
+      BatteryLow: sim.BatteryLow,
+      NoUVSensor: sim.NoUVSensor,
+      NoSolarSensor: sim.NoSolarSensor,
+    })
+    return &iss, nil
+  case "rfm69":
+    if _, err := host.Init(); err != nil {
+      return nil, err
+    }
+    rfm, err := radios.NewRFM69(c.Radio.SpiPort, c.Radio.ResetPin, c.Radio.InterruptPin)
+    if err != nil {
+      return nil, err
+    }
+    return &rfm, nil
+  default:
+    return nil, fmt.Errorf("unknown radio driver %q", c.Radio.Driver)
+  }
+}
+
+// rainDay the zone daily totals are kept in and how long after midnight the
+// day starts, the wind rose shares the rain day
+func rainDay(c config.Config) (loc *time.Location, dayStart time.Duration, err error) {
+  loc, err = time.LoadLocation(c.Rain.Timezone)
+  if err != nil {
+    return
+  }
+
+  start, err := time.Parse("15:04", c.Rain.DayStart)
   if err != nil {
-    log.Printf("Error reporting reading: %s", err)
+    return
   }
+  dayStart = time.Duration(start.Hour()) * time.Hour + time.Duration(start.Minute()) * time.Minute
+  return
 }
 
-func main() {
-  if _, err := host.Init(); err != nil {
-    os.Exit(1)
+func newRainAccumulator(c config.Config, d protocol.Decoder) (acc rain.Accumulator, err error) {
+  loc, dayStart, err := rainDay(c)
+  if err != nil {
+    return
+  }
+
+  acc = rain.NewAccumulator(rain.Config{
+    Bucket: d.RainBucket,
+    Calibration: d.RainCalibration(),
+    Location: loc,
+    DayStart: dayStart,
+    YearStartMonth: time.Month(c.Rain.YearStartMonth),
+  })
+  return
+}
+
+func newWindTracker(c config.Config) (t *wind.Tracker, err error) {
+  loc, dayStart, err := rainDay(c)
+  if err != nil {
+    return
+  }
+
+  t = wind.NewTracker(wind.Config{
+    Interval: c.Wind.Interval,
+    Location: loc,
+    DayStart: dayStart,
+  })
+  return
+}
+
+// receiver ties the radio to the protocol handler and everything that
+// consumes readings
+type receiver struct {
+  radio radios.Radio
+  ph *protocol.ProtocolHandler
+  rain *rain.Accumulator
+  wind *wind.Tracker
+  weather *weather.Aggregator
+  dispatcher reporting.Dispatcher
+  pipeline *reporting.Pipeline
+  health *reporting.HealthTracker
+  metrics *metrics.Exporter
+  // 0 when health isn't reported
+  healthInterval time.Duration
+  lastHealth time.Time
+  inSync bool
+
+  store state.Store
+  checkpointInterval time.Duration
+  lastCheckpoint time.Time
+}
+
+// restore loads anything saved by a previous run
+func (rc *receiver) restore() error {
+  if rc.store.Path == "" {
+    return nil
+  }
+
+  f, err := rc.store.Load()
+  if err != nil {
+    return err
   }
+  if f.Rain != nil {
+    rc.rain.Restore(*f.Rain)
+  }
+  if f.Wind != nil {
+    rc.wind.Restore(*f.Wind)
+  }
+  if f.Stats != nil {
+    rc.ph.RestoreStats(*f.Stats)
+  }
+  if !f.SavedAt.IsZero() {
+    log.Printf("Restored state saved at %s", f.SavedAt)
+  }
+  return nil
+}
+
+// checkpoint saves state if it's due or force is set
+func (rc *receiver) checkpoint(force bool) {
+  if rc.store.Path == "" {
+    return
+  }
+  if !force && time.Since(rc.lastCheckpoint) < rc.checkpointInterval {
+    return
+  }
+
+  rainState := rc.rain.State()
+  windState := rc.wind.State()
+  stats := rc.ph.Stats()
+  err := rc.store.Save(state.File{Rain: &rainState, Wind: &windState, Stats: &stats})
+  if err != nil {
+    log.Printf("Error saving state: %s", err)
+    return
+  }
+  rc.lastCheckpoint = time.Now()
+}
+
+// run receives until a signal on stop arrives, a signal on dump logs the
+// reception statistics
+func (rc *receiver) run(stop <-chan os.Signal, dump <-chan os.Signal) {
+  nextHop := rc.ph.NextHop()
+  log.Printf("Hopping to %v", nextHop)
+  rc.radio.SetFreq(uint32(nextHop.Freq))
+  rc.lastCheckpoint = time.Now()
+  rc.lastHealth = time.Now()
+
+  for {
+    packet, timedout, err := rc.radio.ReceiveData(rc.ph.ListenTimeout())
+    // Whatever came back with an error isn't a packet, skip it but still
+    // check for signals below
+    var shouldHop bool
+    var reading protocol.Reading
+    if err != nil {
+      log.Printf("Error receiving from radio: %s", err)
+    } else {
+      shouldHop, reading = rc.ph.HandlePacket(packet, timedout)
+    }
 
+    if reading.Valid {
+      readings := append([]protocol.Reading{reading}, rc.rain.HandleReading(reading, time.Now())...)
+      readings = append(readings, rc.wind.HandleReading(reading)...)
+      for _, rd := range readings {
+        rc.weather.HandleReading(rd)
+      }
+      readings = append(readings, rc.weather.Derive(reading)...)
+      for _, rd := range readings {
+        log.Printf("Reading: %s", rd)
+        rc.health.HandleReading(rd)
+        if rc.metrics != nil {
+          rc.metrics.HandleReading(rd)
+        }
+        rc.pipeline.Submit(rd)
+      }
+    }
+
+    if inSync := rc.ph.InSync(); inSync != rc.inSync {
+      rc.inSync = inSync
+      rc.dispatcher.ReportSync(inSync)
+    }
+
+    if rc.healthInterval > 0 && time.Since(rc.lastHealth) >= rc.healthInterval {
+      rc.dispatcher.ReportHealth(rc.health.Report(rc.ph.Stats()))
+      rc.lastHealth = time.Now()
+    }
+
+    if shouldHop {
+      nextHop := rc.ph.NextHop()
+      log.Printf("Hopping to %v", nextHop)
+      rc.radio.SetFreq(uint32(nextHop.Freq))
+    }
+
+    select {
+    case sig := <-stop:
+      log.Printf("Received %s, shutting down", sig)
+      rc.checkpoint(true)
+      return
+    case <-dump:
+      log.Printf("Stats: %s", rc.ph.Stats())
+      log.Printf("Reporting: %s", rc.pipeline.Stats())
+    default:
+      rc.checkpoint(false)
+    }
+  }
+}
+
+func main() {
   configPathPtr := flag.String("config", "elements_config.yml", "The config yaml to use")
   flag.Parse()
 
@@ -33,41 +256,111 @@ func main() {
   }
   config, err := config.ReadConfig(*configPathPtr)
   if err != nil{
-    log.Fatal("Error reading config: %s", err)
+    log.Fatalf("Error reading config: %s", err)
   }
 
-  reporter := reporting.NewReporter(config)
+  conditions := weather.NewAggregator(weather.Config{MaxAge: config.Weather.MaxAge})
+  dispatcher, err := reporting.NewDispatcher(config, conditions)
+  if err != nil{
+    log.Fatalf("Error setting up reporting: %s", err)
+  }
+  defer dispatcher.Close()
 
-  r, err := radios.NewRFM69("/dev/spidev0.0", "GPIO4", "GPIO5")
+  pipeline, err := reporting.NewPipeline(dispatcher, config)
   if err != nil{
-    log.Fatal("Failed to open spi port ro radio: %s", err)
+    log.Fatalf("Error setting up reporting: %s", err)
   }
+  defer pipeline.Close()
 
-  timeout := (2562500 + 200000) * time.Microsecond
+  band, err := loadBand(config)
+  if err != nil{
+    log.Fatalf("Error loading frequency band: %s", err)
+  }
+
+  radio, err := openRadio(config, band)
+  if err != nil{
+    log.Fatalf("Failed to open radio: %s", err)
+  }
+  defer radio.Close()
 
   log.Printf("Waiting for packets...")
 
-  ph := protocol.NewProtocolHandler(0)
-  ph.NextHop()
-  nextHop := ph.NextHop()
-  log.Printf("Hopping to %v", nextHop)
-  r.SetFreq(uint32(nextHop.Freq))
+  ph := protocol.NewProtocolHandler(band, config.Receiver.Transmitters)
+  ph.Decoder.RainBucket, err = protocol.ParseRainBucket(config.Rain.Bucket)
+  if err != nil{
+    log.Fatalf("Error reading config: %s", err)
+  }
 
-  for {
-    packet, timeout, _ := r.ReceiveData(timeout)
-    shouldHop, reading := ph.HandlePacket(packet, timeout)
+  ph.Decoder.Anemometer, err = protocol.ParseAnemometer(config.Wind.Anemometer)
+  if err != nil{
+    log.Fatalf("Error reading config: %s", err)
+  }
+  ph.Decoder.WindDirOffset = config.Wind.DirOffset
+  var speedPoints []protocol.WindSpeedPoint
+  for _, p := range config.Wind.SpeedCorrection {
+    speedPoints = append(speedPoints, protocol.WindSpeedPoint{Raw: p.Raw, Mph: p.Mph})
+  }
+  ph.Decoder.WindSpeedCorrection, err = protocol.NewWindSpeedTable(speedPoints)
+  if err != nil{
+    log.Fatalf("Error reading config: %s", err)
+  }
 
-    if reading.Valid {
-      log.Printf("Reading: %s", reading)
-      go reportReading(reading, reporter)
+  for _, c := range config.Calibration {
+    cal, err := protocol.NewCalibration(c.Sensor, c.Transmitter, c.Offset, c.Gain, c.Polynomial)
+    if err != nil{
+      log.Fatalf("Error reading calibration: %s", err)
     }
+    ph.Decoder.Calibrations = append(ph.Decoder.Calibrations, cal)
+  }
 
-    if shouldHop {
-      nextHop := ph.NextHop()
-      log.Printf("Hopping to %v", nextHop)
-      r.SetFreq(uint32(nextHop.Freq))
+  acc, err := newRainAccumulator(config, ph.Decoder)
+  if err != nil{
+    log.Fatalf("Error reading rain config: %s", err)
+  }
+
+  windTracker, err := newWindTracker(config)
+  if err != nil{
+    log.Fatalf("Error reading wind config: %s", err)
+  }
+
+  rc := receiver{
+    radio: radio,
+    ph: &ph,
+    rain: &acc,
+    wind: windTracker,
+    weather: conditions,
+    dispatcher: dispatcher,
+    pipeline: pipeline,
+    health: reporting.NewHealthTracker(),
+    healthInterval: config.Reporting.HealthInterval,
+    store: state.NewStore(config.State.Path),
+    checkpointInterval: config.State.CheckpointInterval,
+  }
+  if err := rc.restore(); err != nil {
+    log.Printf("Error restoring state, starting afresh: %s", err)
+    if path, err := rc.store.Quarantine(); err != nil {
+      log.Printf("Error moving the state file aside: %s", err)
+    } else {
+      log.Printf("Moved the state file to %s", path)
     }
   }
 
-  os.Exit(0)
+  if config.Metrics.Listen != "" {
+    rc.metrics = metrics.NewExporter(metrics.Sources{
+      Stats: ph.Stats,
+      Sinks: dispatcher.Stats,
+      Pipeline: pipeline.Stats,
+      WindRoses: windTracker.Roses,
+    })
+    go func() {
+      err := rc.metrics.ListenAndServe(config.Metrics.Listen, config.Metrics.Path)
+      log.Printf("Error serving metrics: %s", err)
+    }()
+  }
+
+  stop := make(chan os.Signal, 1)
+  signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+  dump := make(chan os.Signal, 1)
+  signal.Notify(dump, syscall.SIGUSR1)
+  rc.run(stop, dump)
 }
@@ -0,0 +1,322 @@
+// Package metrics serves the receiver's state in the Prometheus text format
+package metrics
+
+import (
+  "bufio"
+  "fmt"
+  "log"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+  "github.com/NeilBetham/elements/protocol"
+  "github.com/NeilBetham/elements/reporting"
+  "github.com/NeilBetham/elements/wind"
+)
+
+// Sources where the exporter gets everything it doesn't see in readings,
+// any can be nil
+type Sources struct {
+  Stats func() protocol.Stats
+  Sinks func() []reporting.SinkStats
+  Pipeline func() reporting.PipelineStats
+  WindRoses func() map[int]wind.Rose
+}
+
+// Exporter keeps the latest value of every sensor and renders them with the
+// reception statistics as Prometheus metrics
+type Exporter struct {
+  sources Sources
+
+  mu sync.Mutex
+  values map[valueKey]value
+  batteryLow map[int]bool
+}
+
+type valueKey struct {
+  transmitter int
+  sensor string
+}
+
+type value struct {
+  value float64
+  at time.Time
+}
+
+// NewExporter sets up an exporter with no readings seen
+func NewExporter(sources Sources) (e *Exporter) {
+  e = &Exporter{sources: sources}
+  e.values = make(map[valueKey]value)
+  e.batteryLow = make(map[int]bool)
+  return
+}
+
+// HandleReading records the values carried by a reading
+func (e *Exporter) HandleReading(r protocol.Reading) {
+  if !r.Valid {
+    return
+  }
+
+  at := r.Timestamp
+  if at.IsZero() {
+    at = time.Now()
+  }
+
+  e.mu.Lock()
+  defer e.mu.Unlock()
+
+  if !r.NoSensor {
+    e.values[valueKey{r.StationID, r.SensorName}] = value{r.Value, at}
+  }
+  if r.Derived {
+    return
+  }
+  e.values[valueKey{r.StationID, "WindSpeed"}] = value{r.WindSpeed, at}
+  if !r.NoWindDir {
+    e.values[valueKey{r.StationID, "WindDir"}] = value{r.WindDir, at}
+  }
+  e.batteryLow[r.StationID] = r.StationBatLow
+}
+
+// ListenAndServe serves the metrics on addr at path until it fails
+func (e *Exporter) ListenAndServe(addr string, path string) error {
+  mux := http.NewServeMux()
+  mux.Handle(path, e)
+  log.Printf("Serving metrics on %s%s", addr, path)
+  return http.ListenAndServe(addr, mux)
+}
+
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+  w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+  out := bufio.NewWriter(w)
+  e.write(out)
+  out.Flush()
+}
+
+// write renders every metric in the text exposition format
+func (e *Exporter) write(w *bufio.Writer) {
+  e.writeValues(w)
+  if e.sources.Stats != nil {
+    writeStats(w, e.sources.Stats())
+  }
+  if e.sources.Sinks != nil {
+    writeSinks(w, e.sources.Sinks())
+  }
+  if e.sources.Pipeline != nil {
+    writePipeline(w, e.sources.Pipeline())
+  }
+  if e.sources.WindRoses != nil {
+    writeWindRoses(w, e.sources.WindRoses())
+  }
+}
+
+func (e *Exporter) writeValues(w *bufio.Writer) {
+  e.mu.Lock()
+  defer e.mu.Unlock()
+
+  var keys []valueKey
+  for k := range e.values {
+    keys = append(keys, k)
+  }
+  sort.Slice(keys, func(i, j int) bool {
+    if keys[i].transmitter != keys[j].transmitter {
+      return keys[i].transmitter < keys[j].transmitter
+    }
+    return keys[i].sensor < keys[j].sensor
+  })
+
+  header(w, "elements_sensor_value", "gauge", "Latest decoded value of each sensor")
+  for _, k := range keys {
+    sample(w, "elements_sensor_value", labels("transmitter", strconv.Itoa(k.transmitter), "sensor", k.sensor), e.values[k].value)
+  }
+  header(w, "elements_sensor_timestamp_seconds", "gauge", "When each sensor was last received")
+  for _, k := range keys {
+    sample(w, "elements_sensor_timestamp_seconds", labels("transmitter", strconv.Itoa(k.transmitter), "sensor", k.sensor), unixSeconds(e.values[k].at))
+  }
+
+  var ids []int
+  for id := range e.batteryLow {
+    ids = append(ids, id)
+  }
+  sort.Ints(ids)
+  header(w, "elements_battery_low", "gauge", "Whether the transmitter reports a low battery")
+  for _, id := range ids {
+    sample(w, "elements_battery_low", labels("transmitter", strconv.Itoa(id)), boolValue(e.batteryLow[id]))
+  }
+}
+
+func writeStats(w *bufio.Writer, s protocol.Stats) {
+  counter := func(name string, help string, v int) {
+    header(w, name, "counter", help)
+    sample(w, name, "", float64(v))
+  }
+  counter("elements_packets_received_total", "Packets received with a good CRC from a followed transmitter", s.PacketsReceived)
+  counter("elements_crc_failures_total", "Packets received with a bad CRC", s.CRCFailures)
+  counter("elements_wrong_station_total", "Packets received from transmitters that aren't followed", s.WrongStation)
+  counter("elements_missed_slots_total", "Expected packets that never arrived", s.MissedSlots)
+  counter("elements_resyncs_total", "Times a transmitter was lost and searched for again", s.Resyncs)
+
+  inSync := false
+  for _, tx := range s.Transmitters {
+    inSync = inSync || tx.InSync
+  }
+  header(w, "elements_in_sync", "gauge", "Whether any transmitter is in sync")
+  sample(w, "elements_in_sync", "", boolValue(inSync))
+  header(w, "elements_hop_index", "gauge", "Position in the hop pattern the radio is tuned to")
+  sample(w, "elements_hop_index", "", float64(s.HopIndex))
+  header(w, "elements_tuned_frequency_hz", "gauge", "Frequency the radio is tuned to")
+  sample(w, "elements_tuned_frequency_hz", "", float64(s.Freq))
+
+  var ids []int
+  for id := range s.Transmitters {
+    ids = append(ids, id)
+  }
+  sort.Ints(ids)
+  perTransmitter := func(name string, kind string, help string, fn func(tx *protocol.TransmitterStats) float64) {
+    header(w, name, kind, help)
+    for _, id := range ids {
+      sample(w, name, labels("transmitter", strconv.Itoa(id)), fn(s.Transmitters[id]))
+    }
+  }
+  perTransmitter("elements_transmitter_in_sync", "gauge", "Whether the transmitter is in sync", func(tx *protocol.TransmitterStats) float64 {
+    return boolValue(tx.InSync)
+  })
+  perTransmitter("elements_transmitter_packets_received_total", "counter", "Packets received from the transmitter", func(tx *protocol.TransmitterStats) float64 {
+    return float64(tx.PacketsReceived)
+  })
+  perTransmitter("elements_transmitter_missed_slots_total", "counter", "Packets expected from the transmitter that never arrived", func(tx *protocol.TransmitterStats) float64 {
+    return float64(tx.MissedSlots)
+  })
+  perTransmitter("elements_transmitter_resyncs_total", "counter", "Times the transmitter was lost", func(tx *protocol.TransmitterStats) float64 {
+    return float64(tx.Resyncs)
+  })
+  perTransmitter("elements_transmitter_reception_percent", "gauge", "Packets received as a percentage of those expected", func(tx *protocol.TransmitterStats) float64 {
+    return tx.ReceptionPct()
+  })
+  perTransmitter("elements_transmitter_last_packet_timestamp_seconds", "gauge", "When the transmitter was last heard", func(tx *protocol.TransmitterStats) float64 {
+    return unixSeconds(tx.LastPacket)
+  })
+
+  var freqs []int
+  for freq := range s.Channels {
+    freqs = append(freqs, freq)
+  }
+  sort.Ints(freqs)
+  header(w, "elements_packet_rssi_dbm", "histogram", "Signal strength of received packets by channel")
+  for _, freq := range freqs {
+    histogram(w, "elements_packet_rssi_dbm", labels("channel", strconv.Itoa(freq)), s.Channels[freq].Rssi)
+  }
+  header(w, "elements_packet_freq_error_hz", "histogram", "Frequency error of received packets by channel")
+  for _, freq := range freqs {
+    histogram(w, "elements_packet_freq_error_hz", labels("channel", strconv.Itoa(freq)), s.Channels[freq].FreqErr)
+  }
+}
+
+func writeSinks(w *bufio.Writer, sinks []reporting.SinkStats) {
+  header(w, "elements_sink_reports_total", "counter", "Readings each sink took or failed to take")
+  for _, s := range sinks {
+    sample(w, "elements_sink_reports_total", labels("sink", s.Name, "result", "success"), float64(s.Succeeded))
+    sample(w, "elements_sink_reports_total", labels("sink", s.Name, "result", "failure"), float64(s.Failed))
+  }
+  header(w, "elements_sink_queue_depth", "gauge", "Reports waiting for each sink")
+  for _, s := range sinks {
+    sample(w, "elements_sink_queue_depth", labels("sink", s.Name), float64(s.Queued))
+  }
+  header(w, "elements_sink_dropped_total", "counter", "Readings dropped because a sink fell too far behind")
+  for _, s := range sinks {
+    sample(w, "elements_sink_dropped_total", labels("sink", s.Name), float64(s.Dropped))
+  }
+}
+
+func writePipeline(w *bufio.Writer, p reporting.PipelineStats) {
+  header(w, "elements_reporting_queue_depth", "gauge", "Readings waiting to be reported, in memory and on disk")
+  sample(w, "elements_reporting_queue_depth", "", float64(p.Depth))
+  header(w, "elements_reporting_queue_spilled", "gauge", "Readings waiting to be reported on disk")
+  sample(w, "elements_reporting_queue_spilled", "", float64(p.Spilled))
+  header(w, "elements_reporting_dropped_total", "counter", "Readings dropped because the reporting queue was full")
+  sample(w, "elements_reporting_dropped_total", "", float64(p.Dropped))
+}
+
+// Compass points of the wind rose in order from north
+var rosePoints = [wind.RosePoints]string{
+  "N", "NNE", "NE", "ENE", "E", "ESE", "SE", "SSE",
+  "S", "SSW", "SW", "WSW", "W", "WNW", "NW", "NNW",
+}
+
+func writeWindRoses(w *bufio.Writer, roses map[int]wind.Rose) {
+  var ids []int
+  for id := range roses {
+    ids = append(ids, id)
+  }
+  sort.Ints(ids)
+  header(w, "elements_wind_rose_packets", "gauge", "Packets today with the wind from each compass point, or calm")
+  for _, id := range ids {
+    rose := roses[id]
+    for i, point := range rosePoints {
+      sample(w, "elements_wind_rose_packets", labels("transmitter", strconv.Itoa(id), "direction", point), float64(rose.Counts[i]))
+    }
+    sample(w, "elements_wind_rose_packets", labels("transmitter", strconv.Itoa(id), "direction", "calm"), float64(rose.Calm))
+  }
+}
+
+// histogram writes the cumulative buckets Prometheus expects from counts per
+// bucket
+func histogram(w *bufio.Writer, name string, lbls string, h protocol.Histogram) {
+  cumulative := 0
+  for i, bound := range h.Bounds {
+    cumulative += h.Counts[i]
+    sample(w, name + "_bucket", joinLabels(lbls, labels("le", formatValue(bound))), float64(cumulative))
+  }
+  sample(w, name + "_bucket", joinLabels(lbls, labels("le", "+Inf")), float64(h.Count))
+  sample(w, name + "_sum", lbls, h.Sum)
+  sample(w, name + "_count", lbls, float64(h.Count))
+}
+
+func header(w *bufio.Writer, name string, kind string, help string) {
+  fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func sample(w *bufio.Writer, name string, lbls string, v float64) {
+  if lbls != "" {
+    lbls = "{" + lbls + "}"
+  }
+  fmt.Fprintf(w, "%s%s %s\n", name, lbls, formatValue(v))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats name, value pairs as a label list without the braces
+func labels(pairs ...string) string {
+  var parts []string
+  for i := 0; i + 1 < len(pairs); i += 2 {
+    parts = append(parts, fmt.Sprintf(`%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i + 1])))
+  }
+  return strings.Join(parts, ",")
+}
+
+func joinLabels(a string, b string) string {
+  if a == "" {
+    return b
+  }
+  return a + "," + b
+}
+
+func formatValue(v float64) string {
+  return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func boolValue(b bool) float64 {
+  if b {
+    return 1
+  }
+  return 0
+}
+
+func unixSeconds(t time.Time) float64 {
+  if t.IsZero() {
+    return 0
+  }
+  return float64(t.UnixNano()) / 1e9
+}
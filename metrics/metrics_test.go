@@ -0,0 +1,132 @@
+package metrics
+
+import (
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+  "github.com/NeilBetham/elements/protocol"
+  "github.com/NeilBetham/elements/reporting"
+  "github.com/NeilBetham/elements/wind"
+)
+
+func scrape(t *testing.T, e *Exporter) string {
+  t.Helper()
+  rec := httptest.NewRecorder()
+  e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+  if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+    t.Errorf("content type %q", ct)
+  }
+  return rec.Body.String()
+}
+
+func TestExposition(t *testing.T) {
+  stats := protocol.Stats{
+    PacketsReceived: 3,
+    Transmitters: map[int]*protocol.TransmitterStats{1: {ID: 1, InSync: true, PacketsReceived: 3, MissedSlots: 1}},
+    Channels: map[int]*protocol.ChannelStats{
+      902381897: {
+        Freq: 902381897,
+        Rssi: protocol.Histogram{
+          Bounds: []float64{-100, -80, -60},
+          Counts: []int{1, 0, 1, 1},
+          Sum: -230,
+          Count: 3,
+        },
+        FreqErr: protocol.Histogram{Bounds: []float64{0}, Counts: []int{0, 0}},
+      },
+    },
+  }
+  e := NewExporter(Sources{
+    Stats: func() protocol.Stats { return stats },
+    Sinks: func() []reporting.SinkStats {
+      return []reporting.SinkStats{{Name: "a \"quoted\\\" sink\nname", Succeeded: 2}}
+    },
+    Pipeline: func() reporting.PipelineStats { return reporting.PipelineStats{Depth: 4} },
+    WindRoses: func() map[int]wind.Rose { return map[int]wind.Rose{1: {Calm: 2}} },
+  })
+  e.HandleReading(protocol.Reading{
+    StationID: 1,
+    Timestamp: time.Unix(1750000000, 0),
+    Sensor: protocol.Temperature,
+    SensorName: "Temperature",
+    Value: 68.5,
+    WindSpeed: 4,
+    WindDir: 90,
+    StationBatLow: true,
+    Valid: true,
+  })
+  out := scrape(t, e)
+
+  for _, line := range []string{
+    `elements_sensor_value{transmitter="1",sensor="Temperature"} 68.5`,
+    `elements_sensor_value{transmitter="1",sensor="WindSpeed"} 4`,
+    `elements_sensor_timestamp_seconds{transmitter="1",sensor="Temperature"} 1.75e+09`,
+    `elements_battery_low{transmitter="1"} 1`,
+    `elements_packets_received_total 3`,
+    `elements_transmitter_reception_percent{transmitter="1"} 75`,
+    // Buckets count everything at or below their bound
+    `elements_packet_rssi_dbm_bucket{channel="902381897",le="-100"} 1`,
+    `elements_packet_rssi_dbm_bucket{channel="902381897",le="-80"} 1`,
+    `elements_packet_rssi_dbm_bucket{channel="902381897",le="-60"} 2`,
+    `elements_packet_rssi_dbm_bucket{channel="902381897",le="+Inf"} 3`,
+    `elements_packet_rssi_dbm_sum{channel="902381897"} -230`,
+    `elements_packet_rssi_dbm_count{channel="902381897"} 3`,
+    `elements_sink_reports_total{sink="a \"quoted\\\" sink\nname",result="success"} 2`,
+    `elements_reporting_queue_depth 4`,
+    `elements_wind_rose_packets{transmitter="1",direction="calm"} 2`,
+  } {
+    if !strings.Contains(out, "\n" + line + "\n") {
+      t.Errorf("no line %s", line)
+    }
+  }
+
+  // Every sample follows the HELP and TYPE of its family, histogram samples
+  // belong to the family without their suffix
+  types := make(map[string]string)
+  helped := make(map[string]bool)
+  for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+    fields := strings.Fields(line)
+    switch {
+    case strings.HasPrefix(line, "# HELP "):
+      helped[fields[2]] = true
+    case strings.HasPrefix(line, "# TYPE "):
+      if !helped[fields[2]] {
+        t.Errorf("TYPE before HELP for %s", fields[2])
+      }
+      if _, ok := types[fields[2]]; ok {
+        t.Errorf("%s declared twice", fields[2])
+      }
+      types[fields[2]] = fields[3]
+    default:
+      name := strings.SplitN(fields[0], "{", 2)[0]
+      family := name
+      for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+        if trimmed := strings.TrimSuffix(name, suffix); types[trimmed] == "histogram" {
+          family = trimmed
+        }
+      }
+      if types[family] == "" {
+        t.Errorf("sample %s has no TYPE", name)
+      }
+    }
+  }
+  if types["elements_packet_rssi_dbm"] != "histogram" || types["elements_packets_received_total"] != "counter" || types["elements_sensor_value"] != "gauge" {
+    t.Errorf("types %v", types)
+  }
+}
+
+func TestExporterSkipsMissing(t *testing.T) {
+  e := NewExporter(Sources{})
+  e.HandleReading(protocol.Reading{StationID: 2, Sensor: protocol.UVIndex, SensorName: "UVIndex", NoSensor: true, NoWindDir: true, Valid: true})
+  e.HandleReading(protocol.Reading{StationID: 3, SensorName: "Temperature", Value: 1})
+  out := scrape(t, e)
+  for _, missing := range []string{`sensor="UVIndex"`, `sensor="WindDir"`, `transmitter="3"`, "elements_packets_received_total"} {
+    if strings.Contains(out, missing) {
+      t.Errorf("output has %s:\n%s", missing, out)
+    }
+  }
+  if !strings.Contains(out, `elements_sensor_value{transmitter="2",sensor="WindSpeed"} 0`) {
+    t.Errorf("no wind speed for a packet without a vane:\n%s", out)
+  }
+}
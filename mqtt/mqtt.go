@@ -0,0 +1,306 @@
+// Package mqtt is a minimal MQTT 3.1.1 client, it only publishes at QoS 0
+// which is all a sensor feed needs
+package mqtt
+
+import (
+  "bufio"
+  "bytes"
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "sync"
+  "time"
+)
+
+// Control packet types, shifted into the top nibble of the fixed header
+const (
+  packetConnect = 1 << 4
+  packetConnack = 2 << 4
+  packetPublish = 3 << 4
+  packetPingreq = 12 << 4
+  packetPingresp = 13 << 4
+  packetDisconnect = 14 << 4
+)
+
+// CONNECT flags
+const (
+  flagCleanSession = 0x02
+  flagWill = 0x04
+  flagWillRetain = 0x20
+  flagPassword = 0x40
+  flagUsername = 0x80
+)
+
+const dialTimeout = 30 * time.Second
+
+// Message a payload published to a topic
+type Message struct {
+  Topic string
+  Payload []byte
+  // Have the broker keep the message for anyone subscribing later
+  Retain bool
+}
+
+// Options for connecting to a broker
+type Options struct {
+  ClientID string
+  Username string
+  Password string
+  // How often to ping the broker when nothing else is sent, 0 turns it off
+  KeepAlive time.Duration
+  // Published by the broker if the connection drops without a disconnect
+  Will *Message
+}
+
+// Client a connection to a broker
+type Client struct {
+  conn net.Conn
+  keepAlive time.Duration
+
+  mu sync.Mutex
+  lastWrite time.Time
+  err error
+
+  done chan struct{}
+}
+
+// Dial connects to the broker at addr, host:port
+func Dial(addr string, opts Options) (c *Client, err error) {
+  conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+  if err != nil {
+    return
+  }
+  return handshake(conn, opts)
+}
+
+// handshake sends CONNECT over conn and waits for the broker to accept it,
+// conn is closed if it doesn't
+func handshake(conn net.Conn, opts Options) (c *Client, err error) {
+  c = &Client{conn: conn, keepAlive: opts.KeepAlive, done: make(chan struct{})}
+  conn.SetDeadline(time.Now().Add(dialTimeout))
+  reader := bufio.NewReader(conn)
+  if err = c.write(connectPacket(opts)); err != nil {
+    conn.Close()
+    return nil, err
+  }
+
+  packetType, body, err := readPacket(reader)
+  if err != nil {
+    conn.Close()
+    return nil, err
+  }
+  if packetType != packetConnack || len(body) != 2 {
+    conn.Close()
+    return nil, errors.New("mqtt: expected CONNACK")
+  }
+  if body[1] != 0 {
+    conn.Close()
+    return nil, fmt.Errorf("mqtt: connection refused, %s", connackReason(body[1]))
+  }
+  conn.SetDeadline(time.Time{})
+
+  go c.read(reader)
+  if c.keepAlive > 0 {
+    go c.ping()
+  }
+  return
+}
+
+// Publish sends a message at QoS 0
+func (c *Client) Publish(m Message) error {
+  var body bytes.Buffer
+  writeString(&body, m.Topic)
+  body.Write(m.Payload)
+
+  header := byte(packetPublish)
+  if m.Retain {
+    header |= 0x01
+  }
+  return c.write(packet(header, body.Bytes()))
+}
+
+// Close disconnects cleanly, the broker doesn't publish the will
+func (c *Client) Close() error {
+  c.write(packet(packetDisconnect, nil))
+  c.fail(errors.New("mqtt: closed"))
+  return nil
+}
+
+// Err the reason the connection failed, nil while it's up
+func (c *Client) Err() error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.err
+}
+
+func (c *Client) write(p []byte) error {
+  c.mu.Lock()
+  if c.err != nil {
+    c.mu.Unlock()
+    return c.err
+  }
+  c.conn.SetWriteDeadline(time.Now().Add(dialTimeout))
+  _, err := c.conn.Write(p)
+  if err == nil {
+    c.lastWrite = time.Now()
+  }
+  c.mu.Unlock()
+
+  if err != nil {
+    c.fail(err)
+  }
+  return err
+}
+
+// fail marks the connection as failed and closes it, the first error sticks
+func (c *Client) fail(err error) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if c.err == nil {
+    c.err = err
+    close(c.done)
+  }
+  c.conn.Close()
+}
+
+// read consumes whatever the broker sends, at QoS 0 that's only PINGRESP
+func (c *Client) read(r *bufio.Reader) {
+  for {
+    if _, _, err := readPacket(r); err != nil {
+      c.fail(err)
+      return
+    }
+  }
+}
+
+// ping keeps the connection alive when nothing has been published lately
+func (c *Client) ping() {
+  ticker := time.NewTicker(c.keepAlive / 2)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-c.done:
+      return
+    case <-ticker.C:
+    }
+
+    c.mu.Lock()
+    idle := time.Since(c.lastWrite)
+    c.mu.Unlock()
+    if idle >= c.keepAlive / 2 {
+      c.write(packet(packetPingreq, nil))
+    }
+  }
+}
+
+func connectPacket(opts Options) []byte {
+  var body bytes.Buffer
+  writeString(&body, "MQTT")
+  body.WriteByte(4)
+
+  flags := byte(flagCleanSession)
+  if opts.Will != nil {
+    flags |= flagWill
+    if opts.Will.Retain {
+      flags |= flagWillRetain
+    }
+  }
+  if opts.Username != "" {
+    flags |= flagUsername
+    if opts.Password != "" {
+      flags |= flagPassword
+    }
+  }
+  body.WriteByte(flags)
+  keepAlive := int(opts.KeepAlive / time.Second)
+  body.WriteByte(byte(keepAlive >> 8))
+  body.WriteByte(byte(keepAlive))
+
+  writeString(&body, opts.ClientID)
+  if opts.Will != nil {
+    writeString(&body, opts.Will.Topic)
+    writeBytes(&body, opts.Will.Payload)
+  }
+  if opts.Username != "" {
+    writeString(&body, opts.Username)
+    if opts.Password != "" {
+      writeString(&body, opts.Password)
+    }
+  }
+  return packet(packetConnect, body.Bytes())
+}
+
+// packet adds the fixed header, the remaining length is 7 bits a byte with
+// the top bit set when more follow
+func packet(header byte, body []byte) []byte {
+  p := []byte{header}
+  length := len(body)
+  for {
+    b := byte(length % 128)
+    length /= 128
+    if length > 0 {
+      b |= 0x80
+    }
+    p = append(p, b)
+    if length == 0 {
+      break
+    }
+  }
+  return append(p, body...)
+}
+
+func readPacket(r *bufio.Reader) (packetType byte, body []byte, err error) {
+  header, err := r.ReadByte()
+  if err != nil {
+    return
+  }
+
+  length := 0
+  for shift := uint(0); ; shift += 7 {
+    if shift > 21 {
+      return 0, nil, errors.New("mqtt: malformed remaining length")
+    }
+    b, readErr := r.ReadByte()
+    if readErr != nil {
+      return 0, nil, readErr
+    }
+    length |= int(b & 0x7f) << shift
+    if b & 0x80 == 0 {
+      break
+    }
+  }
+
+  body = make([]byte, length)
+  if _, err = io.ReadFull(r, body); err != nil {
+    return
+  }
+  return header & 0xf0, body, nil
+}
+
+func writeString(b *bytes.Buffer, s string) {
+  writeBytes(b, []byte(s))
+}
+
+func writeBytes(b *bytes.Buffer, data []byte) {
+  b.WriteByte(byte(len(data) >> 8))
+  b.WriteByte(byte(len(data)))
+  b.Write(data)
+}
+
+func connackReason(code byte) string {
+  switch code {
+  case 1:
+    return "unacceptable protocol version"
+  case 2:
+    return "client ID rejected"
+  case 3:
+    return "server unavailable"
+  case 4:
+    return "bad username or password"
+  case 5:
+    return "not authorised"
+  default:
+    return fmt.Sprintf("code %d", code)
+  }
+}
@@ -0,0 +1,201 @@
+package mqtt
+
+import (
+  "bufio"
+  "bytes"
+  "net"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestConnectPacket(t *testing.T) {
+  tests := []struct{
+    name string
+    opts Options
+    want []byte
+  }{
+    {
+      "minimal",
+      Options{ClientID: "c", KeepAlive: time.Minute},
+      []byte{0x10, 0x0d, 0, 4, 'M', 'Q', 'T', 'T', 4, 0x02, 0, 60, 0, 1, 'c'},
+    },
+    {
+      "will and login",
+      Options{ClientID: "c", Username: "u", Password: "p", KeepAlive: time.Minute, Will: &Message{Topic: "s", Payload: []byte("off"), Retain: true}},
+      []byte{
+        0x10, 0x1b, 0, 4, 'M', 'Q', 'T', 'T', 4, 0xe6, 0, 60, 0, 1, 'c',
+        0, 1, 's', 0, 3, 'o', 'f', 'f', 0, 1, 'u', 0, 1, 'p',
+      },
+    },
+    {
+      // A password can't be sent without a username
+      "password only",
+      Options{ClientID: "c", Password: "p"},
+      []byte{0x10, 0x0d, 0, 4, 'M', 'Q', 'T', 'T', 4, 0x02, 0, 0, 0, 1, 'c'},
+    },
+  }
+  for _, tt := range tests {
+    if got := connectPacket(tt.opts); !bytes.Equal(got, tt.want) {
+      t.Errorf("%s: got % x, want % x", tt.name, got, tt.want)
+    }
+  }
+}
+
+func TestRemainingLength(t *testing.T) {
+  tests := []struct{
+    length int
+    want []byte
+  }{
+    {0, []byte{0x00}},
+    {127, []byte{0x7f}},
+    {128, []byte{0x80, 0x01}},
+    {16383, []byte{0xff, 0x7f}},
+    {16384, []byte{0x80, 0x80, 0x01}},
+    {2097151, []byte{0xff, 0xff, 0x7f}},
+    {2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+  }
+  for _, tt := range tests {
+    p := packet(packetPublish, make([]byte, tt.length))
+    if got := p[1:len(p) - tt.length]; !bytes.Equal(got, tt.want) {
+      t.Errorf("%d: got % x, want % x", tt.length, got, tt.want)
+    }
+
+    packetType, body, err := readPacket(bufio.NewReader(bytes.NewReader(p)))
+    if err != nil || packetType != packetPublish || len(body) != tt.length {
+      t.Errorf("%d: read back type %x length %d, %v", tt.length, packetType, len(body), err)
+    }
+  }
+
+  // More than four length bytes is malformed
+  bad := []byte{packetPublish, 0x80, 0x80, 0x80, 0x80, 0x01}
+  if _, _, err := readPacket(bufio.NewReader(bytes.NewReader(bad))); err == nil {
+    t.Error("five byte remaining length read")
+  }
+}
+
+func TestFixedPackets(t *testing.T) {
+  if got := packet(packetPingreq, nil); !bytes.Equal(got, []byte{0xc0, 0x00}) {
+    t.Errorf("PINGREQ % x", got)
+  }
+  if got := packet(packetDisconnect, nil); !bytes.Equal(got, []byte{0xe0, 0x00}) {
+    t.Errorf("DISCONNECT % x", got)
+  }
+}
+
+// connect runs the handshake over a pipe, acting as a broker that answers
+// with code. The broker's end and a reader on it are returned.
+func connect(t *testing.T, opts Options, code byte) (c *Client, server net.Conn, reader *bufio.Reader, err error) {
+  client, server := net.Pipe()
+  reader = bufio.NewReader(server)
+
+  type result struct {
+    c *Client
+    err error
+  }
+  dialled := make(chan result, 1)
+  go func() {
+    c, err := handshake(client, opts)
+    dialled <- result{c, err}
+  }()
+
+  packetType, body, readErr := readPacket(reader)
+  if readErr != nil || packetType != packetConnect {
+    t.Fatalf("broker got packet type %x, %v", packetType, readErr)
+  }
+  if !bytes.Equal(packet(packetConnect, body), connectPacket(opts)) {
+    t.Errorf("broker got CONNECT % x", body)
+  }
+  if _, err := server.Write([]byte{packetConnack, 2, 0, code}); err != nil {
+    t.Fatal(err)
+  }
+  r := <-dialled
+  return r.c, server, reader, r.err
+}
+
+// next the raw header and body of the next packet the broker gets
+func next(t *testing.T, reader *bufio.Reader) (header byte, body []byte) {
+  peek, err := reader.Peek(1)
+  if err != nil {
+    t.Fatal(err)
+  }
+  header = peek[0]
+  if _, body, err = readPacket(reader); err != nil {
+    t.Fatal(err)
+  }
+  return
+}
+
+func TestRoundTrip(t *testing.T) {
+  opts := Options{
+    ClientID: "elements-test",
+    KeepAlive: 400 * time.Millisecond,
+    Will: &Message{Topic: "elements/status", Payload: []byte("offline"), Retain: true},
+  }
+  c, server, reader, err := connect(t, opts, 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer server.Close()
+
+  published := make(chan error, 1)
+  go func() {
+    published <- c.Publish(Message{Topic: "elements/1/temperature", Payload: []byte("72.5"), Retain: true})
+  }()
+  header, body := next(t, reader)
+  want := append([]byte{0, 22}, "elements/1/temperature72.5"...)
+  if header != packetPublish | 0x01 || !bytes.Equal(body, want) {
+    t.Errorf("PUBLISH header %x body %q", header, body)
+  }
+  if err := <-published; err != nil {
+    t.Fatal(err)
+  }
+
+  // Idle for half the keep alive gets a ping, which the broker answers
+  if header, _ := next(t, reader); header != packetPingreq {
+    t.Errorf("expected PINGREQ, got %x", header)
+  }
+  if _, err := server.Write([]byte{packetPingresp, 0}); err != nil {
+    t.Fatal(err)
+  }
+
+  closed := make(chan struct{})
+  go func() {
+    c.Close()
+    close(closed)
+  }()
+  if header, _ := next(t, reader); header != packetDisconnect {
+    t.Errorf("expected DISCONNECT, got %x", header)
+  }
+  <-closed
+  if c.Err() == nil || c.Publish(Message{Topic: "t"}) == nil {
+    t.Error("closed client still publishing")
+  }
+}
+
+func TestBrokerDrops(t *testing.T) {
+  c, server, _, err := connect(t, Options{ClientID: "c"}, 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+  server.Close()
+
+  deadline := time.Now().Add(5 * time.Second)
+  for c.Err() == nil {
+    if time.Now().After(deadline) {
+      t.Fatal("dropped connection not noticed")
+    }
+    time.Sleep(5 * time.Millisecond)
+  }
+  if c.Publish(Message{Topic: "t"}) == nil {
+    t.Error("published on a dropped connection")
+  }
+}
+
+func TestConnectRefused(t *testing.T) {
+  _, server, _, err := connect(t, Options{ClientID: "c", Username: "u", Password: "wrong"}, 5)
+  defer server.Close()
+  if err == nil || !strings.Contains(err.Error(), "not authorised") {
+    t.Errorf("refused connection gave %v", err)
+  }
+}
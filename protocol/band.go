@@ -0,0 +1,124 @@
+package protocol
+
+import (
+  "fmt"
+  "sort"
+  "strings"
+)
+
+// Band the channels and hop order used by ISS hardware sold for a region
+type Band struct {
+  Name string
+  // Channel frequencies in Hz, the radio tunes to the nearest step of its
+  // synthesiser
+  Channels []int
+  // Order in which the ISS visits Channels, each entry an index into Channels
+  HopPattern []int
+}
+
+var bands = map[string]Band{}
+
+// Regions Davis sells ISS hardware for whose channel tables aren't built in.
+// Australia (918 - 926 MHz) and New Zealand use their own tables but no
+// source we could check them against was available, so rather than ship
+// guessed frequencies adding them went back to the requester. Until someone
+// has a capture or Davis reference they're defined under bands in the
+// config.
+var unsupportedBands = map[string]string{
+  "AU": "Australia",
+  "NZ": "New Zealand",
+}
+
+func init() {
+  // 902 - 928 MHz ISM band used in North America
+  RegisterBand(Band{
+    Name: "US",
+    Channels: []int{
+      902381897, 902884521, 903385376, 903888062, 904389343, 904890625,
+      905391968, 905894592, 906395874, 906898071, 907399414, 907901123,
+      908402893, 908904663, 909406860, 909909058, 910409912, 910912109,
+      911413818, 911915161, 912417358, 912919067, 913420410, 913922607,
+      914424316, 914926575, 915427856, 915929138, 916431824, 916933533,
+      917434387, 917935669, 918438354, 918940125, 919441406, 919943604,
+      920445374, 920947083, 921448364, 921949707, 922451904, 922953186,
+      923456299, 923957153, 924458923, 924960205, 925462402, 925964600,
+      926466370, 926967651, 927469849,
+    },
+    HopPattern: []int{
+      18, 0, 19, 41, 25, 8, 47, 32, 13, 36, 22, 3, 29, 44, 16, 5, 27, 38,
+      10, 49, 21, 2, 30, 42, 14, 48, 7, 24, 34, 45, 1, 17, 39, 26, 9, 31,
+      50, 37, 12, 20, 33, 4, 43, 28, 15, 35, 6, 40, 11, 23, 46,
+    },
+  })
+
+  // 868 MHz SRD band used in Europe
+  RegisterBand(Band{
+    Name: "EU",
+    Channels: []int{
+      868066711, 868181885, 868297119, 868412292, 868527466,
+    },
+    HopPattern: []int{
+      0, 2, 4, 1, 3,
+    },
+  })
+}
+
+// RegisterBand adds a band to the registry, replacing any with the same name
+func RegisterBand(b Band) error {
+  if err := b.validate(); err != nil {
+    return err
+  }
+  bands[strings.ToUpper(b.Name)] = b
+  return nil
+}
+
+// LookupBand finds a registered band by name, case insensitively
+func LookupBand(name string) (Band, error) {
+  b, ok := bands[strings.ToUpper(name)]
+  if region, unsupported := unsupportedBands[strings.ToUpper(name)]; !ok && unsupported {
+    return b, fmt.Errorf("the %s (%s) band isn't built in, there's no verified channel table for it yet. Define its channels and hop pattern under bands in the config", strings.ToUpper(name), region)
+  }
+  if !ok {
+    return b, fmt.Errorf("unknown frequency band %q, known bands: %s", name, strings.Join(BandNames(), ", "))
+  }
+  return b, nil
+}
+
+// BandNames the names of every registered band
+func BandNames() (names []string) {
+  for _, b := range bands {
+    names = append(names, b.Name)
+  }
+  sort.Strings(names)
+  return
+}
+
+// Channel the frequency the ISS uses at a position in the hop pattern
+func (b Band) Channel(hopIndex int) int {
+  return b.Channels[b.HopPattern[hopIndex % len(b.HopPattern)]]
+}
+
+// validate checks the hop pattern visits every channel exactly once
+func (b Band) validate() error {
+  if b.Name == "" {
+    return fmt.Errorf("frequency band has no name")
+  }
+  if len(b.Channels) == 0 {
+    return fmt.Errorf("frequency band %s has no channels", b.Name)
+  }
+  if len(b.HopPattern) != len(b.Channels) {
+    return fmt.Errorf("frequency band %s has %d channels but a hop pattern of length %d", b.Name, len(b.Channels), len(b.HopPattern))
+  }
+
+  seen := make([]bool, len(b.Channels))
+  for _, index := range b.HopPattern {
+    if index < 0 || index >= len(b.Channels) {
+      return fmt.Errorf("frequency band %s hop pattern refers to channel %d which doesn't exist", b.Name, index)
+    }
+    if seen[index] {
+      return fmt.Errorf("frequency band %s hop pattern visits channel %d more than once", b.Name, index)
+    }
+    seen[index] = true
+  }
+  return nil
+}
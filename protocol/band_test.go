@@ -0,0 +1,48 @@
+package protocol
+
+import (
+  "strings"
+  "testing"
+)
+
+func TestLookupBand(t *testing.T) {
+  for _, name := range []string{"US", "eu"} {
+    if _, err := LookupBand(name); err != nil {
+      t.Errorf("%s: %s", name, err)
+    }
+  }
+  if _, err := LookupBand("XX"); err == nil {
+    t.Error("unknown band was found")
+  }
+}
+
+func TestUnsupportedBand(t *testing.T) {
+  _, err := LookupBand("AU")
+  if err == nil || !strings.Contains(err.Error(), "AU (Australia) band isn't built in") || !strings.Contains(err.Error(), "under bands") {
+    t.Fatalf("AU lookup gave %v", err)
+  }
+
+  // Defining the band in the config makes it available
+  defer delete(bands, "NZ")
+  if err := RegisterBand(Band{Name: "NZ", Channels: []int{921000000, 921500000}, HopPattern: []int{1, 0}}); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := LookupBand("nz"); err != nil {
+    t.Error(err)
+  }
+}
+
+func TestBandValidate(t *testing.T) {
+  bad := []Band{
+    {Name: "", Channels: []int{1}, HopPattern: []int{0}},
+    {Name: "x", Channels: nil, HopPattern: nil},
+    {Name: "x", Channels: []int{1, 2}, HopPattern: []int{0}},
+    {Name: "x", Channels: []int{1, 2}, HopPattern: []int{0, 0}},
+    {Name: "x", Channels: []int{1, 2}, HopPattern: []int{0, 2}},
+  }
+  for _, b := range bad {
+    if err := b.validate(); err == nil {
+      t.Errorf("%+v passed validation", b)
+    }
+  }
+}
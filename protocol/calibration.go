@@ -0,0 +1,134 @@
+package protocol
+
+import (
+  "fmt"
+  "math"
+)
+
+// Calibration corrects the value of a sensor that reads off, either with a
+// gain and offset or a polynomial. It's recorded on the readings it was
+// applied to so the value as sent can always be worked back to.
+type Calibration struct {
+  Sensor Sensor `json:"sensor"`
+  // Transmitter the calibration is for, 0 for every transmitter
+  Transmitter int `json:"transmitter,omitempty"`
+  Offset float64 `json:"offset"`
+  Gain float64 `json:"gain"`
+  // Coefficients from the constant term up, used instead of the gain and
+  // offset when set
+  Polynomial []float64 `json:"polynomial,omitempty"`
+}
+
+// NewCalibration sets up a calibration for a sensor by name. A gain of 0
+// means the value isn't scaled. Only sensors the ISS sends can be calibrated.
+// RainClicks only takes a gain, the amount each tip of the bucket is scaled
+// by for every transmitter, as the counter itself wraps.
+func NewCalibration(sensor string, transmitter int, offset float64, gain float64, polynomial []float64) (c Calibration, err error) {
+  c.Sensor, err = ParseSensor(sensor)
+  if err != nil {
+    return
+  }
+  switch c.Sensor {
+  case RainClicks:
+    if offset != 0 || len(polynomial) > 0 || gain < 0 {
+      return c, fmt.Errorf("%s only takes a gain, the amount each tip is scaled by", sensor)
+    }
+    if transmitter != 0 {
+      return c, fmt.Errorf("%s is calibrated for every transmitter, the rain totals are shared", sensor)
+    }
+  case SuperCapVoltage, Light:
+    return c, fmt.Errorf("%s is a health value and can't be calibrated", sensor)
+  }
+  if c.Sensor > 0xf {
+    return c, fmt.Errorf("%s is derived, calibrate the sensors it's derived from", sensor)
+  }
+  if transmitter < 0 || transmitter > 8 {
+    return c, fmt.Errorf("calibration for %s has invalid transmitter %d", sensor, transmitter)
+  }
+
+  c.Transmitter = transmitter
+  c.Offset = offset
+  c.Gain = gain
+  if c.Gain == 0 {
+    c.Gain = 1
+  }
+  c.Polynomial = append([]float64(nil), polynomial...)
+  return
+}
+
+// Apply the calibrated value for a value as sent
+func (c Calibration) Apply(v float64) float64 {
+  if len(c.Polynomial) == 0 {
+    return v * c.Gain + c.Offset
+  }
+  out := 0.0
+  for i := len(c.Polynomial) - 1; i >= 0; i-- {
+    out = out * v + c.Polynomial[i]
+  }
+  return out
+}
+
+// ParseSensor finds a sensor by the name it's logged and reported under
+func ParseSensor(name string) (Sensor, error) {
+  for s := 0; s <= 0xff; s++ {
+    if Sensor(s).String() == name {
+      return Sensor(s), nil
+    }
+  }
+  return 0, fmt.Errorf("unknown sensor %q", name)
+}
+
+// RainCalibration the gain applied to each rain tip, nil if there isn't one
+func (d Decoder) RainCalibration() *Calibration {
+  for _, c := range d.Calibrations {
+    if c.Sensor == RainClicks {
+      return &c
+    }
+  }
+  return nil
+}
+
+// calibrate applies the calibration for the reading's sensor, one for its
+// transmitter wins over one for every transmitter. The rain gain scales the
+// rain rate too unless it has a calibration of its own, the clicks counter
+// is left as sent for the rain totals to follow.
+func (d Decoder) calibrate(rd *Reading) {
+  // The ISS sends 0% humidity when the sensor has failed, that has to stay
+  // recognisable
+  if rd.NoSensor || rd.Sensor == RainClicks || (rd.Sensor == Humidity && rd.Value == 0) {
+    return
+  }
+
+  var found *Calibration
+  for i := range d.Calibrations {
+    c := &d.Calibrations[i]
+    if c.Sensor != rd.Sensor || (c.Transmitter != 0 && c.Transmitter != rd.StationID) {
+      continue
+    }
+    if found == nil || c.Transmitter != 0 {
+      found = c
+    }
+  }
+  if found == nil && rd.Sensor == RainRate {
+    found = d.RainCalibration()
+  }
+  if found == nil {
+    return
+  }
+
+  applied := *found
+  rd.UncalibratedValue = rd.Value
+  rd.Calibration = &applied
+  rd.Value = applied.Apply(rd.Value)
+
+  switch rd.Sensor {
+  case Humidity:
+    rd.Value = math.Max(0, math.Min(100, rd.Value))
+  case RainRate, UVIndex, SolarRadiation:
+    rd.Value = math.Max(0, rd.Value)
+  }
+  if rd.Sensor == RainRate {
+    rd.RainRateInHr = rd.Value
+    rd.RainRateMmHr = rd.Value * 25.4
+  }
+}
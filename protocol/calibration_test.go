@@ -0,0 +1,75 @@
+package protocol
+
+import (
+  "math"
+  "testing"
+  "github.com/NeilBetham/elements/radios"
+)
+
+func TestNewRainCalibration(t *testing.T) {
+  tests := []struct{
+    name string
+    transmitter int
+    offset float64
+    gain float64
+    polynomial []float64
+    ok bool
+  }{
+    {"gain", 0, 0, 1.05, nil, true},
+    {"no gain", 0, 0, 0, nil, true},
+    {"offset", 0, 0.01, 1, nil, false},
+    {"polynomial", 0, 0, 0, []float64{0, 1}, false},
+    {"negative gain", 0, 0, -1, nil, false},
+    {"one transmitter", 2, 0, 1.05, nil, false},
+  }
+
+  for _, tt := range tests {
+    c, err := NewCalibration("RainClicks", tt.transmitter, tt.offset, tt.gain, tt.polynomial)
+    if (err == nil) != tt.ok {
+      t.Errorf("%s: got error %v", tt.name, err)
+    }
+    if err == nil && c.Gain <= 0 {
+      t.Errorf("%s: gain %v", tt.name, c.Gain)
+    }
+  }
+}
+
+func TestRainGain(t *testing.T) {
+  rate := radios.Packet{Data: []byte{0x50, 0x00, 0x00, 0x78, 0x40, 0x00, 0, 0}}
+  clicks := radios.Packet{Data: []byte{0xe0, 0x00, 0x00, 0x0a, 0x00, 0x00, 0, 0}}
+  gain, err := NewCalibration("RainClicks", 0, 0, 1.1, nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  own, err := NewCalibration("RainRate", 0, 0, 2, nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  tests := []struct{
+    name string
+    calibrations []Calibration
+    inHr float64
+  }{
+    {"none", nil, 0.3},
+    {"rain gain", []Calibration{gain}, 0.33},
+    {"rain rate wins", []Calibration{gain, own}, 0.6},
+  }
+
+  for _, tt := range tests {
+    d := Decoder{Calibrations: tt.calibrations}
+    rd := d.ParsePacket(rate)
+    if math.Abs(rd.RainRateInHr - tt.inHr) > 1e-9 || math.Abs(rd.Value - tt.inHr) > 1e-9 {
+      t.Errorf("%s: got %v in/hr, want %v", tt.name, rd.RainRateInHr, tt.inHr)
+    }
+    if tt.calibrations != nil && (rd.Calibration == nil || math.Abs(rd.UncalibratedValue - 0.3) > 1e-9) {
+      t.Errorf("%s: calibration not recorded, %v from %v", tt.name, rd.Calibration, rd.UncalibratedValue)
+    }
+
+    // The counter stays as sent, the totals scale the tips
+    rd = d.ParsePacket(clicks)
+    if rd.Sensor != RainClicks || rd.Value != 10 || rd.Calibration != nil {
+      t.Errorf("%s: clicks decoded as %s %v %v", tt.name, rd.Sensor, rd.Value, rd.Calibration)
+    }
+  }
+}
@@ -0,0 +1,169 @@
+package protocol
+
+import (
+  "fmt"
+  "math"
+  "sort"
+)
+
+// Decoder turns packets into readings using settings that depend on how the
+// ISS is fitted out
+type Decoder struct {
+  // Size of the rain collector's tipping bucket
+  RainBucket RainBucket
+  // Kind of anemometer, the vane is read differently on each
+  Anemometer Anemometer
+  // Degrees added to the wind direction to correct a vane that isn't lined
+  // up with north
+  WindDirOffset float64
+  // Corrects the wind and gust speeds, nil to use them as sent
+  WindSpeedCorrection WindSpeedTable
+  // Corrections for sensors that read off
+  Calibrations []Calibration
+}
+
+// Anemometer the model of anemometer fitted to the ISS
+type Anemometer int
+
+const (
+  // Separate anemometer of the Vantage Pro2, its vane has a dead band around
+  // north so the 8 bits cover 9° to 351°
+  AnemometerVP2 Anemometer = iota
+  // Anemometer built into the Vantage Vue, the 8 bits cover the full circle
+  // in steps of 360/256°
+  AnemometerVue
+)
+
+// ParseAnemometer reads an anemometer model as written in the config, "vp2"
+// or "vue"
+func ParseAnemometer(s string) (Anemometer, error) {
+  switch s {
+  case "", "vp2":
+    return AnemometerVP2, nil
+  case "vue":
+    return AnemometerVue, nil
+  default:
+    return AnemometerVP2, fmt.Errorf("unknown anemometer %q, expected vp2 or vue", s)
+  }
+}
+
+func (a Anemometer) String() string {
+  if a == AnemometerVue {
+    return "vue"
+  }
+  return "vp2"
+}
+
+// WindDir the direction in degrees for the vane byte of a packet, ok is false
+// when the vane isn't reporting. A 0 byte is what the ISS sends with no vane
+// connected.
+func (a Anemometer) WindDir(raw byte) (dir float64, ok bool) {
+  if raw == 0 {
+    return 0, false
+  }
+  if a == AnemometerVue {
+    return float64(raw) * 360 / 256, true
+  }
+  return 9 + float64(raw) * 342 / 255, true
+}
+
+// WindSpeedPoint a speed as sent and what it really is, both in mph
+type WindSpeedPoint struct {
+  Raw float64
+  Mph float64
+}
+
+// WindSpeedTable corrects wind speeds by interpolating between points,
+// speeds past the last point are scaled by it
+type WindSpeedTable []WindSpeedPoint
+
+// NewWindSpeedTable sorts points into a table, no points means no
+// correction. Every point needs a raw speed above 0, calm is always calm.
+func NewWindSpeedTable(points []WindSpeedPoint) (t WindSpeedTable, err error) {
+  if len(points) == 0 {
+    return nil, nil
+  }
+  t = append(WindSpeedTable{}, points...)
+  sort.Slice(t, func(i, j int) bool { return t[i].Raw < t[j].Raw })
+  for i, p := range t {
+    if p.Raw <= 0 || p.Mph < 0 {
+      return nil, fmt.Errorf("wind speed correction point {raw: %v, mph: %v} needs raw above 0 and mph of 0 or more", p.Raw, p.Mph)
+    }
+    if i > 0 && p.Raw == t[i - 1].Raw {
+      return nil, fmt.Errorf("wind speed correction has %v mph twice", p.Raw)
+    }
+  }
+  return
+}
+
+// Correct the real speed for a speed as sent, interpolated from 0 below the
+// first point
+func (t WindSpeedTable) Correct(raw float64) float64 {
+  if len(t) == 0 {
+    return raw
+  }
+
+  last := WindSpeedPoint{}
+  for _, p := range t {
+    if raw <= p.Raw {
+      return last.Mph + (raw - last.Raw) * (p.Mph - last.Mph) / (p.Raw - last.Raw)
+    }
+    last = p
+  }
+  return raw * last.Mph / last.Raw
+}
+
+// windDir the calibrated wind direction for the vane byte of a packet
+func (d Decoder) windDir(raw byte) (dir float64, ok bool) {
+  dir, ok = d.Anemometer.WindDir(raw)
+  if !ok {
+    return
+  }
+  dir = math.Mod(dir + d.WindDirOffset, 360)
+  if dir < 0 {
+    dir += 360
+  }
+  return
+}
+
+// RainBucket the amount of rain that tips the rain collector once
+type RainBucket int
+
+const (
+  // 0.01 inch bucket fitted to US rain collectors
+  RainBucket001In RainBucket = iota
+  // 0.2 mm bucket fitted to metric rain collectors
+  RainBucket02Mm
+)
+
+// ParseRainBucket reads a bucket size as written in the config, "0.01in" or "0.2mm"
+func ParseRainBucket(s string) (RainBucket, error) {
+  switch s {
+  case "", "0.01in":
+    return RainBucket001In, nil
+  case "0.2mm":
+    return RainBucket02Mm, nil
+  default:
+    return RainBucket001In, fmt.Errorf("unknown rain bucket size %q, expected 0.01in or 0.2mm", s)
+  }
+}
+
+// Inches of rain per tip
+func (b RainBucket) Inches() float64 {
+  return b.Millimetres() / 25.4
+}
+
+// Millimetres of rain per tip
+func (b RainBucket) Millimetres() float64 {
+  if b == RainBucket02Mm {
+    return 0.2
+  }
+  return 0.254
+}
+
+func (b RainBucket) String() string {
+  if b == RainBucket02Mm {
+    return "0.2mm"
+  }
+  return "0.01in"
+}
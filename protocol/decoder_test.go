@@ -0,0 +1,95 @@
+package protocol
+
+import (
+  "math"
+  "testing"
+  "github.com/NeilBetham/elements/radios"
+)
+
+func TestNewWindSpeedTable(t *testing.T) {
+  tests := []struct{
+    name string
+    points []WindSpeedPoint
+    ok bool
+  }{
+    {"none", nil, true},
+    {"one", []WindSpeedPoint{{10, 11}}, true},
+    {"unsorted", []WindSpeedPoint{{50, 52}, {10, 10.5}}, true},
+    {"calm point", []WindSpeedPoint{{0, 0}, {10, 11}}, false},
+    {"negative raw", []WindSpeedPoint{{-5, 0}, {10, 11}}, false},
+    {"negative mph", []WindSpeedPoint{{10, -1}}, false},
+    {"repeated", []WindSpeedPoint{{10, 11}, {10, 12}}, false},
+  }
+  for _, tt := range tests {
+    _, err := NewWindSpeedTable(tt.points)
+    if (err == nil) != tt.ok {
+      t.Errorf("%s: got %v", tt.name, err)
+    }
+  }
+}
+
+func TestWindSpeedCorrect(t *testing.T) {
+  table, err := NewWindSpeedTable([]WindSpeedPoint{{50, 52}, {10, 10.5}})
+  if err != nil {
+    t.Fatal(err)
+  }
+  tests := []struct{
+    raw, want float64
+  }{
+    {0, 0},
+    {5, 5.25},
+    {10, 10.5},
+    {30, 31.25},
+    {50, 52},
+    {100, 104},
+  }
+  for _, tt := range tests {
+    got := table.Correct(tt.raw)
+    if math.IsNaN(got) || math.Abs(got - tt.want) > 1e-9 {
+      t.Errorf("%v mph corrected to %v, want %v", tt.raw, got, tt.want)
+    }
+  }
+}
+
+func TestWindDir(t *testing.T) {
+  tests := []struct{
+    name string
+    anemometer Anemometer
+    offset float64
+    raw byte
+    dir float64
+    ok bool
+  }{
+    {"vp2 no vane", AnemometerVP2, 0, 0, 0, false},
+    {"vp2 low end", AnemometerVP2, 0, 1, 9 + 342.0 / 255, true},
+    {"vp2 high end", AnemometerVP2, 0, 255, 351, true},
+    {"vue no vane", AnemometerVue, 0, 0, 0, false},
+    {"vue east", AnemometerVue, 0, 64, 90, true},
+    {"vue high end", AnemometerVue, 0, 255, 358.59375, true},
+    {"offset wraps", AnemometerVue, 10, 255, 8.59375, true},
+    {"negative offset wraps", AnemometerVue, -100, 64, 350, true},
+  }
+  for _, tt := range tests {
+    dir, ok := Decoder{Anemometer: tt.anemometer, WindDirOffset: tt.offset}.windDir(tt.raw)
+    if ok != tt.ok || math.Abs(dir - tt.dir) > 1e-9 {
+      t.Errorf("%s: got %v %v, want %v %v", tt.name, dir, ok, tt.dir, tt.ok)
+    }
+  }
+}
+
+// The gust carried by a gust packet is corrected the same as the wind speed
+// every packet has
+func TestGustSpeedCorrected(t *testing.T) {
+  table, err := NewWindSpeedTable([]WindSpeedPoint{{10, 11}})
+  if err != nil {
+    t.Fatal(err)
+  }
+  d := Decoder{WindSpeedCorrection: table}
+  rd := d.ParsePacket(radios.Packet{Data: []byte{0x90, 20, 0x40, 30, 0x00, 0x00, 0, 0}})
+  if rd.Sensor != WindGustSpeed {
+    t.Fatalf("decoded as %s", rd.Sensor)
+  }
+  if rd.WindSpeed != 22 || rd.Value != 33 {
+    t.Errorf("got wind %v gust %v mph, want 22 and 33", rd.WindSpeed, rd.Value)
+  }
+}
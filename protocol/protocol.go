@@ -13,152 +13,233 @@ type Hop struct {
   Freq int
   Dwell time.Duration
   HopIndex int
+  // Transmitter expected on this hop, 0 while searching
+  TransmitterID int
 }
 
 func (h Hop)String() string {
   return fmt.Sprintf(
-    "Freq: %d, Hop: %2d, Dwell: %3.2f",
+    "Freq: %d, Hop: %2d, Dwell: %3.2f, Transmitter: %d",
     h.Freq,
     h.HopIndex,
     h.Dwell.Seconds(),
+    h.TransmitterID,
   )
 }
 
 
+// HopTime the time an ISS with the given transmitter ID dwells on each channel
+func HopTime(transmitterID int) time.Duration {
+  return time.Duration(2562500 + ((transmitterID - 1) * 62500)) * time.Microsecond
+}
+
+// How long to keep listening past the time a packet is expected
+const listenWindow = 200 * time.Millisecond
+
+
+// ProtocolHandler follows the hop schedules of one or more ISS transmitters
+// and decodes the packets they send. While any transmitter is in sync the
+// radio is tuned to whichever of them is due to transmit next, transmitters
+// that are out of sync are picked up when they happen to transmit on the
+// channel being listened to. When nothing is in sync the handler parks on
+// each channel for a full hop cycle until a packet turns up.
 type ProtocolHandler struct {
   crc.CRC
-  stationID int
+  Decoder Decoder
 
-  hopTime time.Duration
-  hopIndex int
-  hopPattern []int
-  channels []int
+  band Band
+  transmitters []*transmitter
+  stats *statsCollector
 
-  goodPkts int
-  badPkts int
-  resync bool
+  // Channel the radio is tuned to and who we expect on it, nil when searching
+  tuned Hop
+  current *transmitter
 
-  lastPktReceived time.Time
+  searchIndex int
   lastHop time.Time
 }
 
-func NewProtocolHandler(stationNumber int) (ph ProtocolHandler){
+// NewProtocolHandler sets up a handler for the given transmitter IDs (1-8)
+// hopping over the channels of band
+func NewProtocolHandler(band Band, transmitterIDs []int) (ph ProtocolHandler){
   ph.CRC = crc.NewCRC("CCITT-16", 0, 0x1021, 0)
-  ph.stationID = stationNumber
-
-  ph.hopTime = time.Duration(2562500 + (stationNumber * 62500)) * time.Microsecond
-
-  ph.hopIndex = 0
-
-  ph.channels = []int{
-    901862125, 902364460, 902865026, 903367422, 903868415, 904369408,
-    904870462, 905372797, 905873790, 906375698, 906876752, 907378172,
-    907879653, 908381134, 908883042, 909384950, 909885516, 910387424,
-    910888844, 911389898, 911891806, 912393226, 912894280, 913396188,
-    913897608, 914399577, 914900570, 915401563, 915903959, 916405379,
-    916905945, 917406938, 917909334, 918410815, 918911808, 919413716,
-    919915197, 920416617, 920917610, 921418664, 921920572, 922421565,
-    922924388, 923424954, 923926435, 924427428, 924929336, 925431244,
-    925932725, 926433718, 926935626,
-  }
 
-  ph.hopPattern = []int{
-    18, 0, 19, 41, 25, 8, 47, 32, 13, 36, 22, 3, 29, 44, 16, 5, 27, 38,
-    10, 49, 21, 2, 30, 42, 14, 48, 7, 24, 34, 45, 1, 17, 39, 26, 9, 31,
-    50, 37, 12, 20, 33, 4, 43, 28, 15, 35, 6, 40, 11, 23, 46,
-  }
+  ph.band = band
 
-  ph.goodPkts = 0
-  ph.badPkts = 0
-  ph.resync = true
+  for _, id := range transmitterIDs {
+    ph.transmitters = append(ph.transmitters, newTransmitter(id))
+  }
+  ph.stats = newStatsCollector(transmitterIDs)
 
-  ph.lastPktReceived = time.Now()
+  ph.searchIndex = 0
   ph.lastHop = time.Now()
   return
 }
 
+// HandlePacket processes the result of listening on the tuned channel, hop
+// is true when the radio should move on to the channel given by NextHop
 func (ph *ProtocolHandler) HandlePacket(pkt radios.Packet, timedout bool) (hop bool, rd Reading){
+  now := time.Now()
+
+  if timedout {
+    if ph.current != nil {
+      ph.missedPkt(now)
+      hop = true
+      return
+    }
+    hop = ph.searchExpired(now)
+    return
+  }
+
   for index, data := range pkt.Data {
     pkt.Data[index] = swapBitOrder(data)
   }
 
-  if ph.Checksum(pkt.Data) != 0 || timedout {
-    if !timedout{
-      log.Printf("Bad: %s", pkt)
+  // Anything too short to hold the sensor data and CRC is noise as well
+  if len(pkt.Data) < PacketLength || ph.Checksum(pkt.Data) != 0 {
+    log.Printf("Bad: %s", pkt)
+    ph.stats.crcFailure(ph.tuned.Freq)
+    if ph.current == nil {
+      hop = ph.searchExpired(now)
+      return
     }
-    ph.invalidPkt()
-    if !timedout && (time.Now().UnixNano() < (ph.lastPktReceived.Add(ph.hopTime).Add(-10 * time.Millisecond)).UnixNano()) {
+
+    // Noise ahead of the expected packet, keep listening for the real thing
+    if now.Before(ph.current.nextTx.Add(-10 * time.Millisecond)) {
       hop = false
       return
     }
-  } else if int(pkt.Data[0] & 0x0f) != ph.stationID  {
-    log.Printf("Wrong Station: %s", pkt)
-    hop = false
+    ph.missedPkt(now)
+    hop = true
     return
-  } else {
-    log.Printf("%s", pkt)
+  }
 
-    ph.validPkt(pkt)
-    rd = ParsePacket(pkt)
-    rd.Valid = true
-    hop = true
+  tx := ph.transmitter(int(pkt.Data[0] & 0x07) + 1)
+  if tx == nil {
+    log.Printf("Wrong Station: %s", pkt)
+    ph.stats.wrongStation()
+    hop = false
     return
   }
 
-  if ph.resync {
-    if ph.lastHop.Add(ph.hopTime * time.Duration(len(ph.channels))).Before(time.Now()) {
-      ph.lastHop = time.Now()
-      hop = true
-    } else {
-      hop = false
+  log.Printf("%s", pkt)
+  tx.validPkt(now, (ph.tuned.HopIndex + 1) % len(ph.band.HopPattern))
+  ph.stats.packetReceived(tx.id, ph.tuned.Freq, pkt.Rssi, pkt.FreqErr, now)
+  rd = ph.Decoder.ParsePacket(pkt)
+  rd.Timestamp = now
+  rd.Valid = true
+
+  // Another transmitter turning up while we wait on this channel for the
+  // current one shouldn't pull us off before its slot
+  hop = ph.current == nil || tx == ph.current
+  return
+}
+
+// NextHop picks the channel to listen on next and tunes the handler to it
+func (ph *ProtocolHandler) NextHop() (hop Hop){
+  now := time.Now()
+
+  ph.current = nil
+  for _, tx := range ph.transmitters {
+    if tx.resync {
+      continue
+    }
+    tx.skipTo(now.Add(-listenWindow), len(ph.band.HopPattern))
+    if ph.current == nil || tx.nextTx.Before(ph.current.nextTx) {
+      ph.current = tx
     }
+  }
+
+  if ph.current != nil {
+    hop.HopIndex = ph.current.hopIndex
+    hop.TransmitterID = ph.current.id
+    hop.Dwell = ph.current.nextTx.Sub(now)
   } else {
-    ph.lastHop = time.Now()
-    hop = true
+    hop.HopIndex = ph.searchIndex
+    hop.Dwell = ph.searchCycle()
+    ph.searchIndex = (ph.searchIndex + 1) % len(ph.band.HopPattern)
+    ph.lastHop = now
   }
+  hop.Freq = ph.band.Channel(hop.HopIndex)
+
+  ph.tuned = hop
+  ph.stats.tuned(hop)
   return
 }
 
-func (ph *ProtocolHandler) invalidPkt(){
-  ph.badPkts++
-  if ph.badPkts > 5 && !ph.resync {
-    log.Printf("Out of sync with transmitter, resyncing...")
-    ph.resync = true
-    ph.badPkts = 0
+// ListenTimeout how long the radio should wait for a packet on the tuned channel
+func (ph *ProtocolHandler) ListenTimeout() time.Duration {
+  if ph.current == nil {
+    return ph.slowestHopTime() + listenWindow
   }
-}
 
-func (ph *ProtocolHandler) validPkt(pkt radios.Packet) {
-  if ph.resync {
-    ph.resync = false
+  timeout := time.Until(ph.current.nextTx) + listenWindow
+  if timeout < 0 {
+    timeout = 0
   }
+  return timeout
+}
 
-  ph.badPkts = 0
-  ph.goodPkts++
-  ph.lastPktReceived = time.Now()
+// Stats returns a copy of the reception statistics, safe to call from any
+// goroutine
+func (ph *ProtocolHandler) Stats() Stats {
+  return ph.stats.snapshot(time.Now())
 }
 
-func (ph *ProtocolHandler) NextHop() (hop Hop){
-  hop.Freq = ph.channels[ph.hopPattern[ph.hopIndex]]
-  hop.HopIndex = ph.hopIndex
-  hop.Dwell = ph.hopTime
+// RestoreStats carries on counting from statistics saved by a previous run
+func (ph *ProtocolHandler) RestoreStats(s Stats) {
+  ph.stats.restore(s)
+}
 
-  ph.hopIndex++
-  if ph.hopIndex > 50 {
-    ph.hopIndex = 0
+// InSync whether any transmitter is in sync
+func (ph *ProtocolHandler) InSync() bool {
+  for _, tx := range ph.transmitters {
+    if !tx.resync {
+      return true
+    }
   }
-  return
+  return false
 }
 
+// CurrentChannel the frequency the handler last tuned to
 func (ph *ProtocolHandler) CurrentChannel() (freq int){
-  hopIndex := ph.hopIndex
-  if hopIndex == 0 {
-    hopIndex = 50
-  } else {
-    hopIndex--
+  return ph.tuned.Freq
+}
+
+// missedPkt records that the transmitter we were waiting for didn't show
+func (ph *ProtocolHandler) missedPkt(now time.Time) {
+  ph.stats.missedSlot(ph.current.id, ph.tuned.Freq)
+  if ph.current.missedPkt(len(ph.band.HopPattern)) {
+    ph.stats.lostSync(ph.current.id, now)
   }
+}
+
+func (ph *ProtocolHandler) transmitter(id int) *transmitter {
+  for _, tx := range ph.transmitters {
+    if tx.id == id {
+      return tx
+    }
+  }
+  return nil
+}
 
-  return ph.channels[ph.hopPattern[hopIndex]]
+// searchExpired whether we've parked on the search channel long enough to
+// have heard every transmitter pass through it
+func (ph *ProtocolHandler) searchExpired(now time.Time) bool {
+  return ph.lastHop.Add(ph.searchCycle()).Before(now)
+}
+
+func (ph *ProtocolHandler) searchCycle() time.Duration {
+  return ph.slowestHopTime() * time.Duration(len(ph.band.Channels))
+}
+
+func (ph *ProtocolHandler) slowestHopTime() (hopTime time.Duration) {
+  for _, tx := range ph.transmitters {
+    if tx.hopTime > hopTime {
+      hopTime = tx.hopTime
+    }
+  }
+  return
 }
 
 func swapBitOrder(b byte) byte {
@@ -0,0 +1,29 @@
+package protocol
+
+import (
+  "testing"
+  "github.com/NeilBetham/elements/radios"
+)
+
+func TestHandlePacketShort(t *testing.T) {
+  band, err := LookupBand("US")
+  if err != nil {
+    t.Fatal(err)
+  }
+  ph := NewProtocolHandler(band, []int{1})
+  ph.NextHop()
+
+  for _, data := range [][]byte{nil, {}, {0x80}, {0x80, 0, 0, 0, 0, 0, 0}} {
+    _, rd := ph.HandlePacket(radios.Packet{Data: data}, false)
+    if rd.Valid {
+      t.Errorf("%d byte packet gave a valid reading", len(data))
+    }
+  }
+}
+
+func TestParsePacketShort(t *testing.T) {
+  rd := ParsePacket(radios.Packet{Data: []byte{0x80, 1, 2}})
+  if rd.Valid || rd.Sensor != 0 {
+    t.Errorf("short packet decoded as %v", rd)
+  }
+}
@@ -3,22 +3,47 @@ package protocol
 import (
   "log"
   "fmt"
+  "time"
   "encoding/binary"
   "github.com/NeilBetham/elements/radios"
 )
 
 type Reading struct {
+  // ID (1-8) of the transmitter the reading came from
   StationID int
+  // When the packet carrying the reading was received
+  Timestamp time.Time
   Sensor Sensor
   SensorName string
   Value float64
   RawValue uint32
+  // Value before calibration and the calibration applied, unset if the
+  // sensor isn't calibrated
+  UncalibratedValue float64
+  Calibration *Calibration
   Valid bool
+  // Set when the transmitter reports the sensor isn't fitted, Value is 0
+  NoSensor bool
+  // Set for readings calculated by the receiver rather than sent by the ISS,
+  // these carry no wind data
+  Derived bool
 
   WindSpeed float64
   WindDir float64
+  // Set when the vane isn't reporting, WindDir is 0
+  NoWindDir bool
+
+  // Rain rate, only set for RainRate readings
+  RainRateInHr float64
+  RainRateMmHr float64
 
   StationBatLow bool
+
+  // Reception details of the packet the reading came in, unset for derived
+  // readings
+  Freq int
+  Rssi float64
+  FreqErr int
 }
 
 func (r Reading) String() string {
@@ -29,19 +54,42 @@ func (r Reading) String() string {
     batLow = "no"
   }
 
+  value := fmt.Sprintf("%f", r.Value)
+  if r.NoSensor {
+    value = "no sensor"
+  }
+
+  windDir := fmt.Sprintf("%3.0f", r.WindDir)
+  if r.NoWindDir {
+    windDir = "no vane"
+  }
+
   return fmt.Sprintf(
-    "Reading for %s, station: %d, wind speed: %2.0f, wind direction: %3.0f, value: %f, battery low: %s",
+    "Reading for %s, station: %d, wind speed: %2.0f, wind direction: %s, value: %s, battery low: %s",
     r.SensorName,
     r.StationID,
     r.WindSpeed,
-    r.WindDir,
-    r.Value,
+    windDir,
+    value,
     batLow,
   )
 }
 
+// ParsePacket decodes a packet assuming a 0.01" rain bucket
 func ParsePacket(pkt radios.Packet) (rd Reading){
-  rd.StationID = int((pkt.Data[0] & 0x0f) + 1)
+  return Decoder{}.ParsePacket(pkt)
+}
+
+// PacketLength the bytes an ISS packet needs, 6 of data and the CRC
+const PacketLength = 8
+
+// ParsePacket decodes a packet into a reading, packets shorter than
+// PacketLength give an invalid reading
+func (d Decoder) ParsePacket(pkt radios.Packet) (rd Reading){
+  if len(pkt.Data) < PacketLength {
+    return
+  }
+  rd.StationID = int((pkt.Data[0] & 0x07) + 1)
   rd.Sensor = Sensor((pkt.Data[0] & 0xf0) >> 4)
   rd.SensorName = fmt.Sprintf("%s", rd.Sensor)
   rd.StationBatLow = (pkt.Data[0] & 0x08) > 0
@@ -53,28 +101,37 @@ func ParsePacket(pkt radios.Packet) (rd Reading){
   case SuperCapVoltage:
     rd.Value = convertSuperCapVoltage(pkt.Data[3:6])
   case UVIndex:
-    rd.Value = 0
+    rd.Value, rd.NoSensor = convertUVIndex(pkt.Data[3:6])
   case RainRate:
-    rd.Value = convertRainRate(pkt.Data[3:6])
+    tipsPerHour := convertRainRate(pkt.Data[3:6])
+    rd.RainRateInHr = tipsPerHour * d.RainBucket.Inches()
+    rd.RainRateMmHr = tipsPerHour * d.RainBucket.Millimetres()
+    rd.Value = rd.RainRateInHr
   case SolarRadiation:
-    rd.Value = 0
+    rd.Value, rd.NoSensor = convertSolarRadiation(pkt.Data[3:6])
   case Light:
     rd.Value = convertLight(pkt.Data[3:6])
   case Temperature:
     rd.Value = convertTemperature(pkt.Data[3:6])
   case WindGustSpeed:
-    rd.Value = convertGustSpeed(pkt.Data[3:6])
+    rd.Value = d.WindSpeedCorrection.Correct(convertGustSpeed(pkt.Data[3:6]))
   case Humidity:
     rd.Value = convertHumidity(pkt.Data[3:6])
   case RainClicks:
     rd.Value = convertRainClicks(pkt.Data[3:6])
   default:
-    fmt.Sprintf("UnknownSensor-%0x", rd.Sensor)
     rd.Value = float64((int(pkt.Data[3]) << 16) | (int(pkt.Data[4]) << 8) | int(pkt.Data[5]))
   }
+  d.calibrate(&rd)
+
+  rd.WindSpeed = d.WindSpeedCorrection.Correct(float64(pkt.Data[1]))
+  windDir, ok := d.windDir(pkt.Data[2])
+  rd.WindDir = windDir
+  rd.NoWindDir = !ok
 
-  rd.WindSpeed = float64(pkt.Data[1])
-  rd.WindDir = ((float64(pkt.Data[2]) * 360) / 255)
+  rd.Freq = pkt.Freq
+  rd.Rssi = pkt.Rssi
+  rd.FreqErr = pkt.FreqErr
   return
 }
 
@@ -82,16 +139,42 @@ func convertSuperCapVoltage(data []byte) float64 {
   return (float64(uint(data[0]) << 2) + (float64(uint(data[1]) & 0xc0) / 64)) / 100
 }
 
+// UV and solar readings are 10 bits left aligned in the first two bytes, a
+// first byte of 0xff means the sensor isn't fitted
+func convertUVIndex(data []byte) (float64, bool) {
+  if data[0] == 0xff {
+    return 0, true
+  }
+  return float64((uint(data[0]) << 8 | uint(data[1])) >> 6) / 50, false
+}
+
+func convertSolarRadiation(data []byte) (float64, bool) {
+  if data[0] == 0xff {
+    return 0, true
+  }
+  return float64((uint(data[0]) << 8 | uint(data[1])) >> 6) * 1.757936, false
+}
+
+// convertRainRate returns the rain rate in bucket tips per hour. The ISS
+// sends the time between the last two tips as 10 bits, the first byte and
+// bits 5-4 of the second. Bit 6 of the second byte is set for light rain with
+// the time in seconds and clear for heavy rain with it in sixteenths of a
+// second, the same as the meteostick and rtl-sdr decoders used with weewx.
+// Once no tip has been seen for a while the first byte is 0xff, no rain.
 func convertRainRate(data []byte) float64 {
   if data[0] == 0xff{
     return 0
-  } else if data[1] & 0x40 == 0 {
-    return ((float64(uint(data[1]) & 0x30) / 16 * 250) + float64(data[0]))
-  } else if data[1] & 0x40 == 0x40 {
-    return ((float64(uint(data[1]) & 0x30) / 16 * 250) + float64(data[0])) / 16
   }
-  log.Printf("Unkown Rain Rate State")
-  return 0
+
+  interval := float64((uint(data[1]) & 0x30) << 4 | uint(data[0]))
+  if data[1] & 0x40 == 0 {
+    interval /= 16
+  }
+  if interval <= 0 {
+    log.Printf("Invalid rain rate interval")
+    return 0
+  }
+  return 3600 / interval
 }
 
 func convertLight(data []byte) float64 {
@@ -128,6 +211,44 @@ const (
   RainClicks      Sensor = 0xE
 )
 
+// Readings derived by the receiver from what the ISS sends, these sit above
+// the 4 bit range used on the air
+const (
+  RainTotal       Sensor = 0x20
+  RainLastHour    Sensor = 0x21
+  RainDaily       Sensor = 0x22
+  RainStorm       Sensor = 0x23
+  RainYearly      Sensor = 0x24
+
+  // Feels like temperatures calculated from the current conditions, in °F
+  // apart from humidex which has its own scale
+  DewPoint            Sensor = 0x25
+  HeatIndex           Sensor = 0x26
+  WindChill           Sensor = 0x27
+  THWIndex            Sensor = 0x28
+  THSWIndex           Sensor = 0x29
+  Humidex             Sensor = 0x2A
+  WetBulb             Sensor = 0x2B
+  ApparentTemperature Sensor = 0x2C
+
+  // Wind statistics, speeds in mph and directions in degrees
+  WindSpeedAvg2Min     Sensor = 0x2D
+  WindDirAvg2Min       Sensor = 0x2E
+  WindVectorSpeed2Min  Sensor = 0x2F
+  WindVectorDir2Min    Sensor = 0x30
+  WindSpeedAvg10Min    Sensor = 0x31
+  WindDirAvg10Min      Sensor = 0x32
+  WindVectorSpeed10Min Sensor = 0x33
+  WindVectorDir10Min   Sensor = 0x34
+  WindGust10Min        Sensor = 0x35
+  WindGustDir10Min     Sensor = 0x36
+  WindDirStdDev10Min   Sensor = 0x37
+  Beaufort             Sensor = 0x38
+
+  // Rain over the rolling last 24 hours, unlike the rain day it never resets
+  RainLast24h Sensor = 0x39
+)
+
 func (r Sensor) String() string {
   switch r {
   case SuperCapVoltage:
@@ -148,6 +269,58 @@ func (r Sensor) String() string {
     return "Humidity"
   case RainClicks:
     return "RainClicks"
+  case RainTotal:
+    return "RainTotal"
+  case RainLastHour:
+    return "RainLastHour"
+  case RainDaily:
+    return "RainDaily"
+  case RainStorm:
+    return "RainStorm"
+  case RainYearly:
+    return "RainYearly"
+  case DewPoint:
+    return "DewPoint"
+  case HeatIndex:
+    return "HeatIndex"
+  case WindChill:
+    return "WindChill"
+  case THWIndex:
+    return "THWIndex"
+  case THSWIndex:
+    return "THSWIndex"
+  case Humidex:
+    return "Humidex"
+  case WetBulb:
+    return "WetBulb"
+  case ApparentTemperature:
+    return "ApparentTemperature"
+  case WindSpeedAvg2Min:
+    return "WindSpeedAvg2Min"
+  case WindDirAvg2Min:
+    return "WindDirAvg2Min"
+  case WindVectorSpeed2Min:
+    return "WindVectorSpeed2Min"
+  case WindVectorDir2Min:
+    return "WindVectorDir2Min"
+  case WindSpeedAvg10Min:
+    return "WindSpeedAvg10Min"
+  case WindDirAvg10Min:
+    return "WindDirAvg10Min"
+  case WindVectorSpeed10Min:
+    return "WindVectorSpeed10Min"
+  case WindVectorDir10Min:
+    return "WindVectorDir10Min"
+  case WindGust10Min:
+    return "WindGust10Min"
+  case WindGustDir10Min:
+    return "WindGustDir10Min"
+  case WindDirStdDev10Min:
+    return "WindDirStdDev10Min"
+  case Beaufort:
+    return "Beaufort"
+  case RainLast24h:
+    return "RainLast24h"
   default:
     return fmt.Sprintf("Unknown Reading Type: %0x", uint(r))
   }
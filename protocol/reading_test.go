@@ -0,0 +1,36 @@
+package protocol
+
+import (
+  "math"
+  "testing"
+  "github.com/NeilBetham/elements/radios"
+)
+
+// The packets are laid out the way the meteostick and rtl-sdr decoders used
+// with weewx read them, they weren't captured off a real ISS
+func TestRainRate(t *testing.T) {
+  tests := []struct{
+    name string
+    data []byte
+    bucket RainBucket
+    inHr float64
+  }{
+    {"no rain", []byte{0x50, 0x00, 0x00, 0xff, 0x71, 0x00, 0, 0}, RainBucket001In, 0},
+    {"light 120s", []byte{0x50, 0x00, 0x00, 0x78, 0x40, 0x00, 0, 0}, RainBucket001In, 0.3},
+    {"light 300s high bits", []byte{0x50, 0x00, 0x00, 0x2c, 0x51, 0x00, 0, 0}, RainBucket001In, 0.12},
+    {"light 900s", []byte{0x50, 0x00, 0x00, 0x84, 0x73, 0x00, 0, 0}, RainBucket001In, 0.04},
+    {"heavy 4s", []byte{0x50, 0x00, 0x00, 0x40, 0x00, 0x00, 0, 0}, RainBucket001In, 9},
+    {"heavy 36s high bits", []byte{0x50, 0x00, 0x00, 0x40, 0x22, 0x00, 0, 0}, RainBucket001In, 1},
+    {"light 120s 0.2mm", []byte{0x50, 0x00, 0x00, 0x78, 0x40, 0x00, 0, 0}, RainBucket02Mm, 6 / 25.4},
+  }
+
+  for _, tt := range tests {
+    rd := Decoder{RainBucket: tt.bucket}.ParsePacket(radios.Packet{Data: tt.data})
+    if rd.Sensor != RainRate {
+      t.Fatalf("%s: decoded as %s", tt.name, rd.Sensor)
+    }
+    if math.Abs(rd.RainRateInHr - tt.inHr) > 1e-9 || math.Abs(rd.RainRateMmHr - tt.inHr * 25.4) > 1e-9 {
+      t.Errorf("%s: got %v in/hr %v mm/hr, want %v in/hr", tt.name, rd.RainRateInHr, rd.RainRateMmHr, tt.inHr)
+    }
+  }
+}
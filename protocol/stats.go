@@ -0,0 +1,303 @@
+package protocol
+
+import (
+  "fmt"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+// Histogram bucket upper bounds for packet signal strength in dBm and
+// frequency error in Hz
+var (
+  RssiBuckets = []float64{-110, -100, -90, -80, -70, -60, -50, -40, -30}
+  FreqErrBuckets = []float64{-20000, -10000, -5000, -2000, -1000, 0, 1000, 2000, 5000, 10000, 20000}
+)
+
+// Stats reception statistics since the handler started
+type Stats struct {
+  Start time.Time `json:"start"`
+
+  PacketsReceived int `json:"packets_received"`
+  CRCFailures int `json:"crc_failures"`
+  WrongStation int `json:"wrong_station"`
+  MissedSlots int `json:"missed_slots"`
+  Resyncs int `json:"resyncs"`
+
+  Transmitters map[int]*TransmitterStats `json:"transmitters"`
+  Channels map[int]*ChannelStats `json:"channels"`
+
+  // Where in the hop pattern the radio was last tuned
+  HopIndex int `json:"hop_index"`
+  Freq int `json:"freq"`
+}
+
+// TransmitterStats reception statistics for a single ISS
+type TransmitterStats struct {
+  ID int `json:"id"`
+  InSync bool `json:"in_sync"`
+  SyncedAt time.Time `json:"synced_at"`
+  TimeInSync time.Duration `json:"time_in_sync"`
+
+  PacketsReceived int `json:"packets_received"`
+  MissedSlots int `json:"missed_slots"`
+  Resyncs int `json:"resyncs"`
+  LastPacket time.Time `json:"last_packet"`
+}
+
+// ChannelStats reception statistics for a single channel
+type ChannelStats struct {
+  Freq int `json:"freq"`
+  PacketsReceived int `json:"packets_received"`
+  CRCFailures int `json:"crc_failures"`
+  MissedSlots int `json:"missed_slots"`
+  Rssi Histogram `json:"rssi"`
+  FreqErr Histogram `json:"freq_err"`
+}
+
+// Histogram counts of observations falling at or below each bound, the last
+// count holds everything above the highest bound
+type Histogram struct {
+  Bounds []float64 `json:"bounds"`
+  Counts []int `json:"counts"`
+  Sum float64 `json:"sum"`
+  Count int `json:"count"`
+}
+
+func newHistogram(bounds []float64) (h Histogram) {
+  h.Bounds = bounds
+  h.Counts = make([]int, len(bounds) + 1)
+  return
+}
+
+func (h *Histogram) observe(v float64) {
+  index := sort.SearchFloat64s(h.Bounds, v)
+  h.Counts[index]++
+  h.Sum += v
+  h.Count++
+}
+
+// Mean of every observation, 0 if there are none
+func (h Histogram) Mean() float64 {
+  if h.Count == 0 {
+    return 0
+  }
+  return h.Sum / float64(h.Count)
+}
+
+func (h Histogram) copy() Histogram {
+  h.Bounds = append([]float64(nil), h.Bounds...)
+  h.Counts = append([]int(nil), h.Counts...)
+  return h
+}
+
+// ReceptionPct packets received as a percentage of those expected while in
+// sync, the same figure a Davis console shows
+func (s TransmitterStats) ReceptionPct() float64 {
+  expected := s.PacketsReceived + s.MissedSlots
+  if expected == 0 {
+    return 0
+  }
+  return float64(s.PacketsReceived) * 100 / float64(expected)
+}
+
+// ReceptionPct packets received as a percentage of those expected across
+// every transmitter
+func (s Stats) ReceptionPct() float64 {
+  expected := s.PacketsReceived + s.MissedSlots
+  if expected == 0 {
+    return 0
+  }
+  return float64(s.PacketsReceived) * 100 / float64(expected)
+}
+
+// TimeInSync the longest any transmitter has been in sync
+func (s Stats) TimeInSync() (d time.Duration) {
+  for _, tx := range s.Transmitters {
+    if tx.TimeInSync > d {
+      d = tx.TimeInSync
+    }
+  }
+  return
+}
+
+func (s Stats) String() string {
+  var ids []int
+  for id := range s.Transmitters {
+    ids = append(ids, id)
+  }
+  sort.Ints(ids)
+
+  var txs []string
+  for _, id := range ids {
+    tx := s.Transmitters[id]
+    txs = append(txs, fmt.Sprintf(
+      "[ID %d in sync: %t, received: %d, missed: %d, reception: %3.0f%%]",
+      tx.ID,
+      tx.InSync,
+      tx.PacketsReceived,
+      tx.MissedSlots,
+      tx.ReceptionPct(),
+    ))
+  }
+
+  return fmt.Sprintf(
+    "Received: %d, CRC failures: %d, missed: %d, resyncs: %d, reception: %3.0f%%, transmitters: %s",
+    s.PacketsReceived,
+    s.CRCFailures,
+    s.MissedSlots,
+    s.Resyncs,
+    s.ReceptionPct(),
+    strings.Join(txs, " "),
+  )
+}
+
+// statsCollector records reception events, it's shared with anything
+// querying stats from another goroutine
+type statsCollector struct {
+  mu sync.Mutex
+  stats Stats
+}
+
+func newStatsCollector(transmitterIDs []int) (c *statsCollector) {
+  c = &statsCollector{}
+  c.stats.Start = time.Now()
+  c.stats.Transmitters = make(map[int]*TransmitterStats)
+  c.stats.Channels = make(map[int]*ChannelStats)
+  for _, id := range transmitterIDs {
+    c.stats.Transmitters[id] = &TransmitterStats{ID: id}
+  }
+  return
+}
+
+func (c *statsCollector) channel(freq int) *ChannelStats {
+  ch, ok := c.stats.Channels[freq]
+  if !ok {
+    ch = &ChannelStats{
+      Freq: freq,
+      Rssi: newHistogram(RssiBuckets),
+      FreqErr: newHistogram(FreqErrBuckets),
+    }
+    c.stats.Channels[freq] = ch
+  }
+  return ch
+}
+
+func (c *statsCollector) packetReceived(id int, freq int, rssi float64, freqErr int, now time.Time) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  c.stats.PacketsReceived++
+  tx := c.stats.Transmitters[id]
+  tx.PacketsReceived++
+  tx.LastPacket = now
+  if !tx.InSync {
+    tx.InSync = true
+    tx.SyncedAt = now
+  }
+
+  ch := c.channel(freq)
+  ch.PacketsReceived++
+  ch.Rssi.observe(rssi)
+  ch.FreqErr.observe(float64(freqErr))
+}
+
+func (c *statsCollector) crcFailure(freq int) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  c.stats.CRCFailures++
+  c.channel(freq).CRCFailures++
+}
+
+func (c *statsCollector) wrongStation() {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  c.stats.WrongStation++
+}
+
+func (c *statsCollector) missedSlot(id int, freq int) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  c.stats.MissedSlots++
+  c.stats.Transmitters[id].MissedSlots++
+  c.channel(freq).MissedSlots++
+}
+
+func (c *statsCollector) lostSync(id int, now time.Time) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  c.stats.Resyncs++
+  tx := c.stats.Transmitters[id]
+  tx.Resyncs++
+  tx.InSync = false
+  tx.TimeInSync += now.Sub(tx.SyncedAt)
+}
+
+func (c *statsCollector) tuned(hop Hop) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  c.stats.HopIndex = hop.HopIndex
+  c.stats.Freq = hop.Freq
+}
+
+// snapshot a deep copy of the stats with time in sync brought up to now
+func (c *statsCollector) snapshot(now time.Time) (s Stats) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  s = c.stats
+  s.Transmitters = make(map[int]*TransmitterStats)
+  for id, tx := range c.stats.Transmitters {
+    txCopy := *tx
+    if txCopy.InSync {
+      txCopy.TimeInSync += now.Sub(txCopy.SyncedAt)
+    }
+    s.Transmitters[id] = &txCopy
+  }
+  s.Channels = make(map[int]*ChannelStats)
+  for freq, ch := range c.stats.Channels {
+    chCopy := *ch
+    chCopy.Rssi = ch.Rssi.copy()
+    chCopy.FreqErr = ch.FreqErr.copy()
+    s.Channels[freq] = &chCopy
+  }
+  return
+}
+
+// restore carries on counting from stats saved by a previous run, nothing
+// is in sync after a restart
+func (c *statsCollector) restore(saved Stats) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  c.stats.Start = saved.Start
+  c.stats.PacketsReceived = saved.PacketsReceived
+  c.stats.CRCFailures = saved.CRCFailures
+  c.stats.WrongStation = saved.WrongStation
+  c.stats.MissedSlots = saved.MissedSlots
+  c.stats.Resyncs = saved.Resyncs
+
+  for id, tx := range saved.Transmitters {
+    if _, ok := c.stats.Transmitters[id]; !ok || tx == nil {
+      continue
+    }
+    txCopy := *tx
+    txCopy.InSync = false
+    c.stats.Transmitters[id] = &txCopy
+  }
+  for freq, ch := range saved.Channels {
+    if ch == nil || len(ch.Rssi.Counts) != len(RssiBuckets) + 1 || len(ch.FreqErr.Counts) != len(FreqErrBuckets) + 1 {
+      continue
+    }
+    chCopy := *ch
+    chCopy.Rssi = ch.Rssi.copy()
+    chCopy.FreqErr = ch.FreqErr.copy()
+    c.stats.Channels[freq] = &chCopy
+  }
+}
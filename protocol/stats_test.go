@@ -0,0 +1,148 @@
+package protocol
+
+import (
+  "testing"
+  "time"
+)
+
+func TestHistogram(t *testing.T) {
+  tests := []struct{
+    value float64
+    bucket int
+  }{
+    {-120, 0},
+    {-110, 0},
+    {-105, 1},
+    {-60, 5},
+    {-30, 8},
+    {-20, 9},
+  }
+  for _, tt := range tests {
+    h := newHistogram(RssiBuckets)
+    h.observe(tt.value)
+    if h.Counts[tt.bucket] != 1 || h.Count != 1 || h.Sum != tt.value {
+      t.Errorf("%v dBm counted as %v", tt.value, h.Counts)
+    }
+  }
+
+  h := newHistogram(FreqErrBuckets)
+  if h.Mean() != 0 {
+    t.Errorf("empty histogram has mean %v", h.Mean())
+  }
+  for _, v := range []float64{-1500, 500, 2500} {
+    h.observe(v)
+  }
+  if h.Mean() != 500 || h.Counts[4] != 1 || h.Counts[6] != 1 || h.Counts[8] != 1 {
+    t.Errorf("got %v with mean %v", h.Counts, h.Mean())
+  }
+}
+
+func TestReceptionPct(t *testing.T) {
+  tests := []struct{
+    received, missed int
+    pct float64
+  }{
+    {0, 0, 0},
+    {0, 5, 0},
+    {3, 1, 75},
+    {9, 1, 90},
+    {10, 0, 100},
+  }
+  for _, tt := range tests {
+    tx := TransmitterStats{PacketsReceived: tt.received, MissedSlots: tt.missed}
+    s := Stats{PacketsReceived: tt.received, MissedSlots: tt.missed}
+    if tx.ReceptionPct() != tt.pct || s.ReceptionPct() != tt.pct {
+      t.Errorf("%d received %d missed got %v and %v, want %v", tt.received, tt.missed, tx.ReceptionPct(), s.ReceptionPct(), tt.pct)
+    }
+  }
+}
+
+func TestStatsCollector(t *testing.T) {
+  start := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+  at := func(d time.Duration) time.Time { return start.Add(d) }
+  c := newStatsCollector([]int{1, 2})
+
+  c.packetReceived(1, 902381897, -70, 1500, at(0))
+  c.packetReceived(1, 902884521, -85, -500, at(time.Minute))
+  c.packetReceived(2, 902381897, -95, 0, at(time.Minute))
+  c.crcFailure(902381897)
+  c.wrongStation()
+  c.missedSlot(1, 902884521)
+  c.lostSync(1, at(10 * time.Minute))
+  c.packetReceived(1, 902381897, -60, 100, at(20 * time.Minute))
+  c.tuned(Hop{HopIndex: 7, Freq: 905894592})
+
+  s := c.snapshot(at(25 * time.Minute))
+  if s.PacketsReceived != 4 || s.CRCFailures != 1 || s.WrongStation != 1 || s.MissedSlots != 1 || s.Resyncs != 1 {
+    t.Errorf("totals %+v", s)
+  }
+  if s.HopIndex != 7 || s.Freq != 905894592 {
+    t.Errorf("tuned to hop %d at %d", s.HopIndex, s.Freq)
+  }
+
+  // In sync for 10 minutes, then again from 20 minutes on
+  tx := s.Transmitters[1]
+  if tx.PacketsReceived != 3 || tx.MissedSlots != 1 || tx.Resyncs != 1 || !tx.InSync || !tx.LastPacket.Equal(at(20 * time.Minute)) {
+    t.Errorf("transmitter 1 %+v", tx)
+  }
+  if tx.TimeInSync != 15 * time.Minute {
+    t.Errorf("transmitter 1 in sync for %s, want 15m", tx.TimeInSync)
+  }
+  if got := s.Transmitters[2].TimeInSync; got != 24 * time.Minute {
+    t.Errorf("transmitter 2 in sync for %s, want 24m", got)
+  }
+  if s.TimeInSync() != 24 * time.Minute {
+    t.Errorf("longest in sync %s, want 24m", s.TimeInSync())
+  }
+
+  ch := s.Channels[902381897]
+  if ch.PacketsReceived != 3 || ch.CRCFailures != 1 || ch.Rssi.Count != 3 || ch.Rssi.Counts[5] != 1 || ch.FreqErr.Counts[6] != 1 {
+    t.Errorf("channel %+v", ch)
+  }
+  if ch := s.Channels[902884521]; ch.PacketsReceived != 1 || ch.MissedSlots != 1 {
+    t.Errorf("channel %+v", ch)
+  }
+
+  // The snapshot is a copy
+  s.Transmitters[1].PacketsReceived = 100
+  s.Channels[902381897].Rssi.Counts[0] = 100
+  again := c.snapshot(at(25 * time.Minute))
+  if again.Transmitters[1].PacketsReceived != 3 || again.Channels[902381897].Rssi.Counts[0] != 0 {
+    t.Error("changing a snapshot changed the collector")
+  }
+}
+
+func TestStatsRestore(t *testing.T) {
+  start := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+  saved := newStatsCollector([]int{1, 3})
+  saved.packetReceived(1, 902381897, -70, 0, start)
+  saved.packetReceived(3, 902381897, -70, 0, start)
+  saved.missedSlot(1, 902884521)
+  snap := saved.snapshot(start.Add(time.Hour))
+  // A channel saved with other histogram bounds can't be carried on
+  snap.Channels[902884521].Rssi.Counts = []int{1}
+
+  c := newStatsCollector([]int{1, 2})
+  c.restore(snap)
+  s := c.snapshot(start.Add(2 * time.Hour))
+
+  if !s.Start.Equal(snap.Start) || s.PacketsReceived != 2 || s.MissedSlots != 1 {
+    t.Errorf("totals %+v", s)
+  }
+  tx := s.Transmitters[1]
+  if tx.InSync || tx.PacketsReceived != 1 || tx.MissedSlots != 1 || tx.TimeInSync != time.Hour {
+    t.Errorf("transmitter 1 %+v", tx)
+  }
+  if _, ok := s.Transmitters[3]; ok {
+    t.Error("transmitter that isn't followed any more was restored")
+  }
+  if tx := s.Transmitters[2]; tx == nil || tx.PacketsReceived != 0 {
+    t.Errorf("transmitter 2 %+v", tx)
+  }
+  if ch := s.Channels[902381897]; ch == nil || ch.PacketsReceived != 2 || ch.Rssi.Count != 2 {
+    t.Errorf("channel %+v", ch)
+  }
+  if _, ok := s.Channels[902884521]; ok {
+    t.Error("channel with the wrong histogram was restored")
+  }
+}
@@ -0,0 +1,76 @@
+package protocol
+
+import (
+  "log"
+  "time"
+)
+
+// transmitter hop schedule and sync state for a single ISS
+type transmitter struct {
+  id int
+  hopTime time.Duration
+
+  // Position in the hop pattern and time of the next expected packet
+  hopIndex int
+  nextTx time.Time
+
+  goodPkts int
+  badPkts int
+  resync bool
+
+  lastPktReceived time.Time
+}
+
+func newTransmitter(id int) (tx *transmitter) {
+  tx = &transmitter{}
+  tx.id = id
+  tx.hopTime = HopTime(id)
+  tx.resync = true
+  tx.lastPktReceived = time.Now()
+  return
+}
+
+// validPkt records a packet from this transmitter, nextHopIndex is where in
+// the hop pattern it will transmit next
+func (tx *transmitter) validPkt(now time.Time, nextHopIndex int) {
+  if tx.resync {
+    log.Printf("In sync with transmitter %d", tx.id)
+    tx.resync = false
+  }
+
+  tx.badPkts = 0
+  tx.goodPkts++
+  tx.lastPktReceived = now
+
+  tx.hopIndex = nextHopIndex
+  tx.nextTx = now.Add(tx.hopTime)
+}
+
+// missedPkt records that the packet expected in the current slot never
+// arrived and moves the schedule on to the next one, lost is true if that
+// took the transmitter out of sync
+func (tx *transmitter) missedPkt(patternLen int) (lost bool) {
+  tx.badPkts++
+  tx.advance(patternLen)
+
+  if tx.badPkts > 5 && !tx.resync {
+    log.Printf("Out of sync with transmitter %d, resyncing...", tx.id)
+    tx.resync = true
+    tx.badPkts = 0
+    lost = true
+  }
+  return
+}
+
+// skipTo moves the schedule past slots that were due before t without
+// counting them as missed, they were skipped while listening elsewhere
+func (tx *transmitter) skipTo(t time.Time, patternLen int) {
+  for tx.nextTx.Before(t) {
+    tx.advance(patternLen)
+  }
+}
+
+func (tx *transmitter) advance(patternLen int) {
+  tx.hopIndex = (tx.hopIndex + 1) % patternLen
+  tx.nextTx = tx.nextTx.Add(tx.hopTime)
+}
@@ -0,0 +1,27 @@
+package radios
+
+import (
+  "time"
+)
+
+// Radio is implemented by anything that can be tuned to a channel and
+// return Davis packets received on it
+type Radio interface {
+  // ReceiveData waits up to timeout for a packet on the current channel
+  ReceiveData(timeout time.Duration) (pkt Packet, timedout bool, err error)
+
+  // SetFreq tunes the radio to the given carrier frequency in Hz
+  SetFreq(freq uint32) error
+
+  // ReadRSSI returns the current received signal strength in dBm
+  ReadRSSI(manualStart bool) (float64, error)
+
+  // ReadFreqErr returns the current frequency error estimate in Hz
+  ReadFreqErr() (int, error)
+
+  // Reset puts the radio back into its power on state
+  Reset()
+
+  // Close releases the underlying device
+  Close() error
+}
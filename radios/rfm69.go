@@ -2,6 +2,7 @@ package radios
 
 import (
   "log"
+  "math"
   "reflect"
   "sort"
   "time"
@@ -11,6 +12,10 @@ import (
   "periph.io/x/periph/conn/gpio/gpioreg"
 )
 
+// Frequency synthesiser step, FXOSC / 2^19 with the 32 MHz crystal. The
+// carrier and FEI registers are in these steps.
+const fStep = 32000000.0 / (1 << 19)
+
 var regAddrs = map[string]uint8{
   "opMode": 0x01,
   "dataModulation": 0x02,
@@ -142,7 +147,7 @@ func newRFM69Regs() (r rfm69Regs){
 
 // RFM69 Handles communication and state for the RFM69 wireless radio
 type RFM69 struct {
-  port spi.Port
+  port spi.PortCloser
   freq  int32
   conn spi.Conn
   config rfm69Regs
@@ -152,6 +157,8 @@ type RFM69 struct {
   recvBytes []byte
 }
 
+var _ Radio = (*RFM69)(nil)
+
 // NewRFM69 sets up a new RFM69 class
 func NewRFM69(port string, resetPin string, interruptPin string) (r RFM69, err error) {
   p, openErr := spireg.Open(port)
@@ -161,12 +168,26 @@ func NewRFM69(port string, resetPin string, interruptPin string) (r RFM69, err e
     return
   }
 
+  // Setup the SPI connection with 5MHz baud, CPOL=0, CPHA=0, and 8 bit bytes
+  conn, err := p.Connect(5000000, spi.Mode0, 8)
+  if err != nil {
+    p.Close()
+    return
+  }
+
+  r, err = NewRFM69Conn(conn, gpioreg.ByName(resetPin), gpioreg.ByName(interruptPin))
   r.port = p
+  return
+}
+
+// NewRFM69Conn sets up an RFM69 on an already connected SPI bus and pins
+func NewRFM69Conn(conn spi.Conn, resetPin gpio.PinIO, interruptPin gpio.PinIO) (r RFM69, err error) {
+  r.conn = conn
   r.freq = 915000000
   r.recvBytes = make([]byte, 1)
   r.config = newRFM69Regs()
-  r.resetPin = gpioreg.ByName(resetPin)
-  r.interruptPin = gpioreg.ByName(interruptPin)
+  r.resetPin = resetPin
+  r.interruptPin = interruptPin
   r.interruptPin.In(gpio.PullDown, gpio.RisingEdge)
 
   r.Reset()
@@ -175,11 +196,12 @@ func NewRFM69(port string, resetPin string, interruptPin string) (r RFM69, err e
   return
 }
 
-// SetFreq Sets the carrier freq of the RFM69
+// SetFreq Sets the carrier freq of the RFM69 to the nearest synthesiser step
 func (r *RFM69) SetFreq(freq uint32) (err error){
-  r.config.carrierFreqLsb = uint8(freq / 61)
-  r.config.carrierFreqMid = uint8((freq / 61) >> 8)
-  r.config.carrierFreqMsb = uint8((freq / 61) >> 16)
+  frf := uint32(math.Round(float64(freq) / fStep))
+  r.config.carrierFreqLsb = uint8(frf)
+  r.config.carrierFreqMid = uint8(frf >> 8)
+  r.config.carrierFreqMsb = uint8(frf >> 16)
   err = r.syncRegs()
   return
 }
@@ -225,7 +247,8 @@ func (r *RFM69) ReceiveData(timeout time.Duration) (pkt Packet, timedout bool, e
   data, _ := r.readFifo()
 
   pkt.Data = data
-  pkt.Freq = int(uint(r.config.carrierFreqLsb) | (uint(r.config.carrierFreqMid) << 8) | (uint(r.config.carrierFreqMsb) << 16)) * 61
+  frf := uint(r.config.carrierFreqLsb) | (uint(r.config.carrierFreqMid) << 8) | (uint(r.config.carrierFreqMsb) << 16)
+  pkt.Freq = int(math.Round(float64(frf) * fStep))
   pkt.FreqErr = freqErr
   pkt.Rssi = rssi
   return
@@ -252,14 +275,7 @@ func (r *RFM69) DumpRegs() (err error){
 }
 
 func (r *RFM69) init() (err error){
-  // Setup the SPI connection with 5MHz baud, CPOL=0, CPHA=0, and 8 bit bytes
-  conn, err := r.port.Connect(5000000, spi.Mode0, 8)
-  if err != nil {
-    return err
-  }
-  r.conn = conn
-
-  r.syncRegs()
+  err = r.syncRegs()
   return
 }
 
@@ -318,7 +334,16 @@ func (r *RFM69) ReadRSSI(manualStart bool) (rssiVal float64, err error){
 func (r *RFM69) ReadFreqErr() (freqErr int, err error){
   feiMsb, _ := r.readReg(regAddrs["feiValMsb"])
   feiLsb, _ := r.readReg(regAddrs["feiValLsb"])
-  freqErr = int((int16(feiMsb) << 8) | int16(feiLsb)) * 61
+  freqErr = int(math.Round(float64((int16(feiMsb) << 8) | int16(feiLsb)) * fStep))
+  return
+}
+
+// Close puts the RFM69 into standby and releases the SPI port
+func (r *RFM69) Close() (err error){
+  r.setStdbyMode()
+  if r.port != nil {
+    err = r.port.Close()
+  }
   return
 }
 
@@ -0,0 +1,183 @@
+package radios_test
+
+import (
+  "math"
+  "testing"
+  "time"
+  "github.com/NeilBetham/elements/protocol"
+  "github.com/NeilBetham/elements/radios"
+  "github.com/NeilBetham/elements/radios/rfm69emu"
+)
+
+func newEmulated(t *testing.T) (*rfm69emu.Device, radios.RFM69) {
+  dev := rfm69emu.New()
+  rfm, err := radios.NewRFM69Conn(dev.Conn(), dev.ResetPin(), dev.InterruptPin())
+  if err != nil {
+    t.Fatal(err)
+  }
+  return dev, rfm
+}
+
+// Register image after the driver initialises the chip, every register not
+// listed is 0. Registers the chip handles itself hold what the chip puts
+// there rather than what was written.
+var initImage = map[uint8]byte{
+  0x01: 0x04, // Standby
+  0x02: 0x02, // FSK, Gaussian BT 0.5
+  0x03: 0x06, // 19200 bps
+  0x04: 0x83,
+  0x05: 0x00, // 9.5 kHz deviation
+  0x06: 0x9c,
+  0x07: 0x00, // No channel tuned yet
+  0x08: 0x00,
+  0x09: 0x00,
+  0x10: 0x24, // Version, read only
+  0x18: 0x00,
+  0x19: 0x4c,
+  0x1a: 0x4b,
+  0x1e: 0x0c,
+  0x23: 0x02, // RSSI done
+  0x24: 0xff,
+  0x25: 0x40,
+  0x27: 0x80, // Mode ready
+  0x29: 0x96,
+  0x2c: 0x00,
+  0x2d: 0x04,
+  0x2e: 0x8a,
+  0x2f: 0xcb,
+  0x30: 0x89,
+  0x37: 0x00,
+  0x38: 0x0a,
+  0x3d: 0x22,
+  0x6f: 0x30,
+}
+
+func expectImage(t *testing.T, dev *rfm69emu.Device, image map[uint8]byte) {
+  t.Helper()
+  regs := dev.Registers()
+  for addr := 0; addr < len(regs); addr++ {
+    if want := image[uint8(addr)]; regs[addr] != want {
+      t.Errorf("register 0x%02x is 0x%02x, expected 0x%02x", addr, regs[addr], want)
+    }
+  }
+}
+
+func TestRFM69InitRegisters(t *testing.T) {
+  dev, _ := newEmulated(t)
+  expectImage(t, dev, initImage)
+}
+
+// The carrier registers are the ones DavisRFM69 programs for the channel
+func TestRFM69SetFreq(t *testing.T) {
+  tests := []struct {
+    band string
+    channel int
+    frf [3]byte
+  }{
+    {"US", 0, [3]byte{0xe1, 0x98, 0x71}},
+    {"US", 27, [3]byte{0xe4, 0xfb, 0x77}},
+    {"US", 50, [3]byte{0xe7, 0xde, 0x12}},
+    {"EU", 0, [3]byte{0xd9, 0x04, 0x45}},
+    {"EU", 4, [3]byte{0xd9, 0x21, 0xc2}},
+  }
+
+  for _, test := range tests {
+    band, err := protocol.LookupBand(test.band)
+    if err != nil {
+      t.Fatal(err)
+    }
+    freq := band.Channels[test.channel]
+
+    dev, rfm := newEmulated(t)
+    if err := rfm.SetFreq(uint32(freq)); err != nil {
+      t.Fatal(err)
+    }
+
+    image := make(map[uint8]byte)
+    for addr, val := range initImage {
+      image[addr] = val
+    }
+    image[0x07], image[0x08], image[0x09] = test.frf[0], test.frf[1], test.frf[2]
+    expectImage(t, dev, image)
+
+    // The chip tunes to the nearest step of its synthesiser
+    if got := int(dev.Freq()); math.Abs(float64(got - freq)) > 31 {
+      t.Errorf("%s channel %d tuned to %d Hz, expected %d Hz", test.band, test.channel, got, freq)
+    }
+  }
+}
+
+// Carrier registers for each hop in the order the ISS visits them, as the
+// FRF_US and FRF_EU tables in DavisRFM69.h have them
+var davisFRF = map[string][][3]byte{
+  "US": {
+    {0xe3, 0xda, 0x7c}, {0xe1, 0x98, 0x71}, {0xe3, 0xfa, 0x92}, {0xe6, 0xbd, 0x01},
+    {0xe4, 0xbb, 0x4d}, {0xe2, 0x99, 0x56}, {0xe7, 0x7d, 0xbc}, {0xe5, 0x9c, 0x0e},
+    {0xe3, 0x39, 0xe6}, {0xe6, 0x1c, 0x81}, {0xe4, 0x5a, 0xe8}, {0xe1, 0xf8, 0xd6},
+    {0xe5, 0x3b, 0xbf}, {0xe7, 0x1d, 0x5f}, {0xe3, 0x9a, 0x3c}, {0xe2, 0x39, 0x00},
+    {0xe4, 0xfb, 0x77}, {0xe6, 0x5c, 0xb2}, {0xe2, 0xd9, 0x90}, {0xe7, 0xbd, 0xee},
+    {0xe4, 0x3a, 0xd2}, {0xe1, 0xd8, 0xaa}, {0xe5, 0x5b, 0xcd}, {0xe6, 0xdd, 0x34},
+    {0xe3, 0x5a, 0x0a}, {0xe7, 0x9d, 0xd9}, {0xe2, 0x79, 0x41}, {0xe4, 0x9b, 0x28},
+    {0xe5, 0xdc, 0x40}, {0xe7, 0x3d, 0x74}, {0xe1, 0xb8, 0x9c}, {0xe3, 0xba, 0x60},
+    {0xe6, 0x7c, 0xc8}, {0xe4, 0xdb, 0x62}, {0xe2, 0xb9, 0x7a}, {0xe5, 0x7b, 0xe2},
+    {0xe7, 0xde, 0x12}, {0xe6, 0x3c, 0x9d}, {0xe3, 0x19, 0xc9}, {0xe4, 0x1a, 0xb6},
+    {0xe5, 0xbc, 0x2b}, {0xe2, 0x18, 0xeb}, {0xe6, 0xfd, 0x42}, {0xe5, 0x1b, 0xa3},
+    {0xe3, 0x7a, 0x2e}, {0xe5, 0xfc, 0x64}, {0xe2, 0x59, 0x16}, {0xe6, 0x9c, 0xec},
+    {0xe2, 0xf9, 0xac}, {0xe4, 0x7b, 0x0c}, {0xe7, 0x5d, 0x98},
+  },
+  "EU": {
+    {0xd9, 0x04, 0x45}, {0xd9, 0x13, 0x04}, {0xd9, 0x21, 0xc2}, {0xd9, 0x0b, 0xa4},
+    {0xd9, 0x1a, 0x63},
+  },
+}
+
+func TestRFM69BandRegisters(t *testing.T) {
+  for name, frfs := range davisFRF {
+    band, err := protocol.LookupBand(name)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if len(frfs) != len(band.HopPattern) {
+      t.Fatalf("%s band has %d hops, DavisRFM69 has %d", name, len(band.HopPattern), len(frfs))
+    }
+
+    dev, rfm := newEmulated(t)
+    for hop, want := range frfs {
+      if err := rfm.SetFreq(uint32(band.Channel(hop))); err != nil {
+        t.Fatal(err)
+      }
+      regs := dev.Registers()
+      if got := [3]byte{regs[0x07], regs[0x08], regs[0x09]}; got != want {
+        t.Errorf("%s hop %d at %d Hz set FRF % x, expected % x", name, hop, band.Channel(hop), got, want)
+      }
+    }
+  }
+}
+
+func TestRFM69ReceiveTuned(t *testing.T) {
+  band, err := protocol.LookupBand("EU")
+  if err != nil {
+    t.Fatal(err)
+  }
+  dev, rfm := newEmulated(t)
+  if err := rfm.SetFreq(uint32(band.Channel(0))); err != nil {
+    t.Fatal(err)
+  }
+
+  // Another channel isn't heard, the tuned one is
+  dev.Transmit(rfm69emu.AirPacket{Data: []byte{0x01}, Freq: uint32(band.Channel(1)), Rssi: -80})
+  if _, timedout, _ := rfm.ReceiveData(50 * time.Millisecond); !timedout {
+    t.Fatal("received a packet sent on another channel")
+  }
+  dev.Transmit(rfm69emu.AirPacket{Data: []byte{0x02}, Freq: uint32(band.Channel(0)), Rssi: -80, FreqErr: 2000})
+  pkt, timedout, err := rfm.ReceiveData(time.Second)
+  if err != nil || timedout {
+    t.Fatalf("nothing received, timed out %v error %v", timedout, err)
+  }
+  if pkt.Freq != band.Channel(0) {
+    t.Errorf("packet on %d Hz, expected %d Hz", pkt.Freq, band.Channel(0))
+  }
+  if pkt.FreqErr < 1950 || pkt.FreqErr > 2050 {
+    t.Errorf("frequency error %d Hz, expected about 2000 Hz", pkt.FreqErr)
+  }
+}
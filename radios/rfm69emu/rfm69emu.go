@@ -0,0 +1,472 @@
+// Package rfm69emu is an in-memory model of an RFM69 at the register level
+// so the radios.RFM69 driver can be exercised without the chip attached.
+package rfm69emu
+
+import (
+  "fmt"
+  "math"
+  "sync"
+  "time"
+  "periph.io/x/periph/conn"
+  "periph.io/x/periph/conn/gpio"
+  "periph.io/x/periph/conn/physic"
+  "periph.io/x/periph/conn/spi"
+)
+
+// Register addresses the emulator gives special behaviour to
+const (
+  RegFifo = 0x00
+  RegOpMode = 0x01
+  RegFrfMsb = 0x07
+  RegFrfMid = 0x08
+  RegFrfLsb = 0x09
+  RegVersion = 0x10
+  RegFeiMsb = 0x21
+  RegFeiLsb = 0x22
+  RegRssiConfig = 0x23
+  RegRssiValue = 0x24
+  RegDioMapping1 = 0x25
+  RegIrqFlags1 = 0x27
+  RegIrqFlags2 = 0x28
+  RegPayloadLength = 0x38
+)
+
+// Operating modes held in bits 4-2 of RegOpMode
+const (
+  ModeSleep = 0
+  ModeStandby = 1
+  ModeFreqSynth = 2
+  ModeTx = 3
+  ModeRx = 4
+)
+
+// Flag bits in RegIrqFlags1 and RegIrqFlags2
+const (
+  IrqModeReady = 1 << 7
+  IrqRxReady = 1 << 6
+  IrqFifoNotEmpty = 1 << 6
+  IrqFifoOverrun = 1 << 4
+  IrqPayloadReady = 1 << 2
+)
+
+const (
+  fifoSize = 66
+  // Frequency synthesiser step, FXOSC / 2^19 with the 32 MHz crystal
+  fStep = 32000000.0 / (1 << 19)
+)
+
+// Power on register values from the RFM69 datasheet for the registers the
+// driver touches or the emulator models
+var resetValues = map[uint8]byte{
+  RegOpMode: 0x04,
+  0x03: 0x1a,
+  0x04: 0x0b,
+  0x05: 0x00,
+  0x06: 0x52,
+  RegFrfMsb: 0xe4,
+  RegFrfMid: 0xc0,
+  RegFrfLsb: 0x00,
+  RegVersion: 0x24,
+  0x18: 0x08,
+  0x19: 0x86,
+  0x1a: 0x8a,
+  0x1e: 0x10,
+  RegRssiConfig: 0x02,
+  RegRssiValue: 0xff,
+  RegIrqFlags1: IrqModeReady,
+  0x29: 0xe4,
+  0x2c: 0x00,
+  0x2d: 0x03,
+  0x2e: 0x98,
+  0x37: 0x10,
+  RegPayloadLength: 0x40,
+  0x3d: 0x02,
+}
+
+// AirPacket a packet sent over the air towards the emulated chip
+type AirPacket struct {
+  // Payload as it would arrive in the FIFO
+  Data []byte
+  // Carrier frequency in Hz, zero matches whatever the chip is tuned to
+  Freq uint32
+  // Signal strength in dBm
+  Rssi float64
+  // Frequency error in Hz
+  FreqErr int
+}
+
+// RegWrite a single register write made over SPI
+type RegWrite struct {
+  Addr uint8
+  Val byte
+}
+
+// Device an emulated RFM69 with its SPI bus, reset and DIO0 pins
+type Device struct {
+  mu sync.Mutex
+  regs [0x80]byte
+  fifo []byte
+  air []AirPacket
+  writes []RegWrite
+
+  resetLevel gpio.Level
+  dio0Edge gpio.Edge
+  dio0 chan struct{}
+}
+
+// New sets up an emulated RFM69 in its power on state
+func New() (d *Device) {
+  d = &Device{}
+  d.dio0 = make(chan struct{}, 1)
+  d.reset()
+  return
+}
+
+// Conn returns the SPI connection to the emulated chip
+func (d *Device) Conn() spi.Conn {
+  return &spiConn{d}
+}
+
+// ResetPin returns the pin wired to the emulated chip's RESET input
+func (d *Device) ResetPin() gpio.PinIO {
+  return &resetPin{pin{d, "RESET"}}
+}
+
+// InterruptPin returns the pin wired to the emulated chip's DIO0 output
+func (d *Device) InterruptPin() gpio.PinIO {
+  return &dio0Pin{pin{d, "DIO0"}}
+}
+
+// Reg returns the current value of a register without side effects
+func (d *Device) Reg(addr uint8) byte {
+  d.mu.Lock()
+  defer d.mu.Unlock()
+  return d.regs[addr & 0x7f]
+}
+
+// Registers returns a copy of the whole register file
+func (d *Device) Registers() (regs [0x80]byte) {
+  d.mu.Lock()
+  defer d.mu.Unlock()
+  regs = d.regs
+  return
+}
+
+// Writes returns every register write made since the last reset
+func (d *Device) Writes() []RegWrite {
+  d.mu.Lock()
+  defer d.mu.Unlock()
+  return append([]RegWrite(nil), d.writes...)
+}
+
+// Mode returns the current operating mode
+func (d *Device) Mode() int {
+  d.mu.Lock()
+  defer d.mu.Unlock()
+  return d.mode()
+}
+
+// Freq returns the carrier frequency the chip is tuned to in Hz
+func (d *Device) Freq() uint32 {
+  d.mu.Lock()
+  defer d.mu.Unlock()
+  return uint32(math.Round(float64(d.frf()) * fStep))
+}
+
+// Transmit sends a packet towards the chip, it is received as soon as the
+// chip is in RX mode on the right frequency with an empty FIFO
+func (d *Device) Transmit(pkt AirPacket) {
+  d.mu.Lock()
+  defer d.mu.Unlock()
+  d.air = append(d.air, pkt)
+  d.receive()
+}
+
+func (d *Device) reset() {
+  d.regs = [0x80]byte{}
+  for addr, val := range resetValues {
+    d.regs[addr] = val
+  }
+  d.fifo = nil
+  d.writes = nil
+  d.drainDio0()
+}
+
+func (d *Device) mode() int {
+  return int(d.regs[RegOpMode] >> 2) & 0x07
+}
+
+func (d *Device) frf() uint32 {
+  return uint32(d.regs[RegFrfMsb]) << 16 | uint32(d.regs[RegFrfMid]) << 8 | uint32(d.regs[RegFrfLsb])
+}
+
+func (d *Device) tx(w, r []byte) {
+  if len(w) == 0 {
+    return
+  }
+
+  addr := w[0] & 0x7f
+  write := w[0] & 0x80 != 0
+  for i := 1; i < len(w); i++ {
+    if write {
+      d.writeReg(addr, w[i])
+    } else if i < len(r) {
+      r[i] = d.readReg(addr)
+    }
+
+    // Burst accesses walk the register file except for the FIFO
+    if addr != RegFifo {
+      addr = (addr + 1) & 0x7f
+    }
+  }
+}
+
+func (d *Device) writeReg(addr uint8, val byte) {
+  d.writes = append(d.writes, RegWrite{addr, val})
+
+  switch addr {
+  case RegFifo:
+    if len(d.fifo) < fifoSize {
+      d.fifo = append(d.fifo, val)
+    } else {
+      d.regs[RegIrqFlags2] |= IrqFifoOverrun
+    }
+    d.updateFifoFlags()
+  case RegOpMode:
+    d.regs[RegOpMode] = val & 0xfc
+    d.regs[RegIrqFlags1] |= IrqModeReady
+    if d.mode() == ModeRx {
+      d.regs[RegIrqFlags1] |= IrqRxReady
+      d.receive()
+    } else {
+      d.regs[RegIrqFlags1] &^= IrqRxReady
+    }
+  case RegVersion:
+    // Read only
+  case RegRssiConfig:
+    // Starting a measurement completes immediately
+    d.regs[RegRssiConfig] = 0x02
+  case RegIrqFlags1:
+    // Only status flags, nothing to clear that the driver uses
+  case RegIrqFlags2:
+    if val & IrqFifoOverrun != 0 {
+      d.fifo = nil
+      d.regs[RegIrqFlags2] &^= IrqFifoOverrun | IrqPayloadReady
+      d.updateFifoFlags()
+    }
+  default:
+    d.regs[addr] = val
+  }
+}
+
+func (d *Device) readReg(addr uint8) byte {
+  if addr != RegFifo {
+    return d.regs[addr]
+  }
+
+  if len(d.fifo) == 0 {
+    return 0
+  }
+  b := d.fifo[0]
+  d.fifo = d.fifo[1:]
+  if len(d.fifo) == 0 {
+    d.regs[RegIrqFlags2] &^= IrqPayloadReady
+  }
+  d.updateFifoFlags()
+  return b
+}
+
+func (d *Device) updateFifoFlags() {
+  if len(d.fifo) > 0 {
+    d.regs[RegIrqFlags2] |= IrqFifoNotEmpty
+  } else {
+    d.regs[RegIrqFlags2] &^= IrqFifoNotEmpty
+  }
+}
+
+// receive moves the first matching packet on air into the FIFO if the chip
+// is listening for one
+func (d *Device) receive() {
+  if d.mode() != ModeRx || len(d.fifo) != 0 {
+    return
+  }
+
+  frf := d.frf()
+  for index, pkt := range d.air {
+    pktFrf := uint32(math.Round(float64(pkt.Freq) / fStep))
+    if pkt.Freq != 0 && (pktFrf + 1 < frf || pktFrf > frf + 1) {
+      continue
+    }
+    d.air = append(d.air[:index], d.air[index + 1:]...)
+
+    payload := make([]byte, d.regs[RegPayloadLength])
+    copy(payload, pkt.Data)
+    d.fifo = payload
+    d.updateFifoFlags()
+
+    d.regs[RegRssiValue] = byte(-pkt.Rssi * 2)
+    fei := int16(math.Round(float64(pkt.FreqErr) / fStep))
+    d.regs[RegFeiMsb] = byte(uint16(fei) >> 8)
+    d.regs[RegFeiLsb] = byte(fei)
+
+    d.regs[RegIrqFlags2] |= IrqPayloadReady
+    // DIO0 is mapped to PayloadReady in RX when RegDioMapping1 bits 7-6 are 01
+    if d.regs[RegDioMapping1] >> 6 == 0x01 && d.dio0Edge != gpio.FallingEdge {
+      select {
+      case d.dio0 <- struct{}{}:
+      default:
+      }
+    }
+    return
+  }
+}
+
+func (d *Device) drainDio0() {
+  select {
+  case <-d.dio0:
+  default:
+  }
+}
+
+
+type spiConn struct {
+  d *Device
+}
+
+func (c *spiConn) String() string {
+  return "rfm69emu"
+}
+
+func (c *spiConn) Halt() error {
+  return nil
+}
+
+func (c *spiConn) Duplex() conn.Duplex {
+  return conn.Full
+}
+
+func (c *spiConn) Tx(w, r []byte) error {
+  if len(r) != 0 && len(r) != len(w) {
+    return fmt.Errorf("rfm69emu: write and read buffers differ in length, %d != %d", len(w), len(r))
+  }
+
+  c.d.mu.Lock()
+  defer c.d.mu.Unlock()
+  c.d.tx(w, r)
+  return nil
+}
+
+func (c *spiConn) TxPackets(pkts []spi.Packet) error {
+  for _, p := range pkts {
+    if err := c.Tx(p.W, p.R); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+
+// pin common implementation of the pin interfaces for the emulated pins
+type pin struct {
+  d *Device
+  name string
+}
+
+func (p *pin) String() string {
+  return "rfm69emu." + p.name
+}
+
+func (p *pin) Halt() error {
+  return nil
+}
+
+func (p *pin) Name() string {
+  return p.name
+}
+
+func (p *pin) Number() int {
+  return -1
+}
+
+func (p *pin) Function() string {
+  return p.name
+}
+
+func (p *pin) Pull() gpio.Pull {
+  return gpio.Float
+}
+
+func (p *pin) DefaultPull() gpio.Pull {
+  return gpio.Float
+}
+
+func (p *pin) PWM(duty gpio.Duty, f physic.Frequency) error {
+  return fmt.Errorf("rfm69emu: %s does not support PWM", p.name)
+}
+
+
+type resetPin struct {
+  pin
+}
+
+func (p *resetPin) In(pull gpio.Pull, edge gpio.Edge) error {
+  return fmt.Errorf("rfm69emu: RESET is an input on the chip")
+}
+
+func (p *resetPin) Read() gpio.Level {
+  p.d.mu.Lock()
+  defer p.d.mu.Unlock()
+  return p.d.resetLevel
+}
+
+func (p *resetPin) WaitForEdge(timeout time.Duration) bool {
+  return false
+}
+
+// Out drives RESET, the chip comes back in its power on state when released
+func (p *resetPin) Out(l gpio.Level) error {
+  p.d.mu.Lock()
+  defer p.d.mu.Unlock()
+  if p.d.resetLevel == gpio.High && l == gpio.Low {
+    p.d.reset()
+  }
+  p.d.resetLevel = l
+  return nil
+}
+
+
+type dio0Pin struct {
+  pin
+}
+
+func (p *dio0Pin) In(pull gpio.Pull, edge gpio.Edge) error {
+  p.d.mu.Lock()
+  defer p.d.mu.Unlock()
+  p.d.dio0Edge = edge
+  return nil
+}
+
+func (p *dio0Pin) Read() gpio.Level {
+  p.d.mu.Lock()
+  defer p.d.mu.Unlock()
+  return gpio.Level(p.d.regs[RegIrqFlags2] & IrqPayloadReady != 0)
+}
+
+// WaitForEdge blocks until a payload lands in the FIFO or the timeout passes
+func (p *dio0Pin) WaitForEdge(timeout time.Duration) bool {
+  if timeout < 0 {
+    <-p.d.dio0
+    return true
+  }
+
+  select {
+  case <-p.d.dio0:
+    return true
+  case <-time.After(timeout):
+    return false
+  }
+}
+
+func (p *dio0Pin) Out(l gpio.Level) error {
+  return fmt.Errorf("rfm69emu: DIO0 is an output on the chip")
+}
@@ -0,0 +1,294 @@
+package simulated
+
+import (
+  "math"
+  "math/bits"
+  "math/rand"
+  "time"
+  "github.com/NeilBetham/elements/crc"
+  "github.com/NeilBetham/elements/protocol"
+  "github.com/NeilBetham/elements/radios"
+)
+
+// Packets are only delivered when the receiver is tuned within this many Hz
+// of the channel the simulated ISS is transmitting on
+const tuneTolerance = 10000
+
+// Order in which the simulated ISS rotates through its sensors, rain clicks
+// are interleaved the same way a real ISS does
+var sensorSequence = []protocol.Sensor{
+  protocol.SuperCapVoltage, protocol.RainClicks,
+  protocol.RainRate, protocol.RainClicks,
+  protocol.Temperature, protocol.RainClicks,
+  protocol.WindGustSpeed, protocol.RainClicks,
+  protocol.Humidity, protocol.RainClicks,
+  protocol.Light, protocol.RainClicks,
+  protocol.UVIndex, protocol.RainClicks,
+  protocol.SolarRadiation, protocol.RainClicks,
+}
+
+// Config controls the behaviour of a simulated ISS
+type Config struct {
+  // Frequency band to hop over, defaults to US
+  Band protocol.Band
+  // Transmitter ID as set on the ISS DIP switches, 1 to 8
+  TransmitterID int
+  // Probability from 0 to 1 that a packet is never received
+  PacketLoss float64
+  // Probability from 0 to 1 that a received packet is corrupted
+  CorruptRate float64
+  // Signal strength reported for received packets in dBm
+  Rssi float64
+  // Frequency error reported for received packets in Hz
+  FreqErr int
+  // Report the transmitter battery as low
+  BatteryLow bool
+  // Report the UV and solar radiation sensors as not fitted
+  NoUVSensor bool
+  NoSolarSensor bool
+}
+
+type weather struct {
+  temperature float64
+  humidity float64
+  windSpeed float64
+  windDir float64
+  windGust float64
+  rainClicks int
+  lastTip time.Time
+  tipInterval time.Duration
+  uvIndex float64
+  solarRadiation float64
+  light float64
+  superCapVoltage float64
+}
+
+// ISS emulates a Davis Instruments ISS and the radio receiving it
+type ISS struct {
+  cfg Config
+  crc crc.CRC
+  rand *rand.Rand
+
+  hopTime time.Duration
+  start time.Time
+  tunedFreq uint32
+
+  wx weather
+}
+
+var _ radios.Radio = (*ISS)(nil)
+
+// NewISS sets up a simulated ISS which starts transmitting immediately
+func NewISS(cfg Config) (s ISS) {
+  if cfg.TransmitterID < 1 {
+    cfg.TransmitterID = 1
+  }
+  if len(cfg.Band.Channels) == 0 {
+    cfg.Band, _ = protocol.LookupBand("US")
+  }
+
+  s.cfg = cfg
+  s.crc = crc.NewCRC("CCITT-16", 0, 0x1021, 0)
+  s.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+  s.hopTime = protocol.HopTime(cfg.TransmitterID)
+
+  // Start part way through a hop so the receiver has to find us
+  s.start = time.Now().Add(-time.Duration(s.rand.Int63n(int64(s.hopTime))))
+
+  s.wx = weather{
+    temperature: 65,
+    humidity: 55,
+    windSpeed: 5,
+    windDir: 180,
+    windGust: 8,
+    uvIndex: 2,
+    solarRadiation: 400,
+    light: 600,
+    superCapVoltage: 2.5,
+  }
+  return
+}
+
+// ReceiveData blocks until the simulated ISS transmits on the tuned channel
+// or the timeout passes
+func (s *ISS) ReceiveData(timeout time.Duration) (pkt radios.Packet, timedout bool, err error) {
+  now := time.Now()
+  deadline := now.Add(timeout)
+
+  txNum := int64(math.Ceil(float64(now.Sub(s.start)) / float64(s.hopTime)))
+  for {
+    txTime := s.start.Add(time.Duration(txNum) * s.hopTime)
+    if txTime.After(deadline) {
+      break
+    }
+
+    if s.onChannel(txNum) && s.rand.Float64() >= s.cfg.PacketLoss {
+      time.Sleep(time.Until(txTime))
+      pkt = s.packet(txNum)
+      return
+    }
+    txNum++
+  }
+
+  time.Sleep(time.Until(deadline))
+  timedout = true
+  return
+}
+
+// SetFreq tunes the simulated receiver
+func (s *ISS) SetFreq(freq uint32) error {
+  s.tunedFreq = freq
+  return nil
+}
+
+// ReadRSSI returns the configured signal strength
+func (s *ISS) ReadRSSI(manualStart bool) (float64, error) {
+  return s.cfg.Rssi, nil
+}
+
+// ReadFreqErr returns the configured frequency error
+func (s *ISS) ReadFreqErr() (int, error) {
+  return s.cfg.FreqErr, nil
+}
+
+// Reset does nothing for a simulated radio
+func (s *ISS) Reset() {}
+
+// Close does nothing for a simulated radio
+func (s *ISS) Close() error {
+  return nil
+}
+
+func (s *ISS) channel(txNum int64) int {
+  return s.cfg.Band.Channel(int(txNum % int64(len(s.cfg.Band.HopPattern))))
+}
+
+func (s *ISS) onChannel(txNum int64) bool {
+  diff := s.channel(txNum) - int(s.tunedFreq)
+  return diff > -tuneTolerance && diff < tuneTolerance
+}
+
+func (s *ISS) packet(txNum int64) (pkt radios.Packet) {
+  s.updateWeather()
+  sensor := sensorSequence[int(txNum % int64(len(sensorSequence)))]
+
+  data := s.encode(sensor)
+  if s.rand.Float64() < s.cfg.CorruptRate {
+    data[s.rand.Intn(len(data))] ^= 1 << uint(s.rand.Intn(8))
+  }
+
+  // The ISS transmits each byte LSB first
+  for index, b := range data {
+    data[index] = bits.Reverse8(b)
+  }
+
+  pkt.Data = data
+  pkt.Freq = int(s.tunedFreq)
+  pkt.FreqErr = s.cfg.FreqErr + s.rand.Intn(400) - 200
+  pkt.Rssi = s.cfg.Rssi + s.rand.NormFloat64()
+  return
+}
+
+// encode builds the 6 byte payload for a sensor followed by its CRC
+func (s *ISS) encode(sensor protocol.Sensor) []byte {
+  data := make([]byte, 8)
+
+  data[0] = byte(sensor) << 4 | byte(s.cfg.TransmitterID - 1) & 0x07
+  if s.cfg.BatteryLow {
+    data[0] |= 0x08
+  }
+  data[1] = byte(math.Round(s.wx.windSpeed))
+  // Vantage Pro2 vane, 9° to 351° in 1 to 255 as 0 means no vane
+  data[2] = byte(math.Max(1, math.Min(255, math.Round((s.wx.windDir - 9) * 255 / 342))))
+
+  switch sensor {
+  case protocol.SuperCapVoltage:
+    encode10Bit(data[3:5], int(math.Round(s.wx.superCapVoltage * 100)))
+  case protocol.UVIndex:
+    if s.cfg.NoUVSensor {
+      data[3] = 0xff
+    } else {
+      encode10Bit(data[3:5], int(math.Round(s.wx.uvIndex * 50)))
+    }
+  case protocol.RainRate:
+    encodeRainRate(data[3:5], s.wx.lastTip, s.wx.tipInterval)
+  case protocol.SolarRadiation:
+    if s.cfg.NoSolarSensor {
+      data[3] = 0xff
+    } else {
+      encode10Bit(data[3:5], int(math.Round(s.wx.solarRadiation / 1.757936)))
+    }
+  case protocol.Light:
+    encode10Bit(data[3:5], int(math.Round(s.wx.light)))
+  case protocol.Temperature:
+    raw := int(math.Round(s.wx.temperature * 160))
+    data[3] = byte(raw >> 8)
+    data[4] = byte(raw)
+  case protocol.WindGustSpeed:
+    data[3] = byte(math.Round(s.wx.windGust))
+  case protocol.Humidity:
+    raw := int(math.Round(s.wx.humidity * 10))
+    data[3] = byte(raw)
+    data[4] = byte(raw >> 8) << 4
+  case protocol.RainClicks:
+    data[3] = byte(s.wx.rainClicks) & 0x7f
+  }
+
+  sum := s.crc.Checksum(data[:6])
+  data[6] = byte(sum >> 8)
+  data[7] = byte(sum)
+  return data
+}
+
+// encodeRainRate packs the time between the last two tips as 10 bits, in
+// sixteenths of a second for heavy rain or seconds with bit 6 set for light
+// rain, or 0xff if it hasn't rained recently
+func encodeRainRate(data []byte, lastTip time.Time, interval time.Duration) {
+  if interval <= 0 || time.Since(lastTip) > 15 * time.Minute || interval > 1000 * time.Second {
+    data[0] = 0xff
+    return
+  }
+
+  raw := int(interval.Seconds() * 16)
+  if raw > 0x3ff {
+    raw = int(interval.Seconds())
+    data[1] = 0x40
+  }
+  // A low byte of 0xff reads as no rain, a tick off makes no odds
+  if raw & 0xff == 0xff {
+    raw--
+  }
+  data[0] = byte(raw)
+  data[1] |= byte(raw >> 8) << 4
+}
+
+// encode10Bit packs a value into the top ten bits of two bytes
+func encode10Bit(data []byte, raw int) {
+  data[0] = byte(raw >> 2)
+  data[1] = byte(raw & 0x03) << 6
+}
+
+// updateWeather nudges every value in a small random walk
+func (s *ISS) updateWeather() {
+  walk := func(v, step, min, max float64) float64 {
+    return math.Max(min, math.Min(max, v + (s.rand.Float64() * 2 - 1) * step))
+  }
+
+  s.wx.temperature = walk(s.wx.temperature, 0.2, 20, 110)
+  s.wx.humidity = walk(s.wx.humidity, 0.5, 5, 100)
+  s.wx.windSpeed = walk(s.wx.windSpeed, 1, 0, 40)
+  s.wx.windDir = math.Mod(walk(s.wx.windDir, 10, -360, 720) + 360, 360)
+  s.wx.windGust = math.Max(s.wx.windSpeed, walk(s.wx.windGust, 2, 0, 60))
+  s.wx.uvIndex = walk(s.wx.uvIndex, 0.1, 0, 12)
+  s.wx.solarRadiation = walk(s.wx.solarRadiation, 10, 0, 1200)
+  s.wx.light = walk(s.wx.light, 10, 0, 1000)
+  s.wx.superCapVoltage = walk(s.wx.superCapVoltage, 0.01, 1.5, 3.2)
+
+  if s.rand.Float64() < 0.05 {
+    s.wx.rainClicks++
+    if !s.wx.lastTip.IsZero() {
+      s.wx.tipInterval = time.Since(s.wx.lastTip)
+    }
+    s.wx.lastTip = time.Now()
+  }
+}
@@ -0,0 +1,143 @@
+package simulated
+
+import (
+  "io/ioutil"
+  "log"
+  "math"
+  "os"
+  "testing"
+  "time"
+  "github.com/NeilBetham/elements/protocol"
+  "github.com/NeilBetham/elements/radios"
+)
+
+func TestEncodeRainRate(t *testing.T) {
+  for _, interval := range []time.Duration{
+    2 * time.Second, 30 * time.Second, 63 * time.Second, 64 * time.Second,
+    90 * time.Second, 300 * time.Second, 1000 * time.Second,
+  } {
+    data := []byte{0x50, 0, 0, 0, 0, 0, 0, 0}
+    encodeRainRate(data[3:5], time.Now(), interval)
+    rd := protocol.ParsePacket(radios.Packet{Data: data})
+    want := 3600 / interval.Seconds() * 0.01
+    // Light rain is only sent to the second, and a tick off to dodge 0xff
+    if math.Abs(rd.RainRateInHr - want) > want * 0.02 {
+      t.Errorf("%s: got %v in/hr, want %v", interval, rd.RainRateInHr, want)
+    }
+  }
+
+  data := []byte{0x50, 0, 0, 0, 0, 0, 0, 0}
+  encodeRainRate(data[3:5], time.Now().Add(-time.Hour), time.Minute)
+  if rd := protocol.ParsePacket(radios.Packet{Data: data}); rd.RainRateInHr != 0 {
+    t.Errorf("no recent tip gave %v in/hr", rd.RainRateInHr)
+  }
+}
+
+// A short band so the handler finds the ISS in a few hops rather than minutes
+var testBand = protocol.Band{
+  Name: "test",
+  Channels: []int{902381897, 910409912, 920445374},
+  HopPattern: []int{2, 0, 1},
+}
+
+// follow runs a handler against the simulated ISS the way the receiver does
+// until done is happy with the readings or limit passes
+func follow(t *testing.T, iss *ISS, ph *protocol.ProtocolHandler, limit time.Duration, done func(readings []protocol.Reading) bool) (readings []protocol.Reading) {
+  deadline := time.Now().Add(limit)
+  iss.SetFreq(uint32(ph.NextHop().Freq))
+  for !done(readings) {
+    if time.Now().After(deadline) {
+      t.Fatalf("Gave up after %s with %d readings, stats %+v", limit, len(readings), ph.Stats())
+    }
+    pkt, timedout, err := iss.ReceiveData(ph.ListenTimeout())
+    if err != nil {
+      t.Fatal(err)
+    }
+    hop, rd := ph.HandlePacket(pkt, timedout)
+    if rd.Valid {
+      readings = append(readings, rd)
+    }
+    if hop {
+      iss.SetFreq(uint32(ph.NextHop().Freq))
+    }
+  }
+  return
+}
+
+func TestHandlerFollowsISS(t *testing.T) {
+  if testing.Short() {
+    t.Skip("follows the ISS in real time")
+  }
+  log.SetOutput(ioutil.Discard)
+  defer log.SetOutput(os.Stderr)
+
+  tests := []struct{
+    name string
+    loss float64
+    corrupt float64
+  }{
+    {"clean", 0, 0},
+    {"packet loss", 0.3, 0},
+    {"corruption", 0, 0.3},
+  }
+
+  t.Run("all", func(t *testing.T) {
+    for _, tt := range tests {
+      tt := tt
+      t.Run(tt.name, func(t *testing.T) {
+        t.Parallel()
+        iss := NewISS(Config{Band: testBand, TransmitterID: 3, PacketLoss: tt.loss, CorruptRate: tt.corrupt, Rssi: -70})
+        ph := protocol.NewProtocolHandler(testBand, []int{3})
+
+        readings := follow(t, &iss, &ph, 90 * time.Second, func(readings []protocol.Reading) bool {
+          stats := ph.Stats()
+          return len(readings) >= 6 && (tt.loss == 0 || stats.MissedSlots > 0) && (tt.corrupt == 0 || stats.CRCFailures > 0)
+        })
+
+        stats := ph.Stats()
+        if !ph.InSync() || stats.Resyncs != 0 {
+          t.Errorf("Lost sync, stats %+v", stats)
+        }
+        if tt.loss == 0 && tt.corrupt == 0 && (stats.MissedSlots != 0 || stats.CRCFailures != 0) {
+          t.Errorf("Missed %d slots and %d CRCs with nothing lost", stats.MissedSlots, stats.CRCFailures)
+        }
+        if tt.corrupt == 0 && stats.CRCFailures != 0 {
+          t.Errorf("%d CRC failures without corruption", stats.CRCFailures)
+        }
+
+        // Every reading turns up in the slot the ISS sent it in, and the
+        // sensors follow its rotation across anything missed
+        anchor := -1
+        for i, rd := range readings {
+          if rd.StationID != 3 || rd.StationBatLow || rd.Rssi > -60 || rd.Rssi < -80 {
+            t.Errorf("Reading %d: %s", i, rd)
+          }
+          if rd.Sensor == protocol.Temperature && (rd.Value < 55 || rd.Value > 75) {
+            t.Errorf("Temperature %v", rd.Value)
+          }
+          if anchor < 0 {
+            if rd.Sensor != protocol.RainClicks {
+              anchor = i
+            }
+            continue
+          }
+          slots := int(math.Round(float64(rd.Timestamp.Sub(readings[anchor].Timestamp)) / float64(iss.hopTime)))
+          want := sensorSequence[(sequenceIndex(readings[anchor].Sensor) + slots) % len(sensorSequence)]
+          if rd.Sensor != want {
+            t.Errorf("Reading %d %d slots after %s is %s, want %s", i, slots, readings[anchor].Sensor, rd.Sensor, want)
+          }
+        }
+      })
+    }
+  })
+}
+
+// sequenceIndex where a sensor other than rain clicks comes in the rotation
+func sequenceIndex(sensor protocol.Sensor) int {
+  for i, s := range sensorSequence {
+    if s == sensor {
+      return i
+    }
+  }
+  return -1
+}
@@ -0,0 +1,297 @@
+package rain
+
+import (
+  "log"
+  "math"
+  "time"
+  "github.com/NeilBetham/elements/protocol"
+)
+
+// The ISS rain counter is 7 bits and wraps
+const counterModulo = 128
+
+// A storm ends after this long without a tip and needs at least stormMinTips
+// to count, the same rules a Davis console uses
+const (
+  stormGap = 24 * time.Hour
+  stormMinTips = 2
+)
+
+// More tips than this per minute since the last packet means the counter was
+// reset, roughly 20 in/hr on a 0.01" bucket
+const maxTipsPerMinute = 35
+
+// The counter going backwards after this long without a packet is taken as a
+// reset rather than a wrap, the two can't be told apart by then
+const resetGap = 10 * time.Minute
+
+// Tips are kept this long for the rolling totals
+const recentWindow = 24 * time.Hour
+
+// Config controls when the rain day and rain year roll over
+type Config struct {
+  Bucket protocol.RainBucket
+  // Zone the rain day is kept in
+  Location *time.Location
+  // Time after local midnight the rain day starts, 0 for midnight
+  DayStart time.Duration
+  // First month of the rain year, 0 or 1 for January
+  YearStartMonth time.Month
+  // Scales each tip when the collector reads off against a reference gauge,
+  // nil to count tips as the bucket size
+  Calibration *protocol.Calibration
+}
+
+type tip struct {
+  at time.Time
+  count int
+}
+
+// Accumulator turns the rolling RainClicks counter into rain totals
+type Accumulator struct {
+  cfg Config
+
+  // Last counter value seen from each transmitter, absent until the first
+  lastClicks map[int]int
+  lastUpdate map[int]time.Time
+  // Transmitters whose last counter value came from a saved state
+  restored map[int]bool
+
+  total int
+  recent []tip
+  daily int
+  day time.Time
+  storm int
+  lastTip time.Time
+  yearly int
+  year int
+}
+
+// NewAccumulator sets up an accumulator with no rain counted
+func NewAccumulator(cfg Config) (a Accumulator) {
+  if cfg.Location == nil {
+    cfg.Location = time.Local
+  }
+  if cfg.YearStartMonth < time.January {
+    cfg.YearStartMonth = time.January
+  }
+
+  a.cfg = cfg
+  a.lastClicks = make(map[int]int)
+  a.lastUpdate = make(map[int]time.Time)
+  a.restored = make(map[int]bool)
+  return
+}
+
+// HandleReading counts any new tips in a RainClicks reading and returns the
+// derived rain readings, other readings are ignored
+func (a *Accumulator) HandleReading(r protocol.Reading, now time.Time) (derived []protocol.Reading) {
+  if !r.Valid || r.Sensor != protocol.RainClicks {
+    return
+  }
+
+  a.rollOver(now)
+  a.countTips(r.StationID, int(r.Value), now)
+
+  return []protocol.Reading{
+    a.reading(r, protocol.RainTotal, a.total),
+    a.reading(r, protocol.RainLastHour, a.tipsSince(now.Add(-time.Hour))),
+    a.reading(r, protocol.RainLast24h, a.tipsSince(now.Add(-recentWindow))),
+    a.reading(r, protocol.RainDaily, a.daily),
+    a.reading(r, protocol.RainStorm, a.stormTips()),
+    a.reading(r, protocol.RainYearly, a.yearly),
+  }
+}
+
+func (a *Accumulator) countTips(stationID int, clicks int, now time.Time) {
+  last, seen := a.lastClicks[stationID]
+  lastUpdate := a.lastUpdate[stationID]
+  restored := a.restored[stationID]
+  a.lastClicks[stationID] = clicks
+  a.lastUpdate[stationID] = now
+  delete(a.restored, stationID)
+
+  // First packet since we started, nothing to compare against yet
+  if !seen {
+    return
+  }
+
+  tips := (clicks - last + counterModulo) % counterModulo
+  if tips == 0 {
+    return
+  }
+
+  // Going backwards is a wrap when packets are arriving steadily, after a
+  // long gap or our own restart it's far more likely the ISS lost power and
+  // its counter went back to zero
+  gap := now.Sub(lastUpdate)
+  if clicks < last && (restored || gap > resetGap) {
+    log.Printf("Rain counter on transmitter %d went back from %d to %d after %s, assuming it was reset", stationID, last, clicks, gap.Round(time.Second))
+    return
+  }
+
+  // The modulo hides missed packets, but a jump bigger than any real rain
+  // could produce means the counter was reset
+  allowed := int(math.Ceil(gap.Minutes() * maxTipsPerMinute))
+  if tips > allowed && tips > 1 {
+    log.Printf("Rain counter on transmitter %d jumped from %d to %d, assuming it was reset", stationID, last, clicks)
+    return
+  }
+
+  a.total += tips
+  a.daily += tips
+  a.yearly += tips
+  if now.Sub(a.lastTip) > stormGap {
+    a.storm = 0
+  }
+  a.storm += tips
+  a.lastTip = now
+  a.recent = append(a.recent, tip{now, tips})
+}
+
+// rollOver clears the totals whose period has ended
+func (a *Accumulator) rollOver(now time.Time) {
+  day := a.rainDay(now)
+  if !day.Equal(a.day) {
+    a.day = day
+    a.daily = 0
+  }
+
+  year := a.rainYear(now)
+  if year != a.year {
+    a.year = year
+    a.yearly = 0
+  }
+
+  if !a.lastTip.IsZero() && now.Sub(a.lastTip) > stormGap {
+    a.storm = 0
+  }
+
+  cutoff := now.Add(-recentWindow)
+  for len(a.recent) > 0 && !a.recent[0].at.After(cutoff) {
+    a.recent = a.recent[1:]
+  }
+}
+
+// rainDay the date of the rain day that now falls in
+func (a *Accumulator) rainDay(now time.Time) time.Time {
+  t := now.In(a.cfg.Location).Add(-a.cfg.DayStart)
+  return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// rainYear the calendar year the current rain year started in
+func (a *Accumulator) rainYear(now time.Time) int {
+  t := now.In(a.cfg.Location)
+  if t.Month() < a.cfg.YearStartMonth {
+    return t.Year() - 1
+  }
+  return t.Year()
+}
+
+// tipsSince the tips counted after cutoff, no further back than recentWindow
+func (a *Accumulator) tipsSince(cutoff time.Time) (tips int) {
+  for _, t := range a.recent {
+    if t.at.After(cutoff) {
+      tips += t.count
+    }
+  }
+  return
+}
+
+func (a *Accumulator) stormTips() int {
+  if a.storm < stormMinTips {
+    return 0
+  }
+  return a.storm
+}
+
+// State everything the accumulator needs to carry on counting after a restart
+type State struct {
+  LastClicks map[int]int `json:"last_clicks"`
+  LastUpdate map[int]time.Time `json:"last_update"`
+  Total int `json:"total"`
+  Recent []TipState `json:"recent"`
+  Daily int `json:"daily"`
+  Day time.Time `json:"day"`
+  Storm int `json:"storm"`
+  LastTip time.Time `json:"last_tip"`
+  Yearly int `json:"yearly"`
+  Year int `json:"year"`
+}
+
+// TipState tips counted at a point in time
+type TipState struct {
+  At time.Time `json:"at"`
+  Count int `json:"count"`
+}
+
+// State returns a copy of the accumulator's counters
+func (a *Accumulator) State() (s State) {
+  s.LastClicks = make(map[int]int)
+  for id, clicks := range a.lastClicks {
+    s.LastClicks[id] = clicks
+  }
+  s.LastUpdate = make(map[int]time.Time)
+  for id, t := range a.lastUpdate {
+    s.LastUpdate[id] = t
+  }
+  for _, t := range a.recent {
+    s.Recent = append(s.Recent, TipState{t.at, t.count})
+  }
+
+  s.Total = a.total
+  s.Daily = a.daily
+  s.Day = a.day
+  s.Storm = a.storm
+  s.LastTip = a.lastTip
+  s.Yearly = a.yearly
+  s.Year = a.year
+  return
+}
+
+// Restore replaces the accumulator's counters with a saved state, periods
+// that ended while we were stopped roll over on the next reading
+func (a *Accumulator) Restore(s State) {
+  a.lastClicks = make(map[int]int)
+  for id, clicks := range s.LastClicks {
+    a.lastClicks[id] = clicks
+  }
+  a.lastUpdate = make(map[int]time.Time)
+  for id, t := range s.LastUpdate {
+    a.lastUpdate[id] = t
+  }
+  a.restored = make(map[int]bool)
+  for id := range s.LastClicks {
+    a.restored[id] = true
+  }
+  a.recent = nil
+  for _, t := range s.Recent {
+    a.recent = append(a.recent, tip{t.At, t.Count})
+  }
+
+  a.total = s.Total
+  a.daily = s.Daily
+  a.day = s.Day
+  a.storm = s.Storm
+  a.lastTip = s.LastTip
+  a.yearly = s.Yearly
+  a.year = s.Year
+}
+
+func (a *Accumulator) reading(from protocol.Reading, sensor protocol.Sensor, tips int) (rd protocol.Reading) {
+  rd.StationID = from.StationID
+  rd.Timestamp = from.Timestamp
+  rd.Sensor = sensor
+  rd.SensorName = sensor.String()
+  rd.Value = float64(tips) * a.cfg.Bucket.Inches()
+  rd.RawValue = uint32(tips)
+  if a.cfg.Calibration != nil {
+    applied := *a.cfg.Calibration
+    rd.UncalibratedValue = rd.Value
+    rd.Calibration = &applied
+    rd.Value = applied.Apply(rd.Value)
+  }
+  rd.Valid = true
+  rd.Derived = true
+  return
+}
@@ -0,0 +1,190 @@
+package rain
+
+import (
+  "math"
+  "testing"
+  "time"
+  "github.com/NeilBetham/elements/protocol"
+)
+
+func clicks(n int) protocol.Reading {
+  return protocol.Reading{StationID: 1, Sensor: protocol.RainClicks, Value: float64(n), Valid: true}
+}
+
+// value the tips in a derived reading
+func value(t *testing.T, derived []protocol.Reading, sensor protocol.Sensor) int {
+  for _, rd := range derived {
+    if rd.Sensor == sensor {
+      return int(rd.RawValue)
+    }
+  }
+  t.Fatalf("no %s reading in %v", sensor, derived)
+  return 0
+}
+
+func TestCounter(t *testing.T) {
+  start := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+  tests := []struct{
+    name string
+    from int
+    to int
+    gap time.Duration
+    tips int
+  }{
+    {"steady", 10, 12, 20 * time.Second, 2},
+    {"wrap", 126, 1, 20 * time.Second, 3},
+    {"wrap to zero", 120, 0, time.Minute, 8},
+    {"missed packets", 10, 40, 5 * time.Minute, 30},
+    {"wrap after missed packets", 100, 20, 5 * time.Minute, 48},
+    {"reset after long gap", 100, 0, time.Hour, 0},
+    {"reset after long gap forwards", 5, 90, time.Hour, 85},
+    {"iss restart", 100, 0, 20 * time.Second, 0},
+    {"jump", 10, 90, 20 * time.Second, 0},
+  }
+
+  for _, tt := range tests {
+    a := NewAccumulator(Config{Location: time.UTC})
+    a.HandleReading(clicks(tt.from), start)
+    got := value(t, a.HandleReading(clicks(tt.to), start.Add(tt.gap)), protocol.RainTotal)
+    if got != tt.tips {
+      t.Errorf("%s: %d to %d counted %d tips, want %d", tt.name, tt.from, tt.to, got, tt.tips)
+    }
+
+    // Counting carries on from the new value either way
+    got = value(t, a.HandleReading(clicks((tt.to + 1) % counterModulo), start.Add(tt.gap + 20 * time.Second)), protocol.RainTotal)
+    if got != tt.tips + 1 {
+      t.Errorf("%s: next tip gave a total of %d, want %d", tt.name, got, tt.tips + 1)
+    }
+  }
+}
+
+func TestResetAfterRestore(t *testing.T) {
+  start := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+  a := NewAccumulator(Config{Location: time.UTC})
+  a.HandleReading(clicks(120), start)
+  a.HandleReading(clicks(125), start.Add(time.Minute))
+
+  b := NewAccumulator(Config{Location: time.UTC})
+  b.Restore(a.State())
+  derived := b.HandleReading(clicks(3), start.Add(2 * time.Minute))
+  if got := value(t, derived, protocol.RainTotal); got != 5 {
+    t.Errorf("backwards step after a restore counted, total %d want 5", got)
+  }
+
+  // Forwards is still counted, and a wrap once packets are flowing again is
+  // still a wrap
+  c := NewAccumulator(Config{Location: time.UTC})
+  c.Restore(a.State())
+  c.HandleReading(clicks(127), start.Add(2 * time.Minute))
+  derived = c.HandleReading(clicks(2), start.Add(2 * time.Minute + 20 * time.Second))
+  if got := value(t, derived, protocol.RainTotal); got != 5 + 2 + 3 {
+    t.Errorf("wrap after a restore gave total %d want %d", got, 5 + 2 + 3)
+  }
+}
+
+func TestRollOver(t *testing.T) {
+  loc := time.FixedZone("NZST", 12 * 60 * 60)
+  a := NewAccumulator(Config{Location: loc, DayStart: 9 * time.Hour, YearStartMonth: time.July})
+
+  at := time.Date(2026, 6, 30, 8, 0, 0, 0, loc)
+  a.HandleReading(clicks(0), at)
+  derived := a.HandleReading(clicks(5), at.Add(30 * time.Minute))
+  if daily, yearly := value(t, derived, protocol.RainDaily), value(t, derived, protocol.RainYearly); daily != 5 || yearly != 5 {
+    t.Fatalf("got daily %d yearly %d, want 5 and 5", daily, yearly)
+  }
+
+  // 08:59 on the 30th is still the rain day that started at 09:00 the day
+  // before
+  derived = a.HandleReading(clicks(6), time.Date(2026, 6, 30, 8, 59, 0, 0, loc))
+  if daily := value(t, derived, protocol.RainDaily); daily != 6 {
+    t.Errorf("before the day start got daily %d, want 6", daily)
+  }
+  derived = a.HandleReading(clicks(7), time.Date(2026, 6, 30, 9, 0, 0, 0, loc))
+  if daily := value(t, derived, protocol.RainDaily); daily != 1 {
+    t.Errorf("after the day start got daily %d, want 1", daily)
+  }
+
+  // The rain year starts on the 1st of July, in local time
+  derived = a.HandleReading(clicks(8), time.Date(2026, 6, 30, 23, 59, 0, 0, loc))
+  if yearly := value(t, derived, protocol.RainYearly); yearly != 8 {
+    t.Errorf("before the year start got yearly %d, want 8", yearly)
+  }
+  derived = a.HandleReading(clicks(9), time.Date(2026, 7, 1, 0, 0, 0, 0, loc))
+  if yearly, total := value(t, derived, protocol.RainYearly), value(t, derived, protocol.RainTotal); yearly != 1 || total != 9 {
+    t.Errorf("after the year start got yearly %d total %d, want 1 and 9", yearly, total)
+  }
+}
+
+func TestRolling(t *testing.T) {
+  start := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+  a := NewAccumulator(Config{Location: time.UTC})
+  a.HandleReading(clicks(0), start)
+  a.HandleReading(clicks(4), start.Add(time.Minute))
+  a.HandleReading(clicks(6), start.Add(2 * time.Hour))
+
+  tests := []struct{
+    at time.Duration
+    hour, day int
+  }{
+    {2 * time.Hour + time.Minute, 2, 6},
+    {3 * time.Hour + time.Minute, 0, 6},
+    {24 * time.Hour, 0, 6},
+    {24 * time.Hour + time.Minute, 0, 2},
+    {26 * time.Hour + time.Minute, 0, 0},
+  }
+  for _, tt := range tests {
+    derived := a.HandleReading(clicks(6), start.Add(tt.at))
+    if hour, day := value(t, derived, protocol.RainLastHour), value(t, derived, protocol.RainLast24h); hour != tt.hour || day != tt.day {
+      t.Errorf("after %s got %d in the last hour and %d in 24 hours, want %d and %d", tt.at, hour, day, tt.hour, tt.day)
+    }
+  }
+
+  // The rolling totals carry across a restart
+  b := NewAccumulator(Config{Location: time.UTC})
+  a.HandleReading(clicks(9), start.Add(27 * time.Hour))
+  b.Restore(a.State())
+  if day := value(t, b.HandleReading(clicks(9), start.Add(28 * time.Hour)), protocol.RainLast24h); day != 3 {
+    t.Errorf("after a restore got %d in 24 hours, want 3", day)
+  }
+}
+
+func TestStorm(t *testing.T) {
+  start := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+  a := NewAccumulator(Config{Location: time.UTC})
+  a.HandleReading(clicks(0), start)
+
+  derived := a.HandleReading(clicks(1), start.Add(time.Minute))
+  if storm := value(t, derived, protocol.RainStorm); storm != 0 {
+    t.Errorf("one tip started a storm of %d", storm)
+  }
+  derived = a.HandleReading(clicks(3), start.Add(2 * time.Minute))
+  if storm := value(t, derived, protocol.RainStorm); storm != 3 {
+    t.Errorf("got storm %d, want 3", storm)
+  }
+
+  derived = a.HandleReading(clicks(3), start.Add(2 * time.Minute + stormGap + time.Second))
+  if storm := value(t, derived, protocol.RainStorm); storm != 0 {
+    t.Errorf("storm of %d still going after a dry day", storm)
+  }
+}
+
+func TestGain(t *testing.T) {
+  start := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+  cal, err := protocol.NewCalibration("RainClicks", 0, 0, 1.05, nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  a := NewAccumulator(Config{Location: time.UTC, Calibration: &cal})
+  a.HandleReading(clicks(0), start)
+
+  for _, rd := range a.HandleReading(clicks(20), start.Add(time.Minute)) {
+    if rd.Sensor != protocol.RainTotal {
+      continue
+    }
+    if rd.RawValue != 20 || math.Abs(rd.Value - 0.21) > 1e-9 || math.Abs(rd.UncalibratedValue - 0.2) > 1e-9 || rd.Calibration == nil {
+      t.Errorf("got %d tips as %v in from %v with %v, want 0.21 in", rd.RawValue, rd.Value, rd.UncalibratedValue, rd.Calibration)
+    }
+    return
+  }
+  t.Fatal("no total")
+}
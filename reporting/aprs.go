@@ -0,0 +1,208 @@
+package reporting
+
+import (
+  "bufio"
+  "errors"
+  "fmt"
+  "math"
+  "net"
+  "strings"
+  "sync"
+  "time"
+  "github.com/NeilBetham/elements/config"
+  "github.com/NeilBetham/elements/protocol"
+  "github.com/NeilBetham/elements/weather"
+)
+
+// CWOP asks for no more than one report every five minutes from each station
+const (
+  defaultAPRSServer = "cwop.aprs.net:14580"
+  defaultAPRSInterval = 5 * time.Minute
+  aprsTimeout = 30 * time.Second
+)
+
+// APRSSink sends the current conditions as APRS weather reports over APRS-IS,
+// the way stations report to the Citizen Weather Observer Program. Readings
+// only trigger reports, the conditions come from the weather aggregator.
+type APRSSink struct {
+  name string
+  Server string
+  Callsign string
+  // APRS-IS passcode for the callsign, CWOP stations without an amateur
+  // licence use -1
+  Passcode string
+  Latitude float64
+  Longitude float64
+  Interval time.Duration
+
+  Weather *weather.Aggregator
+  mu sync.Mutex
+  lastUpload time.Time
+}
+
+// NewAPRSSink sets up an APRS sink reporting the conditions kept by wx
+func NewAPRSSink(c config.SinkConfig, wx *weather.Aggregator) (a *APRSSink, err error) {
+  if wx == nil {
+    return nil, fmt.Errorf("sink %s needs the current conditions", c.Name)
+  }
+  if c.Callsign == "" {
+    return nil, fmt.Errorf("sink %s needs a callsign", c.Name)
+  }
+  if c.Latitude < -90 || c.Latitude > 90 || c.Longitude < -180 || c.Longitude > 180 {
+    return nil, fmt.Errorf("sink %s has an invalid position %f, %f", c.Name, c.Latitude, c.Longitude)
+  }
+
+  a = &APRSSink{
+    name: c.Name,
+    Server: c.Url,
+    Callsign: strings.ToUpper(c.Callsign),
+    Passcode: c.Password,
+    Latitude: c.Latitude,
+    Longitude: c.Longitude,
+    Interval: c.Interval,
+    Weather: wx,
+  }
+  if a.Server == "" {
+    a.Server = defaultAPRSServer
+  }
+  if a.Passcode == "" {
+    a.Passcode = "-1"
+  }
+  if a.Interval <= 0 {
+    a.Interval = defaultAPRSInterval
+  }
+  return
+}
+
+func (a *APRSSink) Name() string {
+  return a.name
+}
+
+// ReportReading sends the current conditions if a report is due
+func (a *APRSSink) ReportReading(r protocol.Reading) error {
+  now := time.Now()
+  a.mu.Lock()
+  if now.Sub(a.lastUpload) < a.Interval {
+    a.mu.Unlock()
+    return nil
+  }
+  a.lastUpload = now
+  a.mu.Unlock()
+
+  packet, ok := a.packet(a.Weather.Current(), now)
+  if !ok {
+    return nil
+  }
+  return a.send(packet)
+}
+
+// send logs in to the APRS-IS server and sends a single packet
+func (a *APRSSink) send(packet string) (err error) {
+  conn, err := net.DialTimeout("tcp", a.Server, aprsTimeout)
+  if err != nil {
+    return
+  }
+  defer conn.Close()
+  conn.SetDeadline(time.Now().Add(aprsTimeout))
+  reader := bufio.NewReader(conn)
+
+  // The server starts with a banner comment
+  if _, err = reader.ReadString('\n'); err != nil {
+    return
+  }
+
+  _, err = fmt.Fprintf(conn, "user %s pass %s vers elements 1.0\r\n", a.Callsign, a.Passcode)
+  if err != nil {
+    return
+  }
+  resp, err := reader.ReadString('\n')
+  if err != nil {
+    return
+  }
+  if !strings.HasPrefix(resp, "# logresp") {
+    return errors.New(fmt.Sprintf("APRS-IS login failed: %s", strings.TrimSpace(resp)))
+  }
+
+  _, err = fmt.Fprintf(conn, "%s\r\n", packet)
+  return
+}
+
+// packet the APRS weather report for the conditions, ok is false if they're
+// all stale. Stale values are sent as dots. APRS wants sustained wind and the
+// recent peak gust, so the averages are used when there are any.
+// Humidity is two digits with 00 meaning 100%, so 0% can't be sent and is
+// left out like a stale value.
+func (a *APRSSink) packet(wx weather.Snapshot, now time.Time) (packet string, ok bool) {
+  field := func(f weather.Field, width int, scale float64) string {
+    if !f.Ok() {
+      return strings.Repeat(".", width)
+    }
+    ok = true
+    return fmt.Sprintf("%0*d", width, int(math.Round(f.Value * scale)))
+  }
+
+  humidity := ".."
+  if h := int(math.Round(wx.Humidity.Value)); wx.Humidity.Ok() && h > 0 && h <= 100 {
+    ok = true
+    humidity = fmt.Sprintf("%02d", h % 100)
+  }
+
+  luminosity := ""
+  if wx.SolarRadiation.Ok() {
+    ok = true
+    lum := int(math.Round(wx.SolarRadiation.Value))
+    luminosity = fmt.Sprintf("L%03d", lum)
+    if lum >= 1000 {
+      luminosity = fmt.Sprintf("l%03d", lum - 1000)
+    }
+  }
+
+  packet = fmt.Sprintf(
+    "%s>APRS,TCPIP*:@%sz%s/%s_%s/%sg%st%sr%sp%sP%sh%sb.....%s",
+    a.Callsign,
+    now.UTC().Format("021504"),
+    aprsLatitude(a.Latitude),
+    aprsLongitude(a.Longitude),
+    field(wx.WindDirAvg2Min.Or(wx.WindDir), 3, 1),
+    field(wx.WindSpeedAvg2MinMph.Or(wx.WindSpeedMph), 3, 1),
+    field(wx.WindGust10MinMph.Or(wx.WindGustMph), 3, 1),
+    field(wx.TempF, 3, 1),
+    field(wx.RainLastHourIn, 3, 100),
+    field(wx.RainLast24hIn, 3, 100),
+    field(wx.RainDailyIn, 3, 100),
+    humidity,
+    luminosity,
+  )
+  return
+}
+
+// aprsLatitude degrees as APRS DDMM.hhN
+func aprsLatitude(lat float64) string {
+  hemisphere := "N"
+  if lat < 0 {
+    hemisphere = "S"
+    lat = -lat
+  }
+  degrees, minutes := aprsDegreesMinutes(lat)
+  return fmt.Sprintf("%02d%05.2f%s", degrees, minutes, hemisphere)
+}
+
+// aprsLongitude degrees as APRS DDDMM.hhW
+func aprsLongitude(lon float64) string {
+  hemisphere := "E"
+  if lon < 0 {
+    hemisphere = "W"
+    lon = -lon
+  }
+  degrees, minutes := aprsDegreesMinutes(lon)
+  return fmt.Sprintf("%03d%05.2f%s", degrees, minutes, hemisphere)
+}
+
+// aprsDegreesMinutes splits degrees into whole degrees and minutes rounded to
+// hundredths, carrying a rounded up 60 minutes into the degrees
+func aprsDegreesMinutes(v float64) (degrees int, minutes float64) {
+  hundredths := int(math.Round(v * 60 * 100))
+  degrees = hundredths / 6000
+  minutes = float64(hundredths % 6000) / 100
+  return
+}
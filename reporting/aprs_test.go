@@ -0,0 +1,145 @@
+package reporting
+
+import (
+  "bufio"
+  "fmt"
+  "net"
+  "regexp"
+  "strings"
+  "testing"
+  "time"
+  "github.com/NeilBetham/elements/config"
+  "github.com/NeilBetham/elements/protocol"
+)
+
+// aprsServer accepts one connection, logs it in with logresp and returns the
+// lines the client sent
+func aprsServer(t *testing.T, logresp string) (addr string, lines <-chan []string) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  out := make(chan []string, 1)
+  go func() {
+    defer l.Close()
+    var got []string
+    defer func() { out <- got }()
+
+    conn, err := l.Accept()
+    if err != nil {
+      return
+    }
+    defer conn.Close()
+    reader := bufio.NewReader(conn)
+    fmt.Fprintf(conn, "# aprsc 2.1.10 test\r\n")
+    for {
+      line, err := reader.ReadString('\n')
+      if err != nil {
+        return
+      }
+      got = append(got, line)
+      if len(got) == 1 {
+        fmt.Fprintf(conn, "%s\r\n", logresp)
+      }
+    }
+  }()
+  return l.Addr().String(), out
+}
+
+func TestAPRSReport(t *testing.T) {
+  addr, lines := aprsServer(t, "# logresp N0CALL unverified, server T2TEST")
+  c := config.SinkConfig{Name: "cwop", Callsign: "n0call", Url: addr, Latitude: 49.0583333, Longitude: -72.0291667}
+  a, err := NewAPRSSink(c, conditions(-5, 100))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := a.ReportReading(protocol.Reading{}); err != nil {
+    t.Fatal(err)
+  }
+
+  got := <-lines
+  if len(got) != 2 {
+    t.Fatalf("got %q, want a login and a packet", got)
+  }
+  if got[0] != "user N0CALL pass -1 vers elements 1.0\r\n" {
+    t.Errorf("login line %q", got[0])
+  }
+  packet := regexp.MustCompile(`^N0CALL>APRS,TCPIP\*:@\d{6}z4903\.50N/07201\.75W_180/005g012t-05r005p040P025h00b\.\.\.\.\.\r\n$`)
+  if !packet.MatchString(got[1]) {
+    t.Errorf("packet %q", got[1])
+  }
+}
+
+func TestAPRSLoginRefused(t *testing.T) {
+  addr, _ := aprsServer(t, "# invalid login")
+  a, err := NewAPRSSink(config.SinkConfig{Name: "cwop", Callsign: "N0CALL", Url: addr}, conditions(50, 50))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := a.ReportReading(protocol.Reading{}); err == nil || !strings.Contains(err.Error(), "login failed") {
+    t.Errorf("refused login gave %v", err)
+  }
+}
+
+func TestAPRSFields(t *testing.T) {
+  tests := []struct{
+    tempF float64
+    want string
+  }{
+    {72.4, "t072"},
+    {-5, "t-05"},
+    {-15.6, "t-16"},
+    {0.4, "t000"},
+    {105, "t105"},
+  }
+  a := &APRSSink{Callsign: "N0CALL"}
+  for _, tt := range tests {
+    packet, ok := a.packet(conditions(tt.tempF, 50).Current(), time.Now())
+    if !ok || !strings.Contains(packet, tt.want + "r") {
+      t.Errorf("%v°F gave %q, want %s", tt.tempF, packet, tt.want)
+    }
+  }
+}
+
+// Humidity is sent mod 100, so 0% would read as 100%
+func TestAPRSHumidity(t *testing.T) {
+  tests := []struct{
+    humidity float64
+    want string
+  }{
+    {55, "h55"},
+    {5.4, "h05"},
+    {100, "h00"},
+    {99.6, "h00"},
+    {0, "h.."},
+    {0.4, "h.."},
+    {-3, "h.."},
+    {104, "h.."},
+  }
+  a := &APRSSink{Callsign: "N0CALL"}
+  for _, tt := range tests {
+    packet, ok := a.packet(conditions(70, tt.humidity).Current(), time.Now())
+    if !ok || !strings.Contains(packet, "P025" + tt.want + "b") {
+      t.Errorf("%v%% gave %q, want %s", tt.humidity, packet, tt.want)
+    }
+  }
+}
+
+func TestAPRSPosition(t *testing.T) {
+  tests := []struct{
+    lat, lon float64
+    want string
+  }{
+    {49.0583333, -72.0291667, "4903.50N/07201.75W"},
+    {-33.8688, 151.2093, "3352.13S/15112.56E"},
+    {0, 0, "0000.00N/00000.00E"},
+    // Minutes that round up to 60 carry into the degrees
+    {12.99999, -0.99999, "1300.00N/00100.00W"},
+    {-90, 180, "9000.00S/18000.00E"},
+  }
+  for _, tt := range tests {
+    if got := aprsLatitude(tt.lat) + "/" + aprsLongitude(tt.lon); got != tt.want {
+      t.Errorf("%v, %v gave %s, want %s", tt.lat, tt.lon, got, tt.want)
+    }
+  }
+}
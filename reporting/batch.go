@@ -0,0 +1,172 @@
+package reporting
+
+import (
+  "errors"
+  "log"
+  "sync"
+  "time"
+  "github.com/NeilBetham/elements/protocol"
+)
+
+// Batch defaults when only one of the size and interval is set
+const (
+  defaultBatchMaxReadings = 100
+  defaultBatchInterval = 30 * time.Second
+
+  // Batches waiting to be sent before the oldest is given up on, only
+  // reached when the sink is much slower than readings arrive
+  maxWaitingBatches = 10
+)
+
+var errBatchBacklog = errors.New("too many batches waiting to be sent")
+
+// batcher collects readings and sends them together once there are enough
+// or the first has waited long enough. Callers don't wait, batches are sent
+// one at a time in the order they filled from a goroutine of their own and
+// readings that fail are handed to the failure function.
+type batcher struct {
+  name string
+  send func(rs []protocol.Reading) []error
+  maxReadings int
+  interval time.Duration
+
+  mu sync.Mutex
+  pending []protocol.Reading
+  ready [][]protocol.Reading
+  timer *time.Timer
+  failed func(r protocol.Reading, err error)
+  closed bool
+
+  wake chan struct{}
+  done chan struct{}
+}
+
+func newBatcher(name string, send func(rs []protocol.Reading) []error, maxReadings int, interval time.Duration) (b *batcher) {
+  if maxReadings <= 0 {
+    maxReadings = defaultBatchMaxReadings
+  }
+  if interval <= 0 {
+    interval = defaultBatchInterval
+  }
+
+  b = &batcher{name: name, send: send, maxReadings: maxReadings, interval: interval}
+  b.wake = make(chan struct{}, 1)
+  b.done = make(chan struct{})
+  go b.run()
+  return
+}
+
+// onFailure sets where readings that fail to send go, they're logged and
+// dropped until it's set
+func (b *batcher) onFailure(fn func(r protocol.Reading, err error)) {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  b.failed = fn
+}
+
+// add queues a reading for the next batch
+func (b *batcher) add(r protocol.Reading) {
+  b.mu.Lock()
+  b.pending = append(b.pending, r)
+  var overflow []protocol.Reading
+  if len(b.pending) >= b.maxReadings {
+    overflow = b.queue()
+  } else if b.timer == nil {
+    b.timer = time.AfterFunc(b.interval, b.flush)
+  }
+  b.mu.Unlock()
+
+  b.fail(overflow, errBatchBacklog)
+}
+
+// flush queues whatever is waiting to be sent now
+func (b *batcher) flush() {
+  b.mu.Lock()
+  overflow := b.queue()
+  b.mu.Unlock()
+
+  b.fail(overflow, errBatchBacklog)
+}
+
+// close sends whatever is waiting and returns once it's done
+func (b *batcher) close() {
+  b.flush()
+  b.mu.Lock()
+  b.closed = true
+  b.mu.Unlock()
+  b.poke()
+  <-b.done
+}
+
+// queue moves the waiting readings to a batch ready to send, returning the
+// oldest batch if too many are waiting already. The lock must be held.
+func (b *batcher) queue() (overflow []protocol.Reading) {
+  if b.timer != nil {
+    b.timer.Stop()
+    b.timer = nil
+  }
+  if len(b.pending) == 0 {
+    return
+  }
+  if len(b.ready) >= maxWaitingBatches {
+    overflow = b.ready[0]
+    b.ready = b.ready[1:]
+  }
+  b.ready = append(b.ready, b.pending)
+  b.pending = nil
+  b.poke()
+  return
+}
+
+func (b *batcher) poke() {
+  select {
+  case b.wake <- struct{}{}:
+  default:
+  }
+}
+
+// run sends batches as they're ready until closed
+func (b *batcher) run() {
+  defer close(b.done)
+
+  for {
+    b.mu.Lock()
+    if len(b.ready) == 0 {
+      closed := b.closed
+      b.mu.Unlock()
+      if closed {
+        return
+      }
+      <-b.wake
+      continue
+    }
+    rs := b.ready[0]
+    b.ready = b.ready[1:]
+    b.mu.Unlock()
+
+    errs := b.send(rs)
+    for i, err := range errs {
+      if err != nil {
+        b.fail(rs[i:i + 1], err)
+      }
+    }
+  }
+}
+
+// fail hands readings that couldn't be sent to the failure function
+func (b *batcher) fail(rs []protocol.Reading, err error) {
+  if len(rs) == 0 {
+    return
+  }
+  b.mu.Lock()
+  failed := b.failed
+  b.mu.Unlock()
+
+  for _, r := range rs {
+    if failed != nil {
+      failed(r, err)
+    } else {
+      log.Printf("Error reporting batched %s reading to %s, dropping it: %s", r.SensorName, b.name, err)
+    }
+  }
+}
@@ -0,0 +1,91 @@
+package reporting
+
+import (
+  "errors"
+  "sync"
+  "testing"
+  "time"
+  "github.com/NeilBetham/elements/protocol"
+)
+
+func TestBatcherDoesNotBlock(t *testing.T) {
+  release := make(chan struct{})
+  var mu sync.Mutex
+  var sent []protocol.Reading
+  send := func(rs []protocol.Reading) []error {
+    <-release
+    mu.Lock()
+    defer mu.Unlock()
+    sent = append(sent, rs...)
+    return make([]error, len(rs))
+  }
+
+  b := newBatcher("test", send, 2, time.Hour)
+  start := time.Now()
+  for i := 0; i < 7; i++ {
+    b.add(numbered(i))
+  }
+  if d := time.Since(start); d > time.Second {
+    t.Fatalf("adding to a stuck sink took %s", d)
+  }
+
+  // Closing sends the partial batch too, everything in order
+  close(release)
+  b.close()
+  mu.Lock()
+  defer mu.Unlock()
+  if len(sent) != 7 {
+    t.Fatalf("sent %d readings, want 7", len(sent))
+  }
+  for i, r := range sent {
+    if int(r.Value) != i {
+      t.Fatalf("reading %d was %v, out of order", i, r.Value)
+    }
+  }
+}
+
+func TestBatcherFailures(t *testing.T) {
+  send := func(rs []protocol.Reading) []error {
+    errs := make([]error, len(rs))
+    for i, r := range rs {
+      if int(r.Value) % 2 == 1 {
+        errs[i] = errors.New("refused")
+      }
+    }
+    return errs
+  }
+
+  var failed []int
+  b := newBatcher("test", send, 3, time.Hour)
+  b.onFailure(func(r protocol.Reading, err error) {
+    failed = append(failed, int(r.Value))
+  })
+  for i := 0; i < 6; i++ {
+    b.add(numbered(i))
+  }
+  b.close()
+
+  if len(failed) != 3 || failed[0] != 1 || failed[1] != 3 || failed[2] != 5 {
+    t.Errorf("failures were %v, want [1 3 5]", failed)
+  }
+}
+
+func TestBatcherInterval(t *testing.T) {
+  done := make(chan []protocol.Reading, 1)
+  send := func(rs []protocol.Reading) []error {
+    done <- rs
+    return make([]error, len(rs))
+  }
+
+  b := newBatcher("test", send, 100, 20 * time.Millisecond)
+  defer b.close()
+  b.add(numbered(0))
+  select {
+  case rs := <-done:
+    if len(rs) != 1 {
+      t.Errorf("sent %d readings, want 1", len(rs))
+    }
+  case <-time.After(5 * time.Second):
+    t.Fatal("batch wasn't sent after its interval")
+  }
+}
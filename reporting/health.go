@@ -0,0 +1,116 @@
+package reporting
+
+import (
+  "sort"
+  "sync"
+  "time"
+  "github.com/NeilBetham/elements/protocol"
+)
+
+// Light readings carry the ISS solar cell output at 300 counts per volt
+const solarCountsPerVolt = 300
+
+type HealthReport struct {
+  Health struct {
+    Timestamp time.Time `json:"timestamp"`
+    Uptime float64 `json:"uptime"`
+    Reception struct {
+      PacketsReceived int `json:"packets_received"`
+      CRCFailures int `json:"crc_failures"`
+      MissedSlots int `json:"missed_slots"`
+      Resyncs int `json:"resyncs"`
+      ReceptionPct float64 `json:"reception_pct"`
+      TimeInSync float64 `json:"time_in_sync"`
+    } `json:"reception"`
+    Transmitters []TransmitterHealth `json:"transmitters"`
+  } `json:"health"`
+}
+
+type TransmitterHealth struct {
+  ID int `json:"id"`
+  InSync bool `json:"in_sync"`
+  ReceptionPct float64 `json:"reception_pct"`
+  LastPacket time.Time `json:"last_packet"`
+  BatteryLow bool `json:"battery_low"`
+  // Set while the wind vane isn't reporting a direction
+  VaneMissing bool `json:"vane_missing"`
+  // Unset until the transmitter has sent the matching reading
+  SuperCapVoltage *float64 `json:"supercap_voltage"`
+  SolarVoltage *float64 `json:"solar_voltage"`
+}
+
+// HealthTracker keeps the latest health related values seen from each
+// transmitter so they can be sent in a single report
+type HealthTracker struct {
+  mu sync.Mutex
+  start time.Time
+  transmitters map[int]*TransmitterHealth
+}
+
+// NewHealthTracker sets up a tracker, uptime is counted from now
+func NewHealthTracker() (h *HealthTracker) {
+  h = &HealthTracker{}
+  h.start = time.Now()
+  h.transmitters = make(map[int]*TransmitterHealth)
+  return
+}
+
+// HandleReading records any health data carried by a reading
+func (h *HealthTracker) HandleReading(r protocol.Reading) {
+  if !r.Valid || r.Derived {
+    return
+  }
+
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  tx, ok := h.transmitters[r.StationID]
+  if !ok {
+    tx = &TransmitterHealth{ID: r.StationID}
+    h.transmitters[r.StationID] = tx
+  }
+
+  tx.BatteryLow = r.StationBatLow
+  tx.VaneMissing = r.NoWindDir
+  switch r.Sensor {
+  case protocol.SuperCapVoltage:
+    v := r.Value
+    tx.SuperCapVoltage = &v
+  case protocol.Light:
+    v := r.Value / solarCountsPerVolt
+    tx.SolarVoltage = &v
+  }
+}
+
+// Report builds a health report from what's been seen and the reception stats
+func (h *HealthTracker) Report(stats protocol.Stats) (report HealthReport) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  now := time.Now()
+  report.Health.Timestamp = now
+  report.Health.Uptime = now.Sub(h.start).Seconds()
+
+  reception := &report.Health.Reception
+  reception.PacketsReceived = stats.PacketsReceived
+  reception.CRCFailures = stats.CRCFailures
+  reception.MissedSlots = stats.MissedSlots
+  reception.Resyncs = stats.Resyncs
+  reception.ReceptionPct = stats.ReceptionPct()
+  reception.TimeInSync = stats.TimeInSync().Seconds()
+
+  for id, txStats := range stats.Transmitters {
+    tx := TransmitterHealth{ID: id}
+    if seen, ok := h.transmitters[id]; ok {
+      tx = *seen
+    }
+    tx.InSync = txStats.InSync
+    tx.ReceptionPct = txStats.ReceptionPct()
+    tx.LastPacket = txStats.LastPacket
+    report.Health.Transmitters = append(report.Health.Transmitters, tx)
+  }
+  sort.Slice(report.Health.Transmitters, func(i, j int) bool {
+    return report.Health.Transmitters[i].ID < report.Health.Transmitters[j].ID
+  })
+  return
+}
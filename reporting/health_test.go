@@ -0,0 +1,80 @@
+package reporting
+
+import (
+  "math"
+  "testing"
+  "time"
+  "github.com/NeilBetham/elements/protocol"
+  "github.com/NeilBetham/elements/radios"
+)
+
+// issPacket decodes a packet from transmitter 1 carrying sensor with data,
+// as the protocol handler would once its CRC checks out
+func issPacket(sensor protocol.Sensor, batLow bool, data ...byte) (rd protocol.Reading) {
+  header := byte(sensor) << 4
+  if batLow {
+    header |= 0x08
+  }
+  rd = protocol.ParsePacket(radios.Packet{Data: append([]byte{header, 5, 0x80}, append(data, 0, 0)...)})
+  rd.Valid = true
+  return
+}
+
+func TestHealthReport(t *testing.T) {
+  h := NewHealthTracker()
+  // 0x5a, 0x40 is 361 hundredths of a volt, 0xe1 is 900 counts
+  h.HandleReading(issPacket(protocol.SuperCapVoltage, true, 0x5a, 0x40, 0x00))
+  h.HandleReading(issPacket(protocol.Light, true, 0xe1, 0x00, 0x00))
+  h.HandleReading(protocol.Reading{StationID: 1, Sensor: protocol.Light, Value: 9000, Valid: true, Derived: true})
+  h.HandleReading(protocol.Reading{StationID: 3, Sensor: protocol.SuperCapVoltage, Value: 2, Valid: true})
+
+  lastPacket := time.Now().Add(-time.Second)
+  stats := protocol.Stats{
+    PacketsReceived: 90,
+    CRCFailures: 4,
+    MissedSlots: 10,
+    Resyncs: 2,
+    Transmitters: map[int]*protocol.TransmitterStats{
+      2: {ID: 2, PacketsReceived: 15, MissedSlots: 5, TimeInSync: time.Minute},
+      1: {ID: 1, InSync: true, PacketsReceived: 75, MissedSlots: 5, Resyncs: 2, LastPacket: lastPacket, TimeInSync: time.Hour},
+    },
+  }
+
+  report := h.Report(stats).Health
+  if report.Uptime < 0 || report.Timestamp.IsZero() {
+    t.Errorf("Uptime %v at %s", report.Uptime, report.Timestamp)
+  }
+  reception := report.Reception
+  if reception.PacketsReceived != 90 || reception.CRCFailures != 4 || reception.MissedSlots != 10 || reception.Resyncs != 2 {
+    t.Errorf("Reception %+v", reception)
+  }
+  if reception.ReceptionPct != 90 || reception.TimeInSync != 3600 {
+    t.Errorf("Reception %v%%, in sync %vs", reception.ReceptionPct, reception.TimeInSync)
+  }
+
+  // Only transmitters with stats are reported, in order
+  txs := report.Transmitters
+  if len(txs) != 2 || txs[0].ID != 1 || txs[1].ID != 2 {
+    t.Fatalf("Transmitters %+v", txs)
+  }
+  tx := txs[0]
+  if !tx.InSync || tx.ReceptionPct != 93.75 || !tx.LastPacket.Equal(lastPacket) || !tx.BatteryLow {
+    t.Errorf("Transmitter 1 %+v", tx)
+  }
+  if tx.SuperCapVoltage == nil || math.Abs(*tx.SuperCapVoltage - 3.61) > 1e-9 {
+    t.Errorf("Supercap voltage %v", tx.SuperCapVoltage)
+  }
+  if tx.SolarVoltage == nil || math.Abs(*tx.SolarVoltage - 3) > 1e-9 {
+    t.Errorf("Solar voltage %v", tx.SolarVoltage)
+  }
+  tx = txs[1]
+  if tx.InSync || tx.ReceptionPct != 75 || tx.BatteryLow || tx.SuperCapVoltage != nil || tx.SolarVoltage != nil {
+    t.Errorf("Transmitter 2 %+v", tx)
+  }
+
+  // The flags follow the latest packet
+  h.HandleReading(issPacket(protocol.Temperature, false, 0x2c, 0x60, 0x00))
+  if tx = h.Report(stats).Health.Transmitters[0]; tx.BatteryLow || tx.SuperCapVoltage == nil {
+    t.Errorf("After battery recovered %+v", tx)
+  }
+}
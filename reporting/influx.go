@@ -0,0 +1,267 @@
+package reporting
+
+import (
+  "bytes"
+  "compress/gzip"
+  "fmt"
+  "io/ioutil"
+  "net"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "time"
+  "github.com/NeilBetham/elements/config"
+  "github.com/NeilBetham/elements/protocol"
+)
+
+const (
+  defaultInfluxMeasurement = "elements"
+  // Keep UDP datagrams inside a typical MTU
+  influxMaxDatagram = 1400
+)
+
+// InfluxSink writes readings as InfluxDB line protocol, either to the v2 HTTP
+// write API or a UDP listener. Each reading is a point tagged with the
+// station, transmitter, sensor and the channel its packet came in on, wind
+// from each packet is written as points of its own.
+type InfluxSink struct {
+  name string
+  Client *http.Client
+  // HTTP write endpoint, empty when writing over UDP
+  WriteUrl string
+  Token string
+  Gzip bool
+  StationID string
+  Measurement string
+
+  udp net.Conn
+  batcher *batcher
+}
+
+var _ BatchSink = (*InfluxSink)(nil)
+var _ AsyncSink = (*InfluxSink)(nil)
+
+// NewInfluxSink sets up an InfluxDB sink, url is http(s)://host:port for
+// the write API or udp://host:port
+func NewInfluxSink(c config.SinkConfig) (s *InfluxSink, err error) {
+  u, err := url.Parse(c.Url)
+  if err != nil {
+    return nil, fmt.Errorf("sink %s has an invalid url: %s", c.Name, err)
+  }
+
+  s = &InfluxSink{
+    name: c.Name,
+    Token: c.Token,
+    Gzip: c.Gzip,
+    StationID: c.StationID,
+    Measurement: c.Measurement,
+  }
+  if s.Measurement == "" {
+    s.Measurement = defaultInfluxMeasurement
+  }
+
+  switch u.Scheme {
+  case "http", "https":
+    if c.Org == "" || c.Bucket == "" {
+      return nil, fmt.Errorf("sink %s needs an org and bucket", c.Name)
+    }
+    query := url.Values{}
+    query.Set("org", c.Org)
+    query.Set("bucket", c.Bucket)
+    query.Set("precision", "ns")
+    u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+    u.RawQuery = query.Encode()
+    s.WriteUrl = u.String()
+    s.Client = &http.Client{Timeout: 30 * time.Second}
+  case "udp":
+    if s.udp, err = net.Dial("udp", u.Host); err != nil {
+      return nil, err
+    }
+  default:
+    return nil, fmt.Errorf("sink %s url must be http, https or udp", c.Name)
+  }
+
+  if c.Batch.MaxReadings > 1 || c.Batch.Interval > 0 {
+    s.batcher = newBatcher(s.name, s.ReportReadings, c.Batch.MaxReadings, c.Batch.Interval)
+  }
+  return
+}
+
+func (s *InfluxSink) Name() string {
+  return s.name
+}
+
+// ReportReading writes a reading, it joins the next batch if batching is on
+// and failures are passed to the OnFailure function
+func (s *InfluxSink) ReportReading(r protocol.Reading) error {
+  if s.batcher != nil {
+    s.batcher.add(r)
+    return nil
+  }
+  return s.ReportReadings([]protocol.Reading{r})[0]
+}
+
+// ReportReadings writes readings together, InfluxDB takes or refuses a
+// write whole so they share any error
+func (s *InfluxSink) ReportReadings(rs []protocol.Reading) (errs []error) {
+  var lines []string
+  for _, r := range rs {
+    lines = append(lines, s.lines(r)...)
+  }
+
+  var err error
+  if len(lines) > 0 {
+    if s.udp != nil {
+      err = s.writeUDP(lines)
+    } else {
+      err = s.writeHTTP(lines)
+    }
+  }
+
+  errs = make([]error, len(rs))
+  for i := range errs {
+    errs[i] = err
+  }
+  return
+}
+
+// OnFailure sets where batched readings that fail to write go, they're
+// logged and dropped otherwise
+func (s *InfluxSink) OnFailure(fn func(r protocol.Reading, err error)) {
+  if s.batcher != nil {
+    s.batcher.onFailure(fn)
+  }
+}
+
+// Close sends anything waiting for the next batch
+func (s *InfluxSink) Close() error {
+  if s.batcher != nil {
+    s.batcher.close()
+  }
+  if s.udp != nil {
+    return s.udp.Close()
+  }
+  return nil
+}
+
+func (s *InfluxSink) writeHTTP(lines []string) (err error) {
+  var body bytes.Buffer
+  data := strings.Join(lines, "\n")
+  if s.Gzip {
+    zw := gzip.NewWriter(&body)
+    if _, err = zw.Write([]byte(data)); err != nil {
+      return
+    }
+    if err = zw.Close(); err != nil {
+      return
+    }
+  } else {
+    body.WriteString(data)
+  }
+
+  req, err := http.NewRequest("POST", s.WriteUrl, &body)
+  if err != nil {
+    return
+  }
+  req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+  if s.Token != "" {
+    req.Header.Set("Authorization", "Token " + s.Token)
+  }
+  if s.Gzip {
+    req.Header.Set("Content-Encoding", "gzip")
+  }
+
+  resp, err := s.Client.Do(req)
+  if err != nil {
+    return
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode >= 300 {
+    reply, _ := ioutil.ReadAll(resp.Body)
+    return statusError(resp.StatusCode, strings.TrimSpace(string(reply)))
+  }
+  return
+}
+
+// writeUDP sends as many lines in each datagram as fit
+func (s *InfluxSink) writeUDP(lines []string) error {
+  var datagram bytes.Buffer
+  for _, line := range lines {
+    if datagram.Len() > 0 && datagram.Len() + len(line) + 1 > influxMaxDatagram {
+      if _, err := s.udp.Write(datagram.Bytes()); err != nil {
+        return err
+      }
+      datagram.Reset()
+    }
+    datagram.WriteString(line)
+    datagram.WriteByte('\n')
+  }
+  _, err := s.udp.Write(datagram.Bytes())
+  return err
+}
+
+// lines the points for a reading, the sensor value and for packets straight
+// from the ISS its wind speed and direction if the vane is reporting
+func (s *InfluxSink) lines(r protocol.Reading) (lines []string) {
+  if !r.Valid {
+    return
+  }
+
+  at := r.Timestamp
+  if at.IsZero() {
+    at = time.Now()
+  }
+
+  tags := strings.NewReplacer(",", `\,`, " ", `\ `).Replace(s.Measurement)
+  if s.StationID != "" {
+    tags += ",station=" + escapeInfluxTag(s.StationID)
+  }
+  tags += ",transmitter=" + strconv.Itoa(r.StationID)
+  if !r.Derived {
+    tags += ",channel=" + strconv.Itoa(r.Freq)
+  }
+
+  var reception string
+  if !r.Derived {
+    reception = fmt.Sprintf(",rssi=%s,freq_err=%di", formatInfluxFloat(r.Rssi), r.FreqErr)
+  }
+  timestamp := strconv.FormatInt(at.UnixNano(), 10)
+
+  if !r.NoSensor {
+    // Calibrated values keep what was sent alongside
+    var uncalibrated string
+    if r.Calibration != nil {
+      uncalibrated = ",uncalibrated=" + formatInfluxFloat(r.UncalibratedValue)
+    }
+    lines = append(lines, fmt.Sprintf(
+      "%s,sensor=%s value=%s,raw=%di%s%s %s",
+      tags,
+      escapeInfluxTag(r.SensorName),
+      formatInfluxFloat(r.Value),
+      r.RawValue,
+      uncalibrated,
+      reception,
+      timestamp,
+    ))
+  }
+  if r.Derived {
+    return
+  }
+
+  lines = append(lines, fmt.Sprintf("%s,sensor=WindSpeed value=%s%s %s", tags, formatInfluxFloat(r.WindSpeed), reception, timestamp))
+  if !r.NoWindDir {
+    lines = append(lines, fmt.Sprintf("%s,sensor=WindDir value=%s%s %s", tags, formatInfluxFloat(r.WindDir), reception, timestamp))
+  }
+  return
+}
+
+// escapeInfluxTag escapes the characters line protocol gives meaning to in
+// tag keys and values
+func escapeInfluxTag(s string) string {
+  return strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `).Replace(s)
+}
+
+func formatInfluxFloat(v float64) string {
+  return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,264 @@
+package reporting
+
+import (
+  "compress/gzip"
+  "fmt"
+  "io/ioutil"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+  "github.com/NeilBetham/elements/config"
+  "github.com/NeilBetham/elements/protocol"
+)
+
+var influxAt = time.Unix(1600000000, 5)
+
+func TestInfluxLines(t *testing.T) {
+  calibration := protocol.Calibration{}
+  s := &InfluxSink{Measurement: "my weather,x", StationID: "home, lab=1"}
+  tags := `my\ weather\,x,station=home\,\ lab\=1,transmitter=2`
+  at := " 1600000000000000005"
+
+  tests := []struct {
+    name string
+    reading protocol.Reading
+    lines []string
+  }{
+    {
+      "sensor and wind",
+      protocol.Reading{StationID: 2, Timestamp: influxAt, SensorName: "Outside Temp", Value: 71.5, RawValue: 715,
+        Valid: true, WindSpeed: 5, WindDir: 182.8, Freq: 3, Rssi: -72.5, FreqErr: -120},
+      []string{
+        tags + `,channel=3,sensor=Outside\ Temp value=71.5,raw=715i,rssi=-72.5,freq_err=-120i` + at,
+        tags + `,channel=3,sensor=WindSpeed value=5,rssi=-72.5,freq_err=-120i` + at,
+        tags + `,channel=3,sensor=WindDir value=182.8,rssi=-72.5,freq_err=-120i` + at,
+      },
+    },
+    {
+      "calibrated",
+      protocol.Reading{StationID: 2, Timestamp: influxAt, SensorName: "Humidity", Value: 52, RawValue: 500,
+        UncalibratedValue: 50, Calibration: &calibration, Valid: true, NoWindDir: true, Freq: 0, Rssi: -80},
+      []string{
+        tags + `,channel=0,sensor=Humidity value=52,raw=500i,uncalibrated=50,rssi=-80,freq_err=0i` + at,
+        tags + `,channel=0,sensor=WindSpeed value=0,rssi=-80,freq_err=0i` + at,
+      },
+    },
+    {
+      "no sensor",
+      protocol.Reading{StationID: 2, Timestamp: influxAt, SensorName: "Solar", Valid: true, NoSensor: true,
+        WindSpeed: 3, NoWindDir: true, Freq: 7, Rssi: -90},
+      []string{tags + `,channel=7,sensor=WindSpeed value=3,rssi=-90,freq_err=0i` + at},
+    },
+    {
+      "derived",
+      protocol.Reading{StationID: 2, Timestamp: influxAt, SensorName: "Dew Point", Value: 48.25, Valid: true, Derived: true},
+      []string{tags + `,sensor=Dew\ Point value=48.25,raw=0i` + at},
+    },
+    {
+      "invalid",
+      protocol.Reading{StationID: 2, Timestamp: influxAt, SensorName: "Outside Temp", WindSpeed: 5},
+      nil,
+    },
+  }
+
+  for _, test := range tests {
+    lines := s.lines(test.reading)
+    if strings.Join(lines, "\n") != strings.Join(test.lines, "\n") {
+      t.Errorf("%s: got\n%s\nwant\n%s", test.name, strings.Join(lines, "\n"), strings.Join(test.lines, "\n"))
+    }
+  }
+}
+
+// influxWrite what the server saw of a write
+type influxWrite struct {
+  path string
+  query url.Values
+  auth string
+  encoding string
+  body string
+}
+
+// influxServer records every write and replies with status
+func influxServer(t *testing.T, status int) (server *httptest.Server, writes func() []influxWrite) {
+  var mu sync.Mutex
+  var got []influxWrite
+  server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    body := r.Body
+    if r.Header.Get("Content-Encoding") == "gzip" {
+      zr, err := gzip.NewReader(r.Body)
+      if err != nil {
+        t.Errorf("Body isn't gzip: %s", err)
+        return
+      }
+      body = zr
+    }
+    data, _ := ioutil.ReadAll(body)
+    mu.Lock()
+    got = append(got, influxWrite{r.URL.Path, r.URL.Query(), r.Header.Get("Authorization"), r.Header.Get("Content-Encoding"), string(data)})
+    mu.Unlock()
+    if status >= 300 {
+      http.Error(w, "bucket not found", status)
+      return
+    }
+    w.WriteHeader(status)
+  }))
+  writes = func() []influxWrite {
+    mu.Lock()
+    defer mu.Unlock()
+    return append([]influxWrite(nil), got...)
+  }
+  return
+}
+
+func influxReading(value float64) protocol.Reading {
+  return protocol.Reading{StationID: 1, Timestamp: influxAt, SensorName: "Outside Temp", Value: value, Valid: true, NoWindDir: true}
+}
+
+func TestInfluxHTTP(t *testing.T) {
+  for _, gzipped := range []bool{false, true} {
+    server, writes := influxServer(t, http.StatusNoContent)
+    s, err := NewInfluxSink(config.SinkConfig{
+      Name: "influx", Type: "influx", Url: server.URL + "/influx/", Token: "secret", Gzip: gzipped,
+      Org: "my org", Bucket: "weather",
+    })
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    errs := s.ReportReadings([]protocol.Reading{influxReading(70), influxReading(71)})
+    for _, err := range errs {
+      if err != nil {
+        t.Errorf("gzip %t: write failed: %s", gzipped, err)
+      }
+    }
+    got := writes()
+    if len(got) != 1 {
+      t.Fatalf("gzip %t: %d writes, want 1", gzipped, len(got))
+    }
+    w := got[0]
+    if w.path != "/influx/api/v2/write" {
+      t.Errorf("gzip %t: path %q", gzipped, w.path)
+    }
+    if w.query.Get("org") != "my org" || w.query.Get("bucket") != "weather" || w.query.Get("precision") != "ns" {
+      t.Errorf("gzip %t: query %v", gzipped, w.query)
+    }
+    if w.auth != "Token secret" {
+      t.Errorf("gzip %t: authorization %q", gzipped, w.auth)
+    }
+    if gzipped != (w.encoding == "gzip") {
+      t.Errorf("gzip %t: content encoding %q", gzipped, w.encoding)
+    }
+    if lines := strings.Split(w.body, "\n"); len(lines) != 4 || !strings.Contains(lines[2], "value=71,") {
+      t.Errorf("gzip %t: body\n%s", gzipped, w.body)
+    }
+    s.Close()
+    server.Close()
+  }
+}
+
+func TestInfluxHTTPStatus(t *testing.T) {
+  tests := []struct {
+    status int
+    permanent bool
+  }{
+    {http.StatusOK, false},
+    {http.StatusNotFound, true},
+    {http.StatusUnauthorized, true},
+    {http.StatusTooManyRequests, false},
+    {http.StatusServiceUnavailable, false},
+  }
+
+  for _, test := range tests {
+    server, _ := influxServer(t, test.status)
+    s, err := NewInfluxSink(config.SinkConfig{Name: "influx", Url: server.URL, Org: "org", Bucket: "weather"})
+    if err != nil {
+      t.Fatal(err)
+    }
+    errs := s.ReportReadings([]protocol.Reading{influxReading(70), influxReading(71)})
+    for i, err := range errs {
+      if test.status < 300 {
+        if err != nil {
+          t.Errorf("%d: reading %d failed: %s", test.status, i, err)
+        }
+        continue
+      }
+      if err == nil || !strings.Contains(err.Error(), "bucket not found") {
+        t.Errorf("%d: reading %d error %v", test.status, i, err)
+      }
+      if _, permanent := err.(*PermanentError); permanent != test.permanent {
+        t.Errorf("%d: permanent %t, want %t", test.status, permanent, test.permanent)
+      }
+    }
+    server.Close()
+  }
+}
+
+func TestInfluxConfig(t *testing.T) {
+  for _, c := range []config.SinkConfig{
+    {Name: "no org", Url: "http://localhost:8086", Bucket: "weather"},
+    {Name: "no bucket", Url: "http://localhost:8086", Org: "org"},
+    {Name: "scheme", Url: "tcp://localhost:8086", Org: "org", Bucket: "weather"},
+  } {
+    if _, err := NewInfluxSink(c); err == nil {
+      t.Errorf("%s: no error", c.Name)
+    }
+  }
+}
+
+func TestInfluxUDP(t *testing.T) {
+  conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer conn.Close()
+
+  s, err := NewInfluxSink(config.SinkConfig{Name: "influx", Url: "udp://" + conn.LocalAddr().String(), StationID: "home"})
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer s.Close()
+
+  var rs []protocol.Reading
+  for i := 0; i < 40; i++ {
+    rs = append(rs, influxReading(float64(i)))
+  }
+  for _, err := range s.ReportReadings(rs) {
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  // Each reading is two lines, the sensor and wind speed
+  var got []string
+  buf := make([]byte, 65536)
+  datagrams := 0
+  for len(got) < 2 * len(rs) {
+    conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+    n, _, err := conn.ReadFrom(buf)
+    if err != nil {
+      t.Fatalf("Got %d of %d lines: %s", len(got), 2 * len(rs), err)
+    }
+    datagrams++
+    if n > influxMaxDatagram {
+      t.Errorf("Datagram of %d bytes", n)
+    }
+    data := string(buf[:n])
+    if !strings.HasSuffix(data, "\n") {
+      t.Errorf("Datagram splits a line: %q", data)
+    }
+    got = append(got, strings.Split(strings.TrimSuffix(data, "\n"), "\n")...)
+  }
+  if datagrams < 2 {
+    t.Errorf("%d datagrams, want the lines split", datagrams)
+  }
+  for i, r := range rs {
+    if want := fmt.Sprintf("sensor=Outside\\ Temp value=%d,", int(r.Value)); !strings.Contains(got[2 * i], want) {
+      t.Errorf("Line %d is %q, want %q", 2 * i, got[2 * i], want)
+    }
+  }
+}
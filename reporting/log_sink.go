@@ -0,0 +1,101 @@
+package reporting
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "log"
+  "os"
+  "sync"
+  "time"
+  "github.com/NeilBetham/elements/config"
+  "github.com/NeilBetham/elements/protocol"
+)
+
+// LogSink writes readings to a file, or the program log without one
+type LogSink struct {
+  mu sync.Mutex
+  name string
+  json bool
+  out io.Writer
+}
+
+var _ HealthSink = (*LogSink)(nil)
+
+// NewLogSink sets up a log sink, the file is appended to if it exists
+func NewLogSink(c config.SinkConfig) (l *LogSink, err error) {
+  l = &LogSink{name: c.Name}
+
+  switch c.Format {
+  case "", "text":
+  case "json":
+    l.json = true
+  default:
+    return nil, fmt.Errorf("sink %s has unknown log format %q", c.Name, c.Format)
+  }
+
+  if c.Path != "" {
+    f, err := os.OpenFile(c.Path, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0644)
+    if err != nil {
+      return nil, err
+    }
+    l.out = f
+  }
+  return
+}
+
+func (l *LogSink) Name() string {
+  return l.name
+}
+
+func (l *LogSink) ReportReading(r protocol.Reading) error {
+  if l.json {
+    return l.writeJSON(r)
+  }
+  return l.writeText(r.String())
+}
+
+func (l *LogSink) ReportHealth(h HealthReport) error {
+  if l.json {
+    return l.writeJSON(h)
+  }
+  return l.writeText(fmt.Sprintf("Health: %+v", h.Health))
+}
+
+// writeJSON writes one JSON document per line
+func (l *LogSink) writeJSON(v interface{}) error {
+  line, err := json.Marshal(v)
+  if err != nil {
+    return err
+  }
+  return l.write(string(line))
+}
+
+func (l *LogSink) writeText(line string) error {
+  if l.out == nil {
+    return l.write(line)
+  }
+  return l.write(time.Now().Format(time.RFC3339) + " " + line)
+}
+
+// Close closes the log file, if there is one
+func (l *LogSink) Close() error {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  if c, ok := l.out.(io.Closer); ok {
+    return c.Close()
+  }
+  return nil
+}
+
+func (l *LogSink) write(line string) (err error) {
+  if l.out == nil {
+    log.Print(line)
+    return
+  }
+
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  _, err = fmt.Fprintln(l.out, line)
+  return
+}
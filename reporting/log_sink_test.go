@@ -0,0 +1,70 @@
+package reporting
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "github.com/NeilBetham/elements/config"
+  "github.com/NeilBetham/elements/protocol"
+)
+
+func TestLogSinkFile(t *testing.T) {
+  dir := tempDir(t)
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "readings.log")
+  l, err := NewLogSink(config.SinkConfig{Name: "log", Path: path, Format: "json"})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := l.ReportReading(numbered(1)); err != nil {
+    t.Fatal(err)
+  }
+  if err := l.ReportReading(numbered(2)); err != nil {
+    t.Fatal(err)
+  }
+  if err := l.Close(); err != nil {
+    t.Fatal(err)
+  }
+  // The file is closed, not left open for the next write
+  if err := l.ReportReading(numbered(3)); err == nil {
+    t.Error("Wrote after close")
+  }
+
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+  if len(lines) != 2 {
+    t.Fatalf("Got %d lines, want 2:\n%s", len(lines), data)
+  }
+  for i, line := range lines {
+    var r protocol.Reading
+    if err := json.Unmarshal([]byte(line), &r); err != nil || r.Value != float64(i + 1) {
+      t.Errorf("Line %d is %q: %v", i, line, err)
+    }
+  }
+
+  // Appended to when opened again
+  l, err = NewLogSink(config.SinkConfig{Name: "log", Path: path})
+  if err != nil {
+    t.Fatal(err)
+  }
+  l.ReportReading(numbered(4))
+  l.Close()
+  if data, _ = ioutil.ReadFile(path); strings.Count(string(data), "\n") != 3 {
+    t.Errorf("File after reopening:\n%s", data)
+  }
+}
+
+func TestLogSinkOpenFails(t *testing.T) {
+  dir := tempDir(t)
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "missing", "readings.log")
+  if l, err := NewLogSink(config.SinkConfig{Name: "log", Path: path}); err == nil || l != nil {
+    t.Errorf("Got %v, %v for a missing directory", l, err)
+  }
+}
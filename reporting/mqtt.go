@@ -0,0 +1,364 @@
+package reporting
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+  "github.com/NeilBetham/elements/config"
+  "github.com/NeilBetham/elements/mqtt"
+  "github.com/NeilBetham/elements/protocol"
+)
+
+const (
+  defaultMQTTBroker = "localhost:1883"
+  defaultMQTTTopicPrefix = "elements"
+  defaultMQTTDiscoveryPrefix = "homeassistant"
+  mqttKeepAlive = 60 * time.Second
+
+  // Waits between attempts to connect to the broker, doubling from the
+  // shortest while it can't be reached
+  minMQTTRetry = time.Second
+  maxMQTTRetry = time.Minute
+)
+
+var errMQTTConnecting = errors.New("not connected to the MQTT broker yet")
+
+// Availability payloads, the receiver is online while it's in sync with an
+// ISS
+const (
+  mqttOnline = "online"
+  mqttOffline = "offline"
+)
+
+// mqttEntity a value published to its own topic and announced to Home
+// Assistant
+type mqttEntity struct {
+  key string
+  name string
+  // sensor or binary_sensor
+  component string
+  unit string
+  deviceClass string
+  stateClass string
+}
+
+// Entities for the sensors the ISS sends and those derived from them
+var mqttSensorEntities = map[protocol.Sensor]mqttEntity{
+  protocol.Temperature: {"temperature", "Temperature", "sensor", "°F", "temperature", "measurement"},
+  protocol.Humidity: {"humidity", "Humidity", "sensor", "%", "humidity", "measurement"},
+  protocol.WindGustSpeed: {"wind_gust", "Wind gust", "sensor", "mph", "wind_speed", "measurement"},
+  protocol.RainRate: {"rain_rate", "Rain rate", "sensor", "in/h", "precipitation_intensity", "measurement"},
+  protocol.UVIndex: {"uv_index", "UV index", "sensor", "UV index", "", "measurement"},
+  protocol.SolarRadiation: {"solar_radiation", "Solar radiation", "sensor", "W/m²", "irradiance", "measurement"},
+  protocol.SuperCapVoltage: {"supercap_voltage", "Supercap voltage", "sensor", "V", "voltage", "measurement"},
+  protocol.RainTotal: {"rain_total", "Rain total", "sensor", "in", "precipitation", "total_increasing"},
+  protocol.RainLastHour: {"rain_last_hour", "Rain last hour", "sensor", "in", "precipitation", "measurement"},
+  protocol.RainLast24h: {"rain_last_24h", "Rain last 24 hours", "sensor", "in", "precipitation", "measurement"},
+  protocol.RainDaily: {"rain_daily", "Rain today", "sensor", "in", "precipitation", "total_increasing"},
+  protocol.RainStorm: {"rain_storm", "Rain storm", "sensor", "in", "precipitation", "measurement"},
+  protocol.RainYearly: {"rain_yearly", "Rain this year", "sensor", "in", "precipitation", "total_increasing"},
+  protocol.DewPoint: {"dew_point", "Dew point", "sensor", "°F", "temperature", "measurement"},
+  protocol.HeatIndex: {"heat_index", "Heat index", "sensor", "°F", "temperature", "measurement"},
+  protocol.WindChill: {"wind_chill", "Wind chill", "sensor", "°F", "temperature", "measurement"},
+  protocol.THWIndex: {"thw_index", "THW index", "sensor", "°F", "temperature", "measurement"},
+  protocol.THSWIndex: {"thsw_index", "THSW index", "sensor", "°F", "temperature", "measurement"},
+  protocol.Humidex: {"humidex", "Humidex", "sensor", "", "", "measurement"},
+  protocol.WetBulb: {"wet_bulb", "Wet bulb temperature", "sensor", "°F", "temperature", "measurement"},
+  protocol.ApparentTemperature: {"apparent_temperature", "Apparent temperature", "sensor", "°F", "temperature", "measurement"},
+  protocol.WindSpeedAvg2Min: {"wind_speed_avg_2m", "Wind speed 2 min average", "sensor", "mph", "wind_speed", "measurement"},
+  protocol.WindDirAvg2Min: {"wind_direction_avg_2m", "Wind direction 2 min average", "sensor", "°", "", "measurement"},
+  protocol.WindVectorSpeed2Min: {"wind_vector_speed_2m", "Wind vector speed 2 min", "sensor", "mph", "wind_speed", "measurement"},
+  protocol.WindVectorDir2Min: {"wind_vector_direction_2m", "Wind vector direction 2 min", "sensor", "°", "", "measurement"},
+  protocol.WindSpeedAvg10Min: {"wind_speed_avg_10m", "Wind speed 10 min average", "sensor", "mph", "wind_speed", "measurement"},
+  protocol.WindDirAvg10Min: {"wind_direction_avg_10m", "Wind direction 10 min average", "sensor", "°", "", "measurement"},
+  protocol.WindVectorSpeed10Min: {"wind_vector_speed_10m", "Wind vector speed 10 min", "sensor", "mph", "wind_speed", "measurement"},
+  protocol.WindVectorDir10Min: {"wind_vector_direction_10m", "Wind vector direction 10 min", "sensor", "°", "", "measurement"},
+  protocol.WindGust10Min: {"wind_gust_10m", "Wind gust 10 min", "sensor", "mph", "wind_speed", "measurement"},
+  protocol.WindGustDir10Min: {"wind_gust_direction_10m", "Wind gust direction 10 min", "sensor", "°", "", "measurement"},
+  protocol.WindDirStdDev10Min: {"wind_direction_std_dev_10m", "Wind direction std dev 10 min", "sensor", "°", "", "measurement"},
+  protocol.Beaufort: {"beaufort", "Beaufort force", "sensor", "", "", "measurement"},
+}
+
+// Entities carried by every packet whatever the sensor
+var (
+  mqttWindSpeed = mqttEntity{"wind_speed", "Wind speed", "sensor", "mph", "wind_speed", "measurement"}
+  mqttWindDir = mqttEntity{"wind_direction", "Wind direction", "sensor", "°", "", "measurement"}
+  mqttBatteryLow = mqttEntity{"battery_low", "Battery low", "binary_sensor", "", "battery", ""}
+  mqttRssi = mqttEntity{"rssi", "Signal strength", "sensor", "dBm", "signal_strength", "measurement"}
+)
+
+// MQTTSink publishes each value to its own retained topic under the topic
+// prefix, <prefix>/<transmitter>/<value>. Home Assistant discovery configs
+// are published for every value the first time it's seen on a connection
+// and <prefix>/status tracks whether the receiver is in sync, the broker
+// sets it offline if we drop off. The broker is dialled in the background,
+// readings that arrive before it's connected fail straight away.
+type MQTTSink struct {
+  name string
+  Broker string
+  TopicPrefix string
+  DiscoveryPrefix string
+  Options mqtt.Options
+
+  mu sync.Mutex
+  client *mqtt.Client
+  announced map[string]bool
+  inSync bool
+  // Set while a connection is being made, the next isn't tried before
+  // nextDial
+  dialling bool
+  retry time.Duration
+  nextDial time.Time
+  closed bool
+}
+
+var _ SyncSink = (*MQTTSink)(nil)
+
+// NewMQTTSink sets up an MQTT sink, it starts connecting on the first
+// reading
+func NewMQTTSink(c config.SinkConfig) (m *MQTTSink, err error) {
+  m = &MQTTSink{
+    name: c.Name,
+    Broker: c.Url,
+    TopicPrefix: strings.TrimSuffix(c.TopicPrefix, "/"),
+    DiscoveryPrefix: strings.TrimSuffix(c.DiscoveryPrefix, "/"),
+  }
+  if m.Broker == "" {
+    m.Broker = defaultMQTTBroker
+  }
+  if m.TopicPrefix == "" {
+    m.TopicPrefix = defaultMQTTTopicPrefix
+  }
+  if m.DiscoveryPrefix == "" {
+    m.DiscoveryPrefix = defaultMQTTDiscoveryPrefix
+  }
+
+  m.Options = mqtt.Options{
+    ClientID: "elements-" + c.Name,
+    Username: c.Username,
+    Password: c.Password,
+    KeepAlive: mqttKeepAlive,
+    Will: &mqtt.Message{
+      Topic: m.statusTopic(),
+      Payload: []byte(mqttOffline),
+      Retain: true,
+    },
+  }
+  return
+}
+
+func (m *MQTTSink) Name() string {
+  return m.name
+}
+
+// ReportReading publishes every value the reading carries
+func (m *MQTTSink) ReportReading(r protocol.Reading) (err error) {
+  if !r.Valid {
+    return
+  }
+
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  // Packets only arrive from transmitters we're in sync with
+  if !r.Derived {
+    m.inSync = true
+  }
+  if !m.connected() {
+    return errMQTTConnecting
+  }
+
+  if entity, ok := mqttSensorEntities[r.Sensor]; ok && !r.NoSensor {
+    err = m.publishValue(r.StationID, entity, formatMQTTFloat(r.Value))
+  }
+  if r.Derived || err != nil {
+    return
+  }
+
+  batteryLow := "OFF"
+  if r.StationBatLow {
+    batteryLow = "ON"
+  }
+  type mqttValue struct {
+    entity mqttEntity
+    value string
+  }
+  values := []mqttValue{
+    {mqttWindSpeed, formatMQTTFloat(r.WindSpeed)},
+    {mqttBatteryLow, batteryLow},
+    {mqttRssi, formatMQTTFloat(r.Rssi)},
+  }
+  if !r.NoWindDir {
+    values = append(values, mqttValue{mqttWindDir, formatMQTTFloat(r.WindDir)})
+  }
+  for _, v := range values {
+    if err = m.publishValue(r.StationID, v.entity, v.value); err != nil {
+      return
+    }
+  }
+  return
+}
+
+// ReportSync publishes the receiver's availability, it's published on
+// connecting if there's no connection yet
+func (m *MQTTSink) ReportSync(inSync bool) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  m.inSync = inSync
+  if !m.connected() {
+    return nil
+  }
+  return m.publishStatus()
+}
+
+// Close marks the receiver offline and disconnects
+func (m *MQTTSink) Close() error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  m.closed = true
+  if m.client == nil {
+    return nil
+  }
+  m.inSync = false
+  m.publishStatus()
+  m.client.Close()
+  m.client = nil
+  return nil
+}
+
+// connected whether there's a working connection, if not one is started in
+// the background unless it's too soon to try again. The lock must be held.
+func (m *MQTTSink) connected() bool {
+  if m.client != nil && m.client.Err() == nil {
+    return true
+  }
+  if m.client != nil {
+    m.client.Close()
+    m.client = nil
+  }
+  if !m.dialling && !m.closed && !time.Now().Before(m.nextDial) {
+    m.dialling = true
+    go m.dial()
+  }
+  return false
+}
+
+// dial connects to the broker without holding the lock, so a broker that's
+// slow or down doesn't hold up the readings
+func (m *MQTTSink) dial() {
+  client, err := mqtt.Dial(m.Broker, m.Options)
+
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  m.dialling = false
+  if err != nil {
+    m.retry *= 2
+    if m.retry < minMQTTRetry {
+      m.retry = minMQTTRetry
+    }
+    if m.retry > maxMQTTRetry {
+      m.retry = maxMQTTRetry
+    }
+    m.nextDial = time.Now().Add(m.retry)
+    log.Printf("Error connecting %s to %s, retrying in %s: %s", m.name, m.Broker, m.retry, err)
+    return
+  }
+  if m.closed {
+    client.Close()
+    return
+  }
+
+  m.retry = 0
+  m.client = client
+  m.announced = make(map[string]bool)
+  if err := m.publishStatus(); err != nil {
+    log.Printf("Error publishing status to %s: %s", m.name, err)
+  }
+}
+
+func (m *MQTTSink) publishStatus() error {
+  status := mqttOffline
+  if m.inSync {
+    status = mqttOnline
+  }
+  return m.publish(m.statusTopic(), []byte(status))
+}
+
+// publishValue publishes a value, announcing it to Home Assistant first if
+// it hasn't been on this connection
+func (m *MQTTSink) publishValue(stationID int, entity mqttEntity, value string) error {
+  topic := fmt.Sprintf("%s/%d/%s", m.TopicPrefix, stationID, entity.key)
+  if !m.announced[topic] {
+    if err := m.announce(stationID, entity, topic); err != nil {
+      return err
+    }
+    m.announced[topic] = true
+  }
+  return m.publish(topic, []byte(value))
+}
+
+// announce publishes the Home Assistant discovery config for a value
+func (m *MQTTSink) announce(stationID int, entity mqttEntity, stateTopic string) error {
+  nodeID := fmt.Sprintf("%s_%d", strings.Replace(m.TopicPrefix, "/", "_", -1), stationID)
+
+  discovery := map[string]interface{}{
+    "name": entity.name,
+    "unique_id": nodeID + "_" + entity.key,
+    "state_topic": stateTopic,
+    "availability_topic": m.statusTopic(),
+    "payload_available": mqttOnline,
+    "payload_not_available": mqttOffline,
+    "device": map[string]interface{}{
+      "identifiers": []string{nodeID},
+      "name": fmt.Sprintf("Davis ISS %d", stationID),
+      "manufacturer": "Davis Instruments",
+      "model": "ISS",
+    },
+  }
+  if entity.unit != "" {
+    discovery["unit_of_measurement"] = entity.unit
+  }
+  if entity.deviceClass != "" {
+    discovery["device_class"] = entity.deviceClass
+  }
+  if entity.stateClass != "" {
+    discovery["state_class"] = entity.stateClass
+  }
+  if entity.component == "binary_sensor" {
+    discovery["payload_on"] = "ON"
+    discovery["payload_off"] = "OFF"
+  }
+
+  payload, err := json.Marshal(discovery)
+  if err != nil {
+    return err
+  }
+  topic := fmt.Sprintf("%s/%s/%s/%s/config", m.DiscoveryPrefix, entity.component, nodeID, entity.key)
+  return m.publish(topic, payload)
+}
+
+// publish a retained message, a failed connection is dropped so the next
+// call dials again
+func (m *MQTTSink) publish(topic string, payload []byte) error {
+  err := m.client.Publish(mqtt.Message{Topic: topic, Payload: payload, Retain: true})
+  if err != nil {
+    m.client.Close()
+    m.client = nil
+  }
+  return err
+}
+
+func (m *MQTTSink) statusTopic() string {
+  return m.TopicPrefix + "/status"
+}
+
+func formatMQTTFloat(v float64) string {
+  return strconv.FormatFloat(v, 'f', -1, 64)
+}
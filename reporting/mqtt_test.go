@@ -0,0 +1,153 @@
+package reporting
+
+import (
+  "bufio"
+  "io"
+  "net"
+  "sync"
+  "testing"
+  "time"
+  "github.com/NeilBetham/elements/config"
+  "github.com/NeilBetham/elements/protocol"
+)
+
+// mqttBroker a fake broker that accepts every CONNECT when answer is set and
+// records what's published to it
+type mqttBroker struct {
+  l net.Listener
+  answer bool
+
+  mu sync.Mutex
+  published map[string]string
+}
+
+func newMQTTBroker(t *testing.T, answer bool) (b *mqttBroker) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  b = &mqttBroker{l: l, answer: answer, published: make(map[string]string)}
+  go b.serve()
+  return
+}
+
+func (b *mqttBroker) serve() {
+  for {
+    conn, err := b.l.Accept()
+    if err != nil {
+      return
+    }
+    go b.handle(conn)
+  }
+}
+
+func (b *mqttBroker) handle(conn net.Conn) {
+  defer conn.Close()
+  r := bufio.NewReader(conn)
+  for {
+    header, err := r.ReadByte()
+    if err != nil {
+      return
+    }
+    length := 0
+    for shift := uint(0); ; shift += 7 {
+      c, err := r.ReadByte()
+      if err != nil {
+        return
+      }
+      length |= int(c & 0x7f) << shift
+      if c & 0x80 == 0 {
+        break
+      }
+    }
+    body := make([]byte, length)
+    if _, err := io.ReadFull(r, body); err != nil {
+      return
+    }
+
+    switch header & 0xf0 {
+    case 0x10:
+      if !b.answer {
+        // Hang like a broker that's stuck
+        select {}
+      }
+      conn.Write([]byte{0x20, 2, 0, 0})
+    case 0x30:
+      topicLength := int(body[0]) << 8 | int(body[1])
+      b.mu.Lock()
+      b.published[string(body[2:2 + topicLength])] = string(body[2 + topicLength:])
+      b.mu.Unlock()
+    }
+  }
+}
+
+func (b *mqttBroker) get(topic string) (payload string, ok bool) {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  payload, ok = b.published[topic]
+  return
+}
+
+func temperature(value float64) protocol.Reading {
+  return protocol.Reading{StationID: 1, Sensor: protocol.Temperature, Value: value, WindSpeed: 3, WindDir: 90, Valid: true}
+}
+
+func TestMQTTPublish(t *testing.T) {
+  b := newMQTTBroker(t, true)
+  defer b.l.Close()
+  m, err := NewMQTTSink(config.SinkConfig{Name: "mqtt", Url: b.l.Addr().String()})
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer m.Close()
+
+  // The first reading starts connecting and doesn't wait for it
+  if err := m.ReportReading(temperature(72.5)); err != errMQTTConnecting {
+    t.Errorf("first reading gave %v", err)
+  }
+  waitFor(t, "the status", func() bool {
+    status, ok := b.get("elements/status")
+    return ok && status == mqttOnline
+  })
+
+  if err := m.ReportReading(temperature(72.5)); err != nil {
+    t.Fatal(err)
+  }
+  waitFor(t, "the temperature", func() bool {
+    value, ok := b.get("elements/1/temperature")
+    return ok && value == "72.5"
+  })
+  for _, topic := range []string{
+    "homeassistant/sensor/elements_1/temperature/config",
+    "elements/1/wind_speed",
+    "elements/1/wind_direction",
+    "elements/1/battery_low",
+  } {
+    if _, ok := b.get(topic); !ok {
+      t.Errorf("nothing published to %s", topic)
+    }
+  }
+}
+
+func TestMQTTBrokerHangs(t *testing.T) {
+  b := newMQTTBroker(t, false)
+  defer b.l.Close()
+  m, err := NewMQTTSink(config.SinkConfig{Name: "mqtt", Url: b.l.Addr().String()})
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  start := time.Now()
+  for i := 0; i < 10; i++ {
+    if err := m.ReportReading(temperature(float64(i))); err != errMQTTConnecting {
+      t.Errorf("reading %d gave %v", i, err)
+    }
+    if err := m.ReportSync(true); err != nil {
+      t.Errorf("sync gave %v", err)
+    }
+  }
+  if elapsed := time.Since(start); elapsed > time.Second {
+    t.Errorf("reporting to a stuck broker took %s", elapsed)
+  }
+  m.Close()
+}
@@ -0,0 +1,640 @@
+package reporting
+
+import (
+  "bufio"
+  "bytes"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "log"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+  "github.com/NeilBetham/elements/atomicfile"
+  "github.com/NeilBetham/elements/config"
+  "github.com/NeilBetham/elements/protocol"
+)
+
+// Outbox defaults, a reading is around 300 bytes so the disk limit holds a
+// couple of weeks of readings from one ISS
+const (
+  defaultOutboxMaxBytes = 64 << 20
+  defaultOutboxMinBackoff = 5 * time.Second
+  defaultOutboxMaxBackoff = 10 * time.Minute
+
+  // Segments are capped at a fraction of the disk limit so dropping the
+  // oldest one when full doesn't throw away too much at once
+  outboxSegmentsPerLimit = 16
+  minOutboxSegmentBytes = 4 << 10
+
+  // Most readings sent at once to a sink that takes batches
+  outboxBatchReadings = 100
+)
+
+// PermanentError a report the sink refused outright, sending it again won't
+// help so it isn't queued
+type PermanentError struct {
+  Err error
+}
+
+func (e *PermanentError) Error() string {
+  return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+  return e.Err
+}
+
+// IsPermanent whether err is a refusal that retrying won't fix
+func IsPermanent(err error) bool {
+  var pe *PermanentError
+  return errors.As(err, &pe)
+}
+
+// Outbox sits in front of a sink and queues the readings it fails to take in
+// files on disk, they're retried with exponential backoff until the sink
+// takes them. Readings keep the time they were received and the queue
+// survives restarts. Delivery is at least once, a reading sent just before
+// the process dies can be sent again.
+type Outbox struct {
+  sink Sink
+  queue *diskQueue
+  minBackoff time.Duration
+  maxBackoff time.Duration
+
+  // Attempts in a row the oldest segment couldn't be read, only touched by
+  // drain
+  readFailures int
+
+  wake chan struct{}
+  stop chan struct{}
+  done chan struct{}
+}
+
+var _ HealthSink = (*Outbox)(nil)
+var _ SyncSink = (*Outbox)(nil)
+
+// NewOutbox wraps sink with the queue configured in c, anything left queued
+// by a previous run starts draining straight away
+func NewOutbox(sink Sink, c config.OutboxConfig) (o *Outbox, err error) {
+  if c.MaxBytes <= 0 {
+    c.MaxBytes = defaultOutboxMaxBytes
+  }
+  if c.MinBackoff <= 0 {
+    c.MinBackoff = defaultOutboxMinBackoff
+  }
+  if c.MaxBackoff < c.MinBackoff {
+    c.MaxBackoff = defaultOutboxMaxBackoff
+    if c.MaxBackoff < c.MinBackoff {
+      c.MaxBackoff = c.MinBackoff
+    }
+  }
+
+  queue, err := openDiskQueue(c.Path, c.MaxBytes)
+  if err != nil {
+    return nil, fmt.Errorf("sink %s outbox: %s", sink.Name(), err)
+  }
+  if n := queue.len(); n > 0 {
+    log.Printf("Outbox for %s has %d readings queued from a previous run", sink.Name(), n)
+  }
+
+  o = &Outbox{
+    sink: sink,
+    queue: queue,
+    minBackoff: c.MinBackoff,
+    maxBackoff: c.MaxBackoff,
+    wake: make(chan struct{}, 1),
+    stop: make(chan struct{}),
+    done: make(chan struct{}),
+  }
+  // Readings a batching sink took but then failed to send are queued like
+  // any other failure
+  if as, ok := sink.(AsyncSink); ok {
+    as.OnFailure(o.requeue)
+  }
+  go o.drain()
+  return
+}
+
+func (o *Outbox) Name() string {
+  return o.sink.Name()
+}
+
+// Queued the number of readings waiting to be sent
+func (o *Outbox) Queued() int {
+  return o.queue.len()
+}
+
+// ReportReading sends a reading straight to the sink, it's queued instead if
+// the sink fails or older readings are still waiting so they go in order
+func (o *Outbox) ReportReading(r protocol.Reading) error {
+  if o.queue.len() == 0 {
+    err := o.sink.ReportReading(r)
+    if err == nil || IsPermanent(err) {
+      return err
+    }
+    log.Printf("Error reporting reading to %s, queueing: %s", o.sink.Name(), err)
+  }
+
+  if err := o.queue.push(r); err != nil {
+    return fmt.Errorf("queueing reading: %s", err)
+  }
+  o.poke()
+  return nil
+}
+
+// requeue queues a reading the sink took but failed to send later
+func (o *Outbox) requeue(r protocol.Reading, err error) {
+  if IsPermanent(err) {
+    log.Printf("Dropping %s reading refused by %s: %s", r.SensorName, o.sink.Name(), err)
+    return
+  }
+  log.Printf("Error reporting reading to %s, queueing: %s", o.sink.Name(), err)
+  if err := o.queue.push(r); err != nil {
+    log.Printf("Error queueing reading for %s, dropping it: %s", o.sink.Name(), err)
+    return
+  }
+  o.poke()
+}
+
+// ReportHealth passes health straight through, it's only worth having when
+// it's current so it isn't queued
+func (o *Outbox) ReportHealth(h HealthReport) error {
+  hs, ok := o.sink.(HealthSink)
+  if !ok {
+    return nil
+  }
+  return hs.ReportHealth(h)
+}
+
+// ReportSync passes sync changes straight through
+func (o *Outbox) ReportSync(inSync bool) error {
+  ss, ok := o.sink.(SyncSink)
+  if !ok {
+    return nil
+  }
+  return ss.ReportSync(inSync)
+}
+
+// Close stops draining, anything still queued is sent on the next run. The
+// sink is closed before the queue so readings it fails to flush are kept.
+func (o *Outbox) Close() (err error) {
+  close(o.stop)
+  <-o.done
+  if c, ok := o.sink.(io.Closer); ok {
+    err = c.Close()
+  }
+  if closeErr := o.queue.close(); err == nil {
+    err = closeErr
+  }
+  return
+}
+
+func (o *Outbox) poke() {
+  select {
+  case o.wake <- struct{}{}:
+  default:
+  }
+}
+
+// drain sends queued readings oldest first, backing off while the sink is
+// failing
+func (o *Outbox) drain() {
+  defer close(o.done)
+
+  var backoff time.Duration
+  for {
+    var retry <-chan time.Time
+    if backoff > 0 {
+      retry = time.After(backoff)
+    } else if o.queue.len() > 0 {
+      retry = time.After(0)
+    }
+
+    select {
+    case <-o.stop:
+      return
+    case <-o.wake:
+      // Keep waiting out the backoff, new readings don't mean the sink is
+      // back
+      if backoff > 0 {
+        continue
+      }
+    case <-retry:
+    }
+
+    err := o.sendOldest()
+    if err == nil {
+      backoff = 0
+      continue
+    }
+
+    backoff *= 2
+    if backoff < o.minBackoff {
+      backoff = o.minBackoff
+    }
+    if backoff > o.maxBackoff {
+      backoff = o.maxBackoff
+    }
+    log.Printf("Error draining outbox for %s, %d queued, retrying in %s: %s", o.sink.Name(), o.queue.len(), backoff, err)
+  }
+}
+
+// sendOldest sends the oldest segment, whatever isn't sent stays queued. A
+// segment that can't be read is set aside after maxReadFailures attempts so
+// it doesn't hold up everything queued behind it.
+func (o *Outbox) sendOldest() (err error) {
+  seg, queued, err := o.queue.take()
+  if err != nil {
+    o.readFailures++
+    if o.readFailures < maxReadFailures {
+      return fmt.Errorf("reading outbox segment: %s", err)
+    }
+    o.readFailures = 0
+    dropped, dropErr := o.queue.dropOldest()
+    if dropErr != nil {
+      return fmt.Errorf("setting aside unreadable outbox segment: %s", dropErr)
+    }
+    log.Printf("Outbox segment for %s still unreadable, set aside with %d readings: %s", o.sink.Name(), dropped, err)
+    return nil
+  }
+  o.readFailures = 0
+  if seg == nil {
+    return
+  }
+
+  // Sinks that take batches get the segment a batch at a time
+  chunkSize := 1
+  if _, ok := o.sink.(BatchSink); ok {
+    chunkSize = outboxBatchReadings
+  }
+
+  // Lines of the segment that are done with, -1 once they all are
+  done := 0
+  for start := 0; start < len(queued) && err == nil; start += chunkSize {
+    select {
+    case <-o.stop:
+      return o.queue.ack(seg, done)
+    default:
+    }
+
+    end := start + chunkSize
+    if end > len(queued) {
+      end = len(queued)
+    }
+    chunk := queued[start:end]
+    errs := o.send(chunk)
+    for i, q := range chunk {
+      if errs[i] != nil && !IsPermanent(errs[i]) {
+        err = errs[i]
+        break
+      }
+      if errs[i] != nil {
+        log.Printf("Dropping queued reading for %s: %s", o.sink.Name(), errs[i])
+      }
+      done = q.line
+    }
+  }
+  if err == nil {
+    done = -1
+  }
+
+  if ackErr := o.queue.ack(seg, done); ackErr != nil && err == nil {
+    err = ackErr
+  }
+  return
+}
+
+// send queued readings to the sink, in one go if it takes batches
+func (o *Outbox) send(queued []queuedReading) []error {
+  bs, ok := o.sink.(BatchSink)
+  if !ok {
+    errs := make([]error, len(queued))
+    for i, q := range queued {
+      errs[i] = o.sink.ReportReading(q.Reading)
+    }
+    return errs
+  }
+
+  rs := make([]protocol.Reading, len(queued))
+  for i, q := range queued {
+    rs[i] = q.Reading
+  }
+  return bs.ReportReadings(rs)
+}
+
+// diskQueue readings in numbered segment files of one JSON reading per line.
+// New readings are appended to the newest segment, the oldest is taken whole
+// for sending and removed or rewritten with whatever wasn't sent.
+type diskQueue struct {
+  mu sync.Mutex
+  dir string
+  maxBytes int64
+  segmentBytes int64
+
+  // Oldest first, the last is appended to while active is open
+  segments []*segment
+  active *os.File
+  nextSeq int64
+  size int64
+  count int
+}
+
+type segment struct {
+  seq int64
+  path string
+  size int64
+  count int
+  // Taken for sending, it's left alone until it's acked
+  sending bool
+}
+
+// queuedReading a reading read back from a segment and the line it was on,
+// counting from 1
+type queuedReading struct {
+  protocol.Reading
+  line int
+}
+
+const segmentSuffix = ".jsonl"
+
+func openDiskQueue(dir string, maxBytes int64) (q *diskQueue, err error) {
+  if dir == "" {
+    return nil, errors.New("no path set")
+  }
+  if err = os.MkdirAll(dir, 0755); err != nil {
+    return
+  }
+
+  q = &diskQueue{dir: dir, maxBytes: maxBytes}
+  q.segmentBytes = maxBytes / outboxSegmentsPerLimit
+  if q.segmentBytes < minOutboxSegmentBytes {
+    q.segmentBytes = minOutboxSegmentBytes
+  }
+
+  entries, err := ioutil.ReadDir(dir)
+  if err != nil {
+    return
+  }
+  for _, e := range entries {
+    name := e.Name()
+    // Left over from a rewrite that never finished, the segment it was
+    // replacing is still intact
+    if strings.HasSuffix(name, ".tmp") {
+      os.Remove(filepath.Join(dir, name))
+      continue
+    }
+    if !strings.HasSuffix(name, segmentSuffix) {
+      continue
+    }
+    seq, parseErr := strconv.ParseInt(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+    if parseErr != nil {
+      continue
+    }
+
+    seg := &segment{seq: seq, path: filepath.Join(dir, name), size: e.Size()}
+    data, readErr := ioutil.ReadFile(seg.path)
+    if readErr != nil {
+      return nil, readErr
+    }
+    seg.count = bytes.Count(data, []byte("\n"))
+    q.segments = append(q.segments, seg)
+    q.size += seg.size
+    q.count += seg.count
+  }
+
+  sort.Slice(q.segments, func(i, j int) bool {
+    return q.segments[i].seq < q.segments[j].seq
+  })
+  if len(q.segments) > 0 {
+    q.nextSeq = q.segments[len(q.segments) - 1].seq + 1
+  }
+  return
+}
+
+func (q *diskQueue) len() int {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  return q.count
+}
+
+// push appends a reading and syncs it to disk, the oldest segments are
+// dropped if that takes the queue over its limit
+func (q *diskQueue) push(r protocol.Reading) error {
+  line, err := json.Marshal(r)
+  if err != nil {
+    return err
+  }
+  line = append(line, '\n')
+
+  q.mu.Lock()
+  defer q.mu.Unlock()
+
+  if q.active != nil && q.last().size >= q.segmentBytes {
+    q.seal()
+  }
+  if q.active == nil {
+    seg := &segment{seq: q.nextSeq}
+    seg.path = filepath.Join(q.dir, fmt.Sprintf("%016d%s", seg.seq, segmentSuffix))
+    q.active, err = os.OpenFile(seg.path, os.O_CREATE | os.O_EXCL | os.O_WRONLY | os.O_APPEND, 0644)
+    if err != nil {
+      return err
+    }
+    q.nextSeq++
+    q.segments = append(q.segments, seg)
+  }
+
+  if _, err = q.active.Write(line); err != nil {
+    return err
+  }
+  if err = q.active.Sync(); err != nil {
+    return err
+  }
+
+  seg := q.last()
+  seg.size += int64(len(line))
+  seg.count++
+  q.size += int64(len(line))
+  q.count++
+
+  q.trim()
+  return nil
+}
+
+// trim drops the oldest segments until the queue fits in its limit, the
+// segment being sent and the one being appended to are kept
+func (q *diskQueue) trim() {
+  for i := 0; q.size > q.maxBytes && i < len(q.segments); {
+    seg := q.segments[i]
+    if seg.sending || (q.active != nil && seg == q.last()) {
+      i++
+      continue
+    }
+
+    if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+      log.Printf("Error dropping outbox segment %s: %s", seg.path, err)
+      i++
+      continue
+    }
+    log.Printf("Outbox %s is full, dropped %d oldest readings", q.dir, seg.count)
+    q.size -= seg.size
+    q.count -= seg.count
+    q.segments = append(q.segments[:i], q.segments[i + 1:]...)
+  }
+}
+
+// take the oldest segment and its readings for sending, nil if the queue is
+// empty. Lines that don't decode, say from losing power part way through a
+// write, are skipped.
+func (q *diskQueue) take() (seg *segment, queued []queuedReading, err error) {
+  q.mu.Lock()
+  if len(q.segments) == 0 || q.segments[0].sending {
+    q.mu.Unlock()
+    return
+  }
+  seg = q.segments[0]
+  if q.active != nil && seg == q.last() {
+    q.seal()
+  }
+  seg.sending = true
+  q.mu.Unlock()
+
+  f, err := os.Open(seg.path)
+  if os.IsNotExist(err) {
+    // Removed from under us, there's nothing left to send from it
+    q.mu.Lock()
+    q.remove(seg)
+    q.mu.Unlock()
+  }
+  if err != nil {
+    q.release(seg)
+    return nil, nil, err
+  }
+  defer f.Close()
+
+  scanner := bufio.NewScanner(f)
+  scanner.Buffer(nil, 1 << 20)
+  for line := 1; scanner.Scan(); line++ {
+    var r protocol.Reading
+    if jsonErr := json.Unmarshal(scanner.Bytes(), &r); jsonErr != nil {
+      log.Printf("Skipping corrupt reading on line %d of outbox segment %s: %s", line, seg.path, jsonErr)
+      continue
+    }
+    queued = append(queued, queuedReading{r, line})
+  }
+  if err = scanner.Err(); err != nil {
+    q.release(seg)
+    return nil, nil, err
+  }
+  return
+}
+
+// ack records that the first lines of a taken segment were sent, the
+// segment is removed if all of them were or rewritten with the rest if not
+func (q *diskQueue) ack(seg *segment, lines int) (err error) {
+  var rest []byte
+  if lines > 0 {
+    data, readErr := ioutil.ReadFile(seg.path)
+    if readErr != nil {
+      q.release(seg)
+      return readErr
+    }
+    rest = data
+    for i := 0; i < lines && len(rest) > 0; i++ {
+      end := bytes.IndexByte(rest, '\n')
+      if end < 0 {
+        rest = rest[:0]
+        break
+      }
+      rest = rest[end + 1:]
+    }
+  }
+
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  seg.sending = false
+
+  switch {
+  case lines == 0:
+    return
+  case lines < 0 || len(bytes.TrimSpace(rest)) == 0:
+    err = os.Remove(seg.path)
+    q.remove(seg)
+    return
+  }
+
+  if err = atomicfile.Write(seg.path, rest); err != nil {
+    return
+  }
+  count := bytes.Count(rest, []byte("\n"))
+  q.size -= seg.size - int64(len(rest))
+  q.count -= seg.count - count
+  seg.size = int64(len(rest))
+  seg.count = count
+  return
+}
+
+// dropOldest sets the oldest segment aside unsent, renamed so it's kept for
+// a look but not read again. It returns the readings that were in it.
+func (q *diskQueue) dropOldest() (count int, err error) {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  if len(q.segments) == 0 || q.segments[0].sending {
+    return
+  }
+  seg := q.segments[0]
+  if q.active != nil && seg == q.last() {
+    q.seal()
+  }
+  if err = os.Rename(seg.path, seg.path + ".bad"); err != nil && !os.IsNotExist(err) {
+    return
+  }
+  q.remove(seg)
+  return seg.count, nil
+}
+
+func (q *diskQueue) release(seg *segment) {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  seg.sending = false
+}
+
+func (q *diskQueue) remove(seg *segment) {
+  for i, s := range q.segments {
+    if s == seg {
+      q.segments = append(q.segments[:i], q.segments[i + 1:]...)
+      q.size -= seg.size
+      q.count -= seg.count
+      return
+    }
+  }
+}
+
+func (q *diskQueue) last() *segment {
+  return q.segments[len(q.segments) - 1]
+}
+
+// seal closes the segment being appended to, the next push starts another
+func (q *diskQueue) seal() {
+  if err := q.active.Close(); err != nil {
+    log.Printf("Error closing outbox segment: %s", err)
+  }
+  q.active = nil
+}
+
+func (q *diskQueue) close() error {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  if q.active == nil {
+    return nil
+  }
+  err := q.active.Close()
+  q.active = nil
+  return err
+}
@@ -0,0 +1,308 @@
+package reporting
+
+import (
+  "bytes"
+  "errors"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sync"
+  "testing"
+  "time"
+  "github.com/NeilBetham/elements/config"
+  "github.com/NeilBetham/elements/protocol"
+)
+
+// fakeSink records what it's sent and fails while down is set
+type fakeSink struct {
+  mu sync.Mutex
+  down bool
+  attempts []time.Time
+  received []protocol.Reading
+}
+
+func (s *fakeSink) Name() string {
+  return "fake"
+}
+
+func (s *fakeSink) ReportReading(r protocol.Reading) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.attempts = append(s.attempts, time.Now())
+  if s.down {
+    return errors.New("sink down")
+  }
+  s.received = append(s.received, r)
+  return nil
+}
+
+func (s *fakeSink) setDown(down bool) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.down = down
+}
+
+func numbered(n int) protocol.Reading {
+  return protocol.Reading{StationID: 1, Sensor: protocol.Temperature, SensorName: "Temperature", Value: float64(n), Valid: true}
+}
+
+func tempDir(t *testing.T) string {
+  dir, err := ioutil.TempDir("", "outbox")
+  if err != nil {
+    t.Fatal(err)
+  }
+  return dir
+}
+
+// waitFor polls until cond holds or a few seconds pass
+func waitFor(t *testing.T, what string, cond func() bool) {
+  deadline := time.Now().Add(5 * time.Second)
+  for !cond() {
+    if time.Now().After(deadline) {
+      t.Fatalf("timed out waiting for %s", what)
+    }
+    time.Sleep(5 * time.Millisecond)
+  }
+}
+
+func TestOutboxReplayOrder(t *testing.T) {
+  dir := tempDir(t)
+  defer os.RemoveAll(dir)
+  // Small enough that the readings span several segments
+  c := config.OutboxConfig{Path: dir, MaxBytes: 64 << 10, MinBackoff: time.Hour}
+
+  down := &fakeSink{down: true}
+  o, err := NewOutbox(down, c)
+  if err != nil {
+    t.Fatal(err)
+  }
+  for i := 0; i < 50; i++ {
+    if err := o.ReportReading(numbered(i)); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if o.Queued() != 50 {
+    t.Fatalf("%d queued, want 50", o.Queued())
+  }
+  if err := o.Close(); err != nil {
+    t.Fatal(err)
+  }
+  if segments, _ := ioutil.ReadDir(dir); len(segments) < 2 {
+    t.Fatalf("queue only used %d segments", len(segments))
+  }
+
+  // After a restart the queue drains oldest first, and new readings wait
+  // behind it
+  up := &fakeSink{}
+  o, err = NewOutbox(up, c)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer o.Close()
+  for i := 50; i < 60; i++ {
+    if err := o.ReportReading(numbered(i)); err != nil {
+      t.Fatal(err)
+    }
+  }
+  waitFor(t, "the outbox to drain", func() bool { return o.Queued() == 0 })
+
+  up.mu.Lock()
+  defer up.mu.Unlock()
+  if len(up.received) != 60 {
+    t.Fatalf("sink got %d readings, want 60", len(up.received))
+  }
+  for i, r := range up.received {
+    if int(r.Value) != i {
+      t.Fatalf("reading %d was %v, out of order", i, r.Value)
+    }
+  }
+}
+
+func TestDiskQueueMaxBytes(t *testing.T) {
+  dir := tempDir(t)
+  defer os.RemoveAll(dir)
+
+  const maxBytes = 16 << 10
+  q, err := openDiskQueue(dir, maxBytes)
+  if err != nil {
+    t.Fatal(err)
+  }
+  for i := 0; i < 300; i++ {
+    if err := q.push(numbered(i)); err != nil {
+      t.Fatal(err)
+    }
+    if q.size > maxBytes {
+      t.Fatalf("queue is %d bytes after %d readings, limit %d", q.size, i + 1, maxBytes)
+    }
+  }
+  if err := q.close(); err != nil {
+    t.Fatal(err)
+  }
+  if q.count == 0 || q.count >= 300 {
+    t.Fatalf("%d readings kept", q.count)
+  }
+
+  // The oldest were dropped, what's left is the newest in order and a
+  // reopened queue agrees
+  reopened, err := openDiskQueue(dir, maxBytes)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if reopened.len() != q.count || reopened.size != q.size {
+    t.Errorf("reopened queue has %d readings in %d bytes, want %d in %d", reopened.len(), reopened.size, q.count, q.size)
+  }
+  next := 300 - q.count
+  for reopened.len() > 0 {
+    seg, queued, err := reopened.take()
+    if err != nil {
+      t.Fatal(err)
+    }
+    for _, r := range queued {
+      if int(r.Value) != next {
+        t.Fatalf("got reading %v, want %d", r.Value, next)
+      }
+      next++
+    }
+    if err := reopened.ack(seg, -1); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if next != 300 {
+    t.Errorf("queue ended at reading %d, want 300", next)
+  }
+}
+
+func TestOutboxBackoff(t *testing.T) {
+  dir := tempDir(t)
+  defer os.RemoveAll(dir)
+
+  const minBackoff, maxBackoff = 20 * time.Millisecond, 80 * time.Millisecond
+  sink := &fakeSink{down: true}
+  o, err := NewOutbox(sink, config.OutboxConfig{Path: dir, MinBackoff: minBackoff, MaxBackoff: maxBackoff})
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer o.Close()
+
+  if err := o.ReportReading(numbered(0)); err != nil {
+    t.Fatal(err)
+  }
+  // The direct attempt, then one from the drain straight away and five
+  // retries
+  waitFor(t, "retries", func() bool {
+    sink.mu.Lock()
+    defer sink.mu.Unlock()
+    return len(sink.attempts) >= 7
+  })
+  sink.setDown(false)
+  waitFor(t, "the outbox to drain", func() bool { return o.Queued() == 0 })
+
+  sink.mu.Lock()
+  defer sink.mu.Unlock()
+  want := []time.Duration{minBackoff, 2 * minBackoff, maxBackoff, maxBackoff, maxBackoff}
+  for i, w := range want {
+    gap := sink.attempts[i + 2].Sub(sink.attempts[i + 1])
+    if gap < w || gap > w + 2 * maxBackoff {
+      t.Errorf("retry %d came after %s, want %s", i + 1, gap, w)
+    }
+  }
+  if len(sink.received) != 1 {
+    t.Errorf("sink got %d readings once it was back, want 1", len(sink.received))
+  }
+}
+
+// asyncSink batches readings like the station API sink does
+type asyncSink struct {
+  fakeSink
+  batcher *batcher
+}
+
+func (s *asyncSink) ReportReading(r protocol.Reading) error {
+  s.batcher.add(r)
+  return nil
+}
+
+func (s *asyncSink) ReportReadings(rs []protocol.Reading) []error {
+  errs := make([]error, len(rs))
+  for i, r := range rs {
+    errs[i] = s.fakeSink.ReportReading(r)
+  }
+  return errs
+}
+
+func (s *asyncSink) OnFailure(fn func(r protocol.Reading, err error)) {
+  s.batcher.onFailure(fn)
+}
+
+func (s *asyncSink) Close() error {
+  s.batcher.close()
+  return nil
+}
+
+func TestOutboxQueuesBatchFailures(t *testing.T) {
+  dir := tempDir(t)
+  defer os.RemoveAll(dir)
+
+  sink := &asyncSink{fakeSink: fakeSink{down: true}}
+  sink.batcher = newBatcher("async", sink.ReportReadings, 5, time.Hour)
+  o, err := NewOutbox(sink, config.OutboxConfig{Path: dir, MinBackoff: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer o.Close()
+
+  for i := 0; i < 5; i++ {
+    if err := o.ReportReading(numbered(i)); err != nil {
+      t.Fatal(err)
+    }
+  }
+  waitFor(t, "failed batch to be queued", func() bool { return o.Queued() == 5 })
+
+  sink.setDown(false)
+  waitFor(t, "the outbox to drain", func() bool { return o.Queued() == 0 })
+  sink.mu.Lock()
+  defer sink.mu.Unlock()
+  if len(sink.received) != 5 {
+    t.Errorf("sink got %d readings, want 5", len(sink.received))
+  }
+}
+
+func TestOutboxUnreadableSegment(t *testing.T) {
+  dir := tempDir(t)
+  defer os.RemoveAll(dir)
+
+  // A line too long to read back followed by a good segment
+  junk := append(bytes.Repeat([]byte("x"), 2 << 20), '\n')
+  if err := ioutil.WriteFile(filepath.Join(dir, "0000000000000000.jsonl"), junk, 0644); err != nil {
+    t.Fatal(err)
+  }
+  q, err := openDiskQueue(dir, 64 << 20)
+  if err != nil {
+    t.Fatal(err)
+  }
+  for i := 0; i < 3; i++ {
+    if err := q.push(numbered(i)); err != nil {
+      t.Fatal(err)
+    }
+  }
+  q.close()
+
+  sink := &fakeSink{}
+  o, err := NewOutbox(sink, config.OutboxConfig{Path: dir, MinBackoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond})
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer o.Close()
+
+  waitFor(t, "the readings behind the bad segment", func() bool {
+    sink.mu.Lock()
+    defer sink.mu.Unlock()
+    return len(sink.received) == 3
+  })
+  if _, err := os.Stat(filepath.Join(dir, "0000000000000000.jsonl.bad")); err != nil {
+    t.Errorf("bad segment wasn't set aside: %s", err)
+  }
+  if n := o.Queued(); n != 0 {
+    t.Errorf("%d readings still queued", n)
+  }
+}
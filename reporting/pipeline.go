@@ -0,0 +1,394 @@
+package reporting
+
+import (
+  "fmt"
+  "log"
+  "path/filepath"
+  "sync"
+  "time"
+  "github.com/NeilBetham/elements/config"
+  "github.com/NeilBetham/elements/protocol"
+)
+
+// Waits between attempts to read back a spill segment that failed, doubling
+// from the shortest. After maxReadFailures in a row the segment is set aside
+// so the readings behind it aren't stuck forever.
+var (
+  minSpillRetry = time.Second
+  maxSpillRetry = time.Minute
+)
+
+// Failed attempts in a row to read back the oldest spill or outbox segment
+// before it's set aside
+const maxReadFailures = 5
+
+// Time Close gives the workers to report what's waiting in memory, whatever
+// is left after that is spilled or dropped
+var pipelineCloseTimeout = 10 * time.Second
+
+// Overflow what a pipeline does with a reading when its queue is full
+type Overflow int
+
+const (
+  // Throw away the oldest waiting reading to make room
+  DropOldest Overflow = iota
+  // Wait for room, holding up whoever is submitting
+  Block
+  // Queue on disk until the workers catch up
+  Spill
+)
+
+// ParseOverflow reads an overflow policy as written in the config
+func ParseOverflow(s string) (Overflow, error) {
+  switch s {
+  case "", "drop_oldest":
+    return DropOldest, nil
+  case "block":
+    return Block, nil
+  case "spill":
+    return Spill, nil
+  default:
+    return DropOldest, fmt.Errorf("unknown reporting overflow %q, expected drop_oldest, block or spill", s)
+  }
+}
+
+func (o Overflow) String() string {
+  switch o {
+  case DropOldest:
+    return "drop_oldest"
+  case Block:
+    return "block"
+  case Spill:
+    return "spill"
+  default:
+    return fmt.Sprintf("Overflow(%d)", int(o))
+  }
+}
+
+// PipelineStats queue metrics for a pipeline
+type PipelineStats struct {
+  Workers int `json:"workers"`
+  Capacity int `json:"capacity"`
+  // Readings waiting in memory and on disk right now
+  Depth int `json:"depth"`
+  Spilled int `json:"spilled"`
+  // Most readings that have been waiting in memory at once
+  HighWater int `json:"high_water"`
+
+  Submitted int `json:"submitted"`
+  Reported int `json:"reported"`
+  Dropped int `json:"dropped"`
+}
+
+func (s PipelineStats) String() string {
+  return fmt.Sprintf(
+    "Queued: %d/%d, spilled: %d, high water: %d, submitted: %d, reported: %d, dropped: %d",
+    s.Depth,
+    s.Capacity,
+    s.Spilled,
+    s.HighWater,
+    s.Submitted,
+    s.Reported,
+    s.Dropped,
+  )
+}
+
+// Pipeline queues readings for a fixed number of workers that pass them to
+// the dispatcher. Readings from the same sensor always go to the same worker
+// so they're reported in the order they arrived.
+type Pipeline struct {
+  dispatcher Dispatcher
+  overflow Overflow
+  shards []*shard
+  wg sync.WaitGroup
+
+  mu sync.Mutex
+  stats PipelineStats
+}
+
+// shard the queue for one worker
+type shard struct {
+  mu sync.Mutex
+  // Signalled when a reading is queued or taken and on close
+  cond *sync.Cond
+  items []protocol.Reading
+  capacity int
+  spill *diskQueue
+  // Closed shards take no more readings but their workers report what's
+  // already waiting in memory, stopped ones report nothing more
+  closed bool
+  stopped bool
+  // Reading the spill back failed this many times in a row, it isn't tried
+  // again until retryAt
+  failures int
+  retryAt time.Time
+}
+
+// NewPipeline starts the workers configured under reporting, readings
+// spilled to disk by a previous run are reported first
+func NewPipeline(d Dispatcher, c config.Config) (p *Pipeline, err error) {
+  cfg := c.Reporting
+  overflow, err := ParseOverflow(cfg.Overflow)
+  if err != nil {
+    return
+  }
+  workers := cfg.Workers
+  if workers < 1 {
+    workers = 1
+  }
+  perWorker := cfg.QueueSize / workers
+  if perWorker < 1 {
+    perWorker = 1
+  }
+
+  p = &Pipeline{dispatcher: d, overflow: overflow}
+  p.stats.Workers = workers
+  p.stats.Capacity = perWorker * workers
+  for i := 0; i < workers; i++ {
+    s := &shard{capacity: perWorker}
+    s.cond = sync.NewCond(&s.mu)
+    if overflow == Spill {
+      maxBytes := cfg.SpillMaxBytes
+      if maxBytes <= 0 {
+        maxBytes = defaultOutboxMaxBytes
+      }
+      dir := filepath.Join(cfg.SpillPath, fmt.Sprintf("worker-%d", i))
+      if s.spill, err = openDiskQueue(dir, maxBytes / int64(workers)); err != nil {
+        return nil, fmt.Errorf("reporting spill: %s", err)
+      }
+    }
+    p.shards = append(p.shards, s)
+  }
+
+  for _, s := range p.shards {
+    p.wg.Add(1)
+    go p.work(s)
+  }
+  return
+}
+
+// Submit queues a reading for reporting, what happens when the queue is full
+// depends on the overflow policy
+func (p *Pipeline) Submit(r protocol.Reading) {
+  s := p.shards[(r.StationID * 256 + int(r.Sensor)) % len(p.shards)]
+
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  defer s.cond.Broadcast()
+
+  p.count(func(st *PipelineStats) { st.Submitted++ })
+
+  // Once anything is on disk the rest has to follow it to keep the order
+  if s.spill != nil && s.spill.len() > 0 {
+    p.spill(s, r)
+    return
+  }
+
+  for len(s.items) >= s.capacity && !s.closed {
+    switch p.overflow {
+    case Block:
+      s.cond.Wait()
+    case Spill:
+      p.spill(s, r)
+      return
+    default:
+      log.Printf("Reporting queue full, dropping %s reading from %s", s.items[0].SensorName, s.items[0].Timestamp)
+      s.items = s.items[1:]
+      p.count(func(st *PipelineStats) {
+        st.Dropped++
+        st.Depth--
+      })
+    }
+  }
+  if s.closed {
+    p.count(func(st *PipelineStats) { st.Dropped++ })
+    return
+  }
+
+  s.items = append(s.items, r)
+  p.count(func(st *PipelineStats) {
+    st.Depth++
+    if st.Depth > st.HighWater {
+      st.HighWater = st.Depth
+    }
+  })
+}
+
+// spill writes a reading to the shard's disk queue, the shard lock must be
+// held
+func (p *Pipeline) spill(s *shard, r protocol.Reading) {
+  if err := s.spill.push(r); err != nil {
+    log.Printf("Error spilling reading to disk, dropping it: %s", err)
+    p.count(func(st *PipelineStats) { st.Dropped++ })
+  }
+}
+
+// Stats a snapshot of the queue metrics
+func (p *Pipeline) Stats() (st PipelineStats) {
+  p.mu.Lock()
+  st = p.stats
+  p.mu.Unlock()
+
+  for _, s := range p.shards {
+    if s.spill != nil {
+      st.Spilled += s.spill.len()
+    }
+  }
+  st.Depth += st.Spilled
+  return
+}
+
+// Close stops taking readings and waits for the workers to report those
+// waiting in memory. Any they don't get to in time are spilled to disk with
+// the spill policy and dropped otherwise, readings already spilled stay there
+// for the next run.
+func (p *Pipeline) Close() {
+  for _, s := range p.shards {
+    s.mu.Lock()
+    s.closed = true
+    s.cond.Broadcast()
+    s.mu.Unlock()
+  }
+
+  done := make(chan struct{})
+  go func() {
+    p.wg.Wait()
+    close(done)
+  }()
+  select {
+  case <-done:
+  case <-time.After(pipelineCloseTimeout):
+    log.Printf("Gave up waiting for reporting workers to catch up")
+  }
+
+  for _, s := range p.shards {
+    s.mu.Lock()
+    s.stopped = true
+    if s.spill != nil {
+      for _, r := range s.items {
+        p.spill(s, r)
+      }
+      if err := s.spill.close(); err != nil {
+        log.Printf("Error closing reporting spill: %s", err)
+      }
+    } else if len(s.items) > 0 {
+      log.Printf("Dropping %d readings waiting to be reported", len(s.items))
+      p.count(func(st *PipelineStats) { st.Dropped += len(s.items) })
+    }
+    p.count(func(st *PipelineStats) { st.Depth -= len(s.items) })
+    s.items = nil
+    s.mu.Unlock()
+  }
+}
+
+func (p *Pipeline) count(fn func(st *PipelineStats)) {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  fn(&p.stats)
+}
+
+// work reports a shard's readings in order, memory first as anything spilled
+// arrived after it. Once closed it carries on until memory is empty.
+func (p *Pipeline) work(s *shard) {
+  defer p.wg.Done()
+
+  for {
+    s.mu.Lock()
+    for len(s.items) == 0 && !s.spillReady() && !s.closed {
+      s.cond.Wait()
+    }
+    if s.stopped || (s.closed && len(s.items) == 0) {
+      s.mu.Unlock()
+      return
+    }
+
+    if len(s.items) > 0 {
+      r := s.items[0]
+      s.items = s.items[1:]
+      s.cond.Broadcast()
+      s.mu.Unlock()
+
+      p.count(func(st *PipelineStats) { st.Depth-- })
+      p.report(r)
+      continue
+    }
+    s.mu.Unlock()
+
+    err := p.reportSpilled(s)
+    s.mu.Lock()
+    if err != nil {
+      p.spillFailed(s, err)
+    } else {
+      s.failures = 0
+    }
+    s.mu.Unlock()
+  }
+}
+
+// spillReady whether there's spilled readings to report now, the lock must
+// be held
+func (s *shard) spillReady() bool {
+  return s.spill != nil && s.spill.len() > 0 && !time.Now().Before(s.retryAt)
+}
+
+// spillFailed backs off reading the spill after a failure, or sets the
+// oldest segment aside once it has failed too often. The lock must be held.
+func (p *Pipeline) spillFailed(s *shard, err error) {
+  s.failures++
+  if s.failures >= maxReadFailures {
+    s.failures = 0
+    dropped, dropErr := s.spill.dropOldest()
+    if dropErr != nil {
+      log.Printf("Error setting aside unreadable reporting spill segment: %s", dropErr)
+    } else {
+      log.Printf("Reporting spill segment still unreadable, set aside with %d readings: %s", dropped, err)
+      p.count(func(st *PipelineStats) { st.Dropped += dropped })
+    }
+    return
+  }
+
+  retry := minSpillRetry << uint(s.failures - 1)
+  if retry > maxSpillRetry {
+    retry = maxSpillRetry
+  }
+  log.Printf("Error reading reporting spill, retrying in %s: %s", retry, err)
+  s.retryAt = time.Now().Add(retry)
+  time.AfterFunc(retry, func() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.cond.Broadcast()
+  })
+}
+
+// reportSpilled reports the oldest segment of a shard's spill
+func (p *Pipeline) reportSpilled(s *shard) (err error) {
+  seg, queued, err := s.spill.take()
+  if err != nil || seg == nil {
+    return
+  }
+
+  done := 0
+  for _, q := range queued {
+    s.mu.Lock()
+    closed := s.closed
+    s.mu.Unlock()
+    if closed {
+      break
+    }
+
+    p.report(q.Reading)
+    done = q.line
+  }
+  if len(queued) == 0 || done == queued[len(queued) - 1].line {
+    done = -1
+  }
+  if err = s.spill.ack(seg, done); err != nil {
+    err = fmt.Errorf("updating spill: %s", err)
+  }
+  return
+}
+
+func (p *Pipeline) report(r protocol.Reading) {
+  p.dispatcher.ReportReading(r)
+  p.count(func(st *PipelineStats) { st.Reported++ })
+}
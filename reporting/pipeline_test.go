@@ -0,0 +1,170 @@
+package reporting
+
+import (
+  "bytes"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+  "github.com/NeilBetham/elements/config"
+)
+
+func TestPipelineUnreadableSpill(t *testing.T) {
+  dir := tempDir(t)
+  defer os.RemoveAll(dir)
+  defer func(min, max time.Duration) {
+    minSpillRetry, maxSpillRetry = min, max
+  }(minSpillRetry, maxSpillRetry)
+  minSpillRetry, maxSpillRetry = time.Millisecond, 4 * time.Millisecond
+
+  // A line too long to read back, as if the file was overwritten with junk,
+  // followed by a good segment
+  worker := filepath.Join(dir, "worker-0")
+  if err := os.MkdirAll(worker, 0755); err != nil {
+    t.Fatal(err)
+  }
+  junk := append(bytes.Repeat([]byte("x"), 2 << 20), '\n')
+  if err := ioutil.WriteFile(filepath.Join(worker, "0000000000000000.jsonl"), junk, 0644); err != nil {
+    t.Fatal(err)
+  }
+  q, err := openDiskQueue(worker, 64 << 20)
+  if err != nil {
+    t.Fatal(err)
+  }
+  for i := 0; i < 3; i++ {
+    if err := q.push(numbered(i)); err != nil {
+      t.Fatal(err)
+    }
+  }
+  q.close()
+
+  sink := &fakeSink{}
+  var c config.Config
+  c.Reporting.Workers = 1
+  c.Reporting.QueueSize = 10
+  c.Reporting.Overflow = "spill"
+  c.Reporting.SpillPath = dir
+  p, err := NewPipeline(newDispatcher([]Sink{sink}, 10, Spill), c)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  waitFor(t, "the readings behind the bad segment", func() bool {
+    sink.mu.Lock()
+    defer sink.mu.Unlock()
+    return len(sink.received) == 3
+  })
+  p.Close()
+
+  if _, err := os.Stat(filepath.Join(worker, "0000000000000000.jsonl.bad")); err != nil {
+    t.Errorf("bad segment wasn't set aside: %s", err)
+  }
+  if st := p.Stats(); st.Dropped != 1 || st.Spilled != 0 {
+    t.Errorf("pipeline stats %+v", st)
+  }
+}
+
+func TestPipelineSpillsForSlowSink(t *testing.T) {
+  dir := tempDir(t)
+  defer os.RemoveAll(dir)
+
+  stuck := &stuckSink{release: make(chan struct{})}
+  var c config.Config
+  c.Reporting.Workers = 1
+  c.Reporting.QueueSize = 2
+  c.Reporting.Overflow = "spill"
+  c.Reporting.SpillPath = dir
+  d := newDispatcher([]Sink{stuck}, 2, Spill)
+  p, err := NewPipeline(d, c)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // The sink's queue and the pipeline fill up, the rest go to disk
+  for i := 0; i < 20; i++ {
+    p.Submit(numbered(i))
+  }
+  if st := p.Stats(); st.Spilled == 0 || st.Dropped != 0 {
+    t.Errorf("pipeline stats while the sink is stuck %+v", st)
+  }
+
+  close(stuck.release)
+  waitFor(t, "every reading", func() bool {
+    stuck.mu.Lock()
+    defer stuck.mu.Unlock()
+    return len(stuck.received) == 20
+  })
+  p.Close()
+  d.Close()
+
+  for i, r := range stuck.received {
+    if r.Value != float64(i) {
+      t.Fatalf("readings out of order %v", stuck.received)
+    }
+  }
+  if st := p.Stats(); st.Dropped != 0 || st.Depth != 0 {
+    t.Errorf("pipeline stats %+v", st)
+  }
+}
+
+func TestPipelineCloseDrains(t *testing.T) {
+  sink := &fakeSink{}
+  var c config.Config
+  c.Reporting.Workers = 2
+  c.Reporting.QueueSize = 100
+  d := newDispatcher([]Sink{sink}, 100, DropOldest)
+  p, err := NewPipeline(d, c)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  for i := 0; i < 50; i++ {
+    p.Submit(numbered(i))
+  }
+  p.Close()
+  d.Close()
+
+  if len(sink.received) != 50 {
+    t.Errorf("sink got %d readings, expected 50", len(sink.received))
+  }
+  if st := p.Stats(); st.Reported != 50 || st.Dropped != 0 || st.Depth != 0 {
+    t.Errorf("pipeline stats %+v", st)
+  }
+}
+
+func TestPipelineCloseSpillsStuck(t *testing.T) {
+  dir := tempDir(t)
+  defer os.RemoveAll(dir)
+  defer func(timeout time.Duration) {
+    pipelineCloseTimeout = timeout
+  }(pipelineCloseTimeout)
+  pipelineCloseTimeout = 50 * time.Millisecond
+
+  stuck := &stuckSink{release: make(chan struct{})}
+  var c config.Config
+  c.Reporting.Workers = 1
+  c.Reporting.QueueSize = 10
+  c.Reporting.Overflow = "spill"
+  c.Reporting.SpillPath = dir
+  d := newDispatcher([]Sink{stuck}, 1, Spill)
+  p, err := NewPipeline(d, c)
+  if err != nil {
+    t.Fatal(err)
+  }
+  for i := 0; i < 5; i++ {
+    p.Submit(numbered(i))
+  }
+
+  // One reading with the sink and one waiting for it, the worker holds the
+  // third and the rest are spilled for the next run
+  waitFor(t, "the worker to wait for the sink", func() bool {
+    return p.Stats().Depth == 2
+  })
+  p.Close()
+  if st := p.Stats(); st.Dropped != 0 || st.Spilled != 2 {
+    t.Errorf("pipeline stats %+v", st)
+  }
+  close(stuck.release)
+  d.Close()
+}
@@ -5,7 +5,10 @@ import (
   "time"
   "bytes"
   "errors"
+  "io/ioutil"
   "net/http"
+  "sync"
+  "compress/gzip"
   "crypto/tls"
   "encoding/json"
   "github.com/NeilBetham/elements/protocol"
@@ -14,30 +17,85 @@ import (
 
 
 type Report struct {
-  Reading struct {
-    Type string `json:"type"`
-    RawValue string `json:"raw_value"`
-    DecodedValue string `json:"decoded_value"`
-    Timestamp time.Time `json:"timestamp"`
-  } `json:"reading"`
+  Reading ApiReading `json:"reading"`
 }
 
+// BatchReport readings posted together to the batch endpoint
+type BatchReport struct {
+  Readings []ApiReading `json:"readings"`
+}
+
+// ApiReading a single reading as the station API takes it
+type ApiReading struct {
+  Type string `json:"type"`
+  RawValue string `json:"raw_value"`
+  DecodedValue string `json:"decoded_value"`
+  Timestamp time.Time `json:"timestamp"`
+}
+
+// BatchResponse the batch endpoint's reply, it only needs to list the
+// readings it didn't take
+type BatchResponse struct {
+  Results []struct {
+    // Position of the reading in the batch
+    Index int `json:"index"`
+    Status int `json:"status"`
+    Error string `json:"error"`
+  } `json:"results"`
+}
+
+
+// Reports taken for a partly failed reading are remembered this long, a
+// retry after that may post them again
+const sentReportsMaxAge = 24 * time.Hour
 
+// Reporter posts readings and health to the station API. With batching on
+// readings are collected and posted together to BatchUrl, the reply lists
+// any that weren't taken by their index in the batch. A reading is posted as
+// a report each for its sensor and wind, when only some are taken the rest
+// fail the reading and only they are posted when it's sent again.
 type Reporter struct {
+  name string
   Client *http.Client
   Url string
+  BatchUrl string
+  HealthUrl string
   ApiKey string
+  // Compress request bodies
+  Gzip bool
+
+  batcher *batcher
+  sent *sentReports
+}
+
+// reportKey identifies one report of a reading
+type reportKey struct {
+  station int
+  timestamp int64
+  typ string
 }
 
+// sentReports the reports already taken for readings that partly failed
+type sentReports struct {
+  mu sync.Mutex
+  // When each report was taken
+  at map[reportKey]time.Time
+}
 
-func NewReporter(c config.Config) (r Reporter) {
+
+var _ HealthSink = (*Reporter)(nil)
+var _ BatchSink = (*Reporter)(nil)
+var _ AsyncSink = (*Reporter)(nil)
+
+func NewReporter(c config.SinkConfig) (r Reporter) {
+  r.name = c.Name
   if c.Server.SslVerify == false {
     tr := &http.Transport {
       TLSClientConfig: &tls.Config { InsecureSkipVerify: true },
     }
-    r.Client = &http.Client { Transport: tr }
+    r.Client = &http.Client { Transport: tr, Timeout: 30 * time.Second }
   } else {
-    r.Client = &http.Client {}
+    r.Client = &http.Client { Timeout: 30 * time.Second }
   }
 
   protocol := "http"
@@ -45,58 +103,286 @@ func NewReporter(c config.Config) (r Reporter) {
     protocol = "https"
   }
 
-  r.Url = fmt.Sprintf("%s://%s:%s/api/stations/%s/reading",
+  stationUrl := fmt.Sprintf("%s://%s:%s/api/stations/%s",
     protocol,
     c.Server.Host,
     c.Server.Port,
     c.Server.StationId,
   )
+  r.Url = stationUrl + "/reading"
+  r.BatchUrl = stationUrl + "/readings"
+  r.HealthUrl = stationUrl + "/health"
 
   r.ApiKey = c.Credentials.ApiKey
+  r.Gzip = c.Gzip
+  r.sent = &sentReports{at: make(map[reportKey]time.Time)}
+
+  if c.Batch.MaxReadings > 1 || c.Batch.Interval > 0 {
+    r.batcher = newBatcher(r.name, r.ReportReadings, c.Batch.MaxReadings, c.Batch.Interval)
+  }
 
   return
 }
 
 
 
-func (rp *Reporter) postReport(report Report) (err error) {
-  jsonData, err :=  json.Marshal(report)
+func (rp *Reporter) Name() string {
+  return rp.name
+}
+
+
+func (rp *Reporter) post(url string, payload interface{}) (err error) {
+  _, err = rp.postBody(url, payload)
+  return
+}
+
+// postBody posts payload as JSON and returns the response body
+func (rp *Reporter) postBody(url string, payload interface{}) (body []byte, err error) {
+  jsonData, err :=  json.Marshal(payload)
   if err != nil {
     return
   }
 
-  req, err := http.NewRequest("POST", rp.Url, bytes.NewBuffer(jsonData))
+  var reqBody bytes.Buffer
+  if rp.Gzip {
+    zw := gzip.NewWriter(&reqBody)
+    if _, err = zw.Write(jsonData); err != nil {
+      return
+    }
+    if err = zw.Close(); err != nil {
+      return
+    }
+  } else {
+    reqBody.Write(jsonData)
+  }
+
+  req, err := http.NewRequest("POST", url, &reqBody)
   if err != nil {
     return
   }
   req.Header.Add("Authorization", fmt.Sprintf("Token %s", rp.ApiKey))
   req.Header.Set("Content-Type", "application/json")
+  if rp.Gzip {
+    req.Header.Set("Content-Encoding", "gzip")
+  }
 
   resp, err := rp.Client.Do(req)
+  if err != nil {
+    return
+  }
+  defer resp.Body.Close()
+  body, err = ioutil.ReadAll(resp.Body)
+  if err != nil {
+    return
+  }
   if resp.StatusCode > 300 {
-    err = errors.New(fmt.Sprintf("Error posting to API, http code: %i", resp.StatusCode))
+    err = statusError(resp.StatusCode, "")
   }
   return
 }
 
+// statusError the error for an unsuccessful HTTP status and any detail the
+// server gave
+func statusError(code int, detail string) (err error) {
+  err = errors.New(fmt.Sprintf("Error posting to API, http code: %d", code))
+  if detail != "" {
+    err = errors.New(fmt.Sprintf("Error posting to API, http code: %d: %s", code, detail))
+  }
+  // The server understood the request and turned it down, sending it again
+  // won't change its mind
+  if code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests {
+    err = &PermanentError{err}
+  }
+  return
+}
 
-func (rp *Reporter) ReportReading(r protocol.Reading) (err error) {
+// reports the API readings for a reading, one for the sensor and unless it's
+// derived one each for wind speed and direction, if the vane is reporting
+func reports(r protocol.Reading) (reports []Report) {
   var report Report
 
-  report.Reading.Type = r.SensorName
-  report.Reading.RawValue = fmt.Sprintf("%X", r.RawValue)
-  report.Reading.DecodedValue = fmt.Sprintf("%f", r.Value)
-  report.Reading.Timestamp = time.Now()
-  err = rp.postReport(report)
+  report.Reading.Timestamp = r.Timestamp
+  if r.Timestamp.IsZero() {
+    report.Reading.Timestamp = time.Now()
+  }
+  if !r.NoSensor {
+    report.Reading.Type = r.SensorName
+    report.Reading.RawValue = fmt.Sprintf("%X", r.RawValue)
+    report.Reading.DecodedValue = fmt.Sprintf("%f", r.Value)
+    reports = append(reports, report)
+  }
+
+  if r.Derived {
+    return
+  }
 
   report.Reading.Type = "WindSpeed"
   report.Reading.RawValue = ""
   report.Reading.DecodedValue = fmt.Sprintf("%f", r.WindSpeed)
-  err = rp.postReport(report)
+  reports = append(reports, report)
 
+  if r.NoWindDir {
+    return
+  }
   report.Reading.Type = "WindDir"
   report.Reading.DecodedValue = fmt.Sprintf("%f", r.WindDir)
-  err = rp.postReport(report)
+  reports = append(reports, report)
+  return
+}
 
+// pending the reports for a reading that haven't been taken yet
+func (rp *Reporter) pending(r protocol.Reading) (pending []Report, keys []reportKey) {
+  rp.sent.mu.Lock()
+  defer rp.sent.mu.Unlock()
+  for _, report := range reports(r) {
+    key := reportKey{r.StationID, r.Timestamp.UnixNano(), report.Reading.Type}
+    if _, ok := rp.sent.at[key]; ok {
+      continue
+    }
+    pending = append(pending, report)
+    keys = append(keys, key)
+  }
   return
 }
+
+// settle records which pending reports of a reading were taken, a reading
+// that's done with is forgotten. It's done once everything's taken or a
+// report is refused, then it won't be sent again.
+func (rp *Reporter) settle(r protocol.Reading, keys []reportKey, errs []error) {
+  done := true
+  for _, err := range errs {
+    if err != nil && !IsPermanent(err) {
+      done = false
+    }
+  }
+
+  rp.sent.mu.Lock()
+  defer rp.sent.mu.Unlock()
+  now := time.Now()
+  for key, at := range rp.sent.at {
+    if now.Sub(at) > sentReportsMaxAge {
+      delete(rp.sent.at, key)
+    }
+  }
+  if done {
+    for _, report := range reports(r) {
+      delete(rp.sent.at, reportKey{r.StationID, r.Timestamp.UnixNano(), report.Reading.Type})
+    }
+    return
+  }
+  for i, key := range keys {
+    if errs[i] == nil {
+      rp.sent.at[key] = now
+    }
+  }
+}
+
+// ReportReading posts a reading, it joins the next batch if batching is on
+// and failures are passed to the OnFailure function. Every report for the
+// reading not yet taken is tried and the first failure returned.
+func (rp *Reporter) ReportReading(r protocol.Reading) (err error) {
+  if rp.batcher != nil {
+    rp.batcher.add(r)
+    return
+  }
+
+  pending, keys := rp.pending(r)
+  errs := make([]error, len(pending))
+  for i, report := range pending {
+    errs[i] = rp.post(rp.Url, report)
+    if errs[i] != nil && err == nil {
+      err = errs[i]
+    }
+  }
+  rp.settle(r, keys, errs)
+  return
+}
+
+// ReportReadings posts readings in a single request to the batch endpoint
+// and returns an error for each reading that failed
+func (rp *Reporter) ReportReadings(rs []protocol.Reading) (errs []error) {
+  var batch BatchReport
+  // Index of the first and one past the last report for each reading
+  bounds := make([][2]int, len(rs))
+  keys := make([][]reportKey, len(rs))
+  for i, r := range rs {
+    bounds[i][0] = len(batch.Readings)
+    var pending []Report
+    pending, keys[i] = rp.pending(r)
+    for _, report := range pending {
+      batch.Readings = append(batch.Readings, report.Reading)
+    }
+    bounds[i][1] = len(batch.Readings)
+  }
+
+  errs = make([]error, len(rs))
+  if len(batch.Readings) == 0 {
+    return
+  }
+
+  itemErrs := make([]error, len(batch.Readings))
+  body, err := rp.postBody(rp.BatchUrl, batch)
+  if err == nil {
+    itemErrs, err = batchResultErrors(body, len(batch.Readings))
+  }
+  if err != nil {
+    for i := range itemErrs {
+      itemErrs[i] = err
+    }
+  }
+
+  for i, b := range bounds {
+    readingErrs := itemErrs[b[0]:b[1]]
+    for _, itemErr := range readingErrs {
+      if itemErr != nil {
+        errs[i] = itemErr
+        break
+      }
+    }
+    rp.settle(rs[i], keys[i], readingErrs)
+  }
+  return
+}
+
+// batchResultErrors an error for each item in a batch from the response, a
+// response without results means everything was taken
+func batchResultErrors(body []byte, items int) (errs []error, err error) {
+  errs = make([]error, items)
+  if len(bytes.TrimSpace(body)) == 0 {
+    return
+  }
+
+  var resp BatchResponse
+  if err = json.Unmarshal(body, &resp); err != nil {
+    err = fmt.Errorf("Error decoding batch response: %s", err)
+    return
+  }
+  for _, result := range resp.Results {
+    if result.Index < 0 || result.Index >= items || result.Status < 300 {
+      continue
+    }
+    errs[result.Index] = statusError(result.Status, result.Error)
+  }
+  return
+}
+
+// OnFailure sets where batched readings that fail to post go, they're
+// logged and dropped otherwise
+func (rp *Reporter) OnFailure(fn func(r protocol.Reading, err error)) {
+  if rp.batcher != nil {
+    rp.batcher.onFailure(fn)
+  }
+}
+
+// Close sends anything waiting for the next batch
+func (rp *Reporter) Close() error {
+  if rp.batcher != nil {
+    rp.batcher.close()
+  }
+  return nil
+}
+
+
+func (rp *Reporter) ReportHealth(h HealthReport) (err error) {
+  return rp.post(rp.HealthUrl, h)
+}
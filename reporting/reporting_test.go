@@ -0,0 +1,174 @@
+package reporting
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+  "github.com/NeilBetham/elements/config"
+  "github.com/NeilBetham/elements/protocol"
+)
+
+// apiServer records the type of every report posted and fails those fail
+// gives a status for
+type apiServer struct {
+  *httptest.Server
+  mu sync.Mutex
+  posted []string
+  fail map[string]int
+}
+
+func newAPIServer() (s *apiServer) {
+  s = &apiServer{fail: make(map[string]int)}
+  s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if strings.HasSuffix(r.URL.Path, "/reading") {
+      var report Report
+      json.NewDecoder(r.Body).Decode(&report)
+      s.posted = append(s.posted, report.Reading.Type)
+      if status, ok := s.fail[report.Reading.Type]; ok {
+        w.WriteHeader(status)
+      }
+      return
+    }
+
+    var batch BatchReport
+    json.NewDecoder(r.Body).Decode(&batch)
+    var results []string
+    for i, reading := range batch.Readings {
+      s.posted = append(s.posted, reading.Type)
+      if status, ok := s.fail[reading.Type]; ok {
+        results = append(results, fmt.Sprintf(`{"index": %d, "status": %d}`, i, status))
+      }
+    }
+    fmt.Fprintf(w, `{"results": [%s]}`, strings.Join(results, ","))
+  }))
+  return
+}
+
+func (s *apiServer) setFail(typ string, status int) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if status == 0 {
+    delete(s.fail, typ)
+    return
+  }
+  s.fail[typ] = status
+}
+
+// takePosted the types posted since the last call
+func (s *apiServer) takePosted() string {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  posted := strings.Join(s.posted, " ")
+  s.posted = nil
+  return posted
+}
+
+func (s *apiServer) reporter(t *testing.T) *Reporter {
+  u, err := url.Parse(s.URL)
+  if err != nil {
+    t.Fatal(err)
+  }
+  r := NewReporter(config.SinkConfig{Name: "api", Server: config.ServerConfig{Host: u.Hostname(), Port: u.Port(), StationId: "1"}})
+  return &r
+}
+
+func windReading(station int, at time.Time) protocol.Reading {
+  return protocol.Reading{StationID: station, Timestamp: at, Sensor: protocol.Temperature, SensorName: "Temperature",
+    Value: 70, Valid: true, WindSpeed: 5, WindDir: 90}
+}
+
+func TestReporterPartialFailure(t *testing.T) {
+  s := newAPIServer()
+  defer s.Close()
+  rp := s.reporter(t)
+  r := windReading(1, time.Now())
+
+  s.setFail("WindDir", http.StatusServiceUnavailable)
+  if err := rp.ReportReading(r); err == nil {
+    t.Fatal("No error for a failed report")
+  }
+  if posted := s.takePosted(); posted != "Temperature WindSpeed WindDir" {
+    t.Errorf("Posted %s", posted)
+  }
+
+  // Only what failed is sent again
+  if err := rp.ReportReading(r); err == nil {
+    t.Fatal("No error for a failed report")
+  }
+  s.setFail("WindDir", 0)
+  if err := rp.ReportReading(r); err != nil {
+    t.Fatal(err)
+  }
+  if posted := s.takePosted(); posted != "WindDir WindDir" {
+    t.Errorf("Retries posted %s", posted)
+  }
+
+  // A reading that's done with is forgotten
+  if err := rp.ReportReading(r); err != nil {
+    t.Fatal(err)
+  }
+  if posted := s.takePosted(); posted != "Temperature WindSpeed WindDir" {
+    t.Errorf("Posting again sent %s", posted)
+  }
+
+  // As is one that was refused
+  s.setFail("WindSpeed", http.StatusBadRequest)
+  if err := rp.ReportReading(r); !IsPermanent(err) {
+    t.Fatalf("Refused report gave %v", err)
+  }
+  s.setFail("WindSpeed", 0)
+  rp.ReportReading(r)
+  if posted := s.takePosted(); posted != "Temperature WindSpeed WindDir Temperature WindSpeed WindDir" {
+    t.Errorf("After a refusal posted %s", posted)
+  }
+  if len(rp.sent.at) != 0 {
+    t.Errorf("%d reports remembered", len(rp.sent.at))
+  }
+}
+
+func TestReporterBatchPartialFailure(t *testing.T) {
+  s := newAPIServer()
+  defer s.Close()
+  rp := s.reporter(t)
+  now := time.Now()
+  rs := []protocol.Reading{windReading(1, now), windReading(2, now)}
+  rs[1].NoWindDir = true
+
+  s.setFail("WindSpeed", http.StatusServiceUnavailable)
+  errs := rp.ReportReadings(rs)
+  if errs[0] == nil || errs[1] == nil {
+    t.Fatalf("Errors %v", errs)
+  }
+  if posted := s.takePosted(); posted != "Temperature WindSpeed WindDir Temperature WindSpeed" {
+    t.Errorf("Posted %s", posted)
+  }
+
+  s.setFail("WindSpeed", 0)
+  for i, err := range rp.ReportReadings(rs) {
+    if err != nil {
+      t.Errorf("Reading %d: %s", i, err)
+    }
+  }
+  if posted := s.takePosted(); posted != "WindSpeed WindSpeed" {
+    t.Errorf("Retry posted %s", posted)
+  }
+
+  // Nothing is remembered when the whole post fails
+  s.Close()
+  for _, err := range rp.ReportReadings(rs) {
+    if err == nil {
+      t.Error("No error with the server gone")
+    }
+  }
+  if len(rp.sent.at) != 0 {
+    t.Errorf("%d reports remembered", len(rp.sent.at))
+  }
+}
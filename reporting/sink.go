@@ -0,0 +1,345 @@
+package reporting
+
+import (
+  "fmt"
+  "io"
+  "log"
+  "sync"
+  "time"
+  "github.com/NeilBetham/elements/config"
+  "github.com/NeilBetham/elements/protocol"
+  "github.com/NeilBetham/elements/weather"
+)
+
+// Sink is somewhere readings are reported to
+type Sink interface {
+  // Name identifies the sink in logs
+  Name() string
+  ReportReading(r protocol.Reading) error
+}
+
+// HealthSink is a Sink that also takes receiver health reports
+type HealthSink interface {
+  Sink
+  ReportHealth(h HealthReport) error
+}
+
+// SyncSink is a Sink that wants to know when the receiver gains or loses
+// sync with every ISS
+type SyncSink interface {
+  Sink
+  ReportSync(inSync bool) error
+}
+
+// BatchSink is a Sink that can take many readings at once, it returns an
+// error for each reading that failed
+type BatchSink interface {
+  Sink
+  ReportReadings(rs []protocol.Reading) []error
+}
+
+// AsyncSink is a Sink that can take a reading before sending it, readings
+// that fail later are passed to the function given to OnFailure
+type AsyncSink interface {
+  Sink
+  OnFailure(fn func(r protocol.Reading, err error))
+}
+
+// NewSink sets up a sink from its config, behind an outbox if it has one.
+// Sinks that report whole observations read them from wx.
+func NewSink(c config.SinkConfig, wx *weather.Aggregator) (sink Sink, err error) {
+  if c.Name == "" {
+    c.Name = c.Type
+  }
+
+  switch c.Type {
+  case "station_api":
+    r := NewReporter(c)
+    sink = &r
+  case "log":
+    sink, err = NewLogSink(c)
+  case "wunderground":
+    sink, err = NewWUSink(c, wx)
+  case "aprs":
+    sink, err = NewAPRSSink(c, wx)
+  case "mqtt":
+    sink, err = NewMQTTSink(c)
+  case "influxdb":
+    sink, err = NewInfluxSink(c)
+  default:
+    err = fmt.Errorf("sink %s has unknown type %q", c.Name, c.Type)
+  }
+  if err != nil || c.Outbox.Path == "" {
+    return
+  }
+  return NewOutbox(sink, c.Outbox)
+}
+
+// Reports waiting for each sink when the config doesn't say, past this the
+// overflow policy applies
+const defaultSinkQueueSize = 1000
+
+// Time Close gives the sinks to catch up before what's waiting is dropped
+const sinkCloseTimeout = 10 * time.Second
+
+// Dispatcher fans readings out to every sink. Each sink has its own queue
+// and goroutine so a failing or slow one doesn't hold up the others while
+// there's room. Once a sink's queue is full its oldest reading is dropped
+// with the drop_oldest policy, otherwise reporting waits for the sink so the
+// pipeline in front blocks or spills.
+type Dispatcher struct {
+  sinks []Sink
+  queues []*sinkQueue
+}
+
+// SinkStats how many readings a sink has taken and failed to take
+type SinkStats struct {
+  Name string `json:"name"`
+  Succeeded int `json:"succeeded"`
+  Failed int `json:"failed"`
+  // Reports waiting for the sink right now
+  Queued int `json:"queued"`
+  // Reports dropped because the sink fell too far behind
+  Dropped int `json:"dropped"`
+}
+
+// sinkQueue the reports waiting for one sink, sent in order by a goroutine
+// of its own
+type sinkQueue struct {
+  sink Sink
+  capacity int
+  // Wait for room rather than dropping the oldest reading
+  wait bool
+  done chan struct{}
+
+  mu sync.Mutex
+  // Signalled when a report is queued or taken and on close
+  cond *sync.Cond
+  jobs []sinkJob
+  closed bool
+
+  succeeded int
+  failed int
+  dropped int
+}
+
+// sinkJob a report for a sink, only readings are counted
+type sinkJob struct {
+  reading bool
+  fn func(s Sink) error
+}
+
+// NewDispatcher sets up every sink in the config
+func NewDispatcher(c config.Config, wx *weather.Aggregator) (d Dispatcher, err error) {
+  var sinks []Sink
+  for _, sc := range c.ReportingSinks() {
+    sink, sinkErr := NewSink(sc, wx)
+    if sinkErr != nil {
+      err = sinkErr
+      return
+    }
+    sinks = append(sinks, sink)
+  }
+  overflow, err := ParseOverflow(c.Reporting.Overflow)
+  if err != nil {
+    return
+  }
+  d = newDispatcher(sinks, c.Reporting.QueueSize, overflow)
+  return
+}
+
+// newDispatcher starts a queue for each sink holding up to queueSize reports
+func newDispatcher(sinks []Sink, queueSize int, overflow Overflow) (d Dispatcher) {
+  if queueSize <= 0 {
+    queueSize = defaultSinkQueueSize
+  }
+  for _, sink := range sinks {
+    q := &sinkQueue{sink: sink, capacity: queueSize, wait: overflow != DropOldest, done: make(chan struct{})}
+    q.cond = sync.NewCond(&q.mu)
+    go q.run()
+    d.sinks = append(d.sinks, sink)
+    d.queues = append(d.queues, q)
+  }
+  return
+}
+
+// Sinks the sinks readings are dispatched to
+func (d Dispatcher) Sinks() []Sink {
+  return d.sinks
+}
+
+// Close gives every sink a while to send what's waiting for it, then shuts
+// down those that hold anything open
+func (d Dispatcher) Close() (err error) {
+  var wg sync.WaitGroup
+  for _, q := range d.queues {
+    wg.Add(1)
+    go func(q *sinkQueue) {
+      defer wg.Done()
+      q.close(sinkCloseTimeout)
+    }(q)
+  }
+  wg.Wait()
+
+  for _, s := range d.sinks {
+    c, ok := s.(io.Closer)
+    if !ok {
+      continue
+    }
+    if closeErr := c.Close(); closeErr != nil {
+      log.Printf("Error closing %s: %s", s.Name(), closeErr)
+      err = closeErr
+    }
+  }
+  return
+}
+
+// Stats reading counts for each sink
+func (d Dispatcher) Stats() (stats []SinkStats) {
+  for i, s := range d.sinks {
+    q := d.queues[i]
+    q.mu.Lock()
+    stats = append(stats, SinkStats{
+      Name: s.Name(),
+      Succeeded: q.succeeded,
+      Failed: q.failed,
+      Queued: len(q.jobs),
+      Dropped: q.dropped,
+    })
+    q.mu.Unlock()
+  }
+  return
+}
+
+// ReportReading queues a reading for every sink, waiting for room unless the
+// policy is to drop the oldest
+func (d Dispatcher) ReportReading(r protocol.Reading) {
+  d.each(true, func(s Sink) error {
+    err := s.ReportReading(r)
+    if err != nil {
+      log.Printf("Error reporting reading to %s: %s", s.Name(), err)
+    }
+    return err
+  })
+}
+
+// ReportHealth queues a health report for every sink that takes them
+func (d Dispatcher) ReportHealth(h HealthReport) {
+  d.each(false, func(s Sink) error {
+    hs, ok := s.(HealthSink)
+    if !ok {
+      return nil
+    }
+    if err := hs.ReportHealth(h); err != nil {
+      log.Printf("Error reporting health to %s: %s", s.Name(), err)
+    }
+    return nil
+  })
+}
+
+// ReportSync tells every sink that wants to know whether the receiver is in
+// sync, after whatever is already waiting for it
+func (d Dispatcher) ReportSync(inSync bool) {
+  d.each(false, func(s Sink) error {
+    ss, ok := s.(SyncSink)
+    if !ok {
+      return nil
+    }
+    if err := ss.ReportSync(inSync); err != nil {
+      log.Printf("Error reporting sync to %s: %s", s.Name(), err)
+    }
+    return nil
+  })
+}
+
+func (d Dispatcher) each(reading bool, fn func(s Sink) error) {
+  for _, q := range d.queues {
+    q.push(sinkJob{reading, fn})
+  }
+}
+
+// push queues a report. When the queue is full a reading waits for room if
+// the queue waits and the oldest report is dropped if not. Health and sync
+// reports never wait, they're few and the receive loop sends them.
+func (q *sinkQueue) push(job sinkJob) {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  for q.wait && job.reading && len(q.jobs) >= q.capacity && !q.closed {
+    q.cond.Wait()
+  }
+  if q.closed {
+    if job.reading {
+      q.dropped++
+    }
+    return
+  }
+
+  if len(q.jobs) >= q.capacity && !q.wait {
+    if q.jobs[0].reading {
+      q.dropped++
+      if q.dropped % 100 == 1 {
+        log.Printf("%s is falling behind, %d readings dropped so far", q.sink.Name(), q.dropped)
+      }
+    }
+    q.jobs = q.jobs[1:]
+  }
+  q.jobs = append(q.jobs, job)
+  q.cond.Broadcast()
+}
+
+// run sends queued reports until the queue is closed and empty
+func (q *sinkQueue) run() {
+  defer close(q.done)
+
+  for {
+    q.mu.Lock()
+    for len(q.jobs) == 0 && !q.closed {
+      q.cond.Wait()
+    }
+    if len(q.jobs) == 0 {
+      q.mu.Unlock()
+      return
+    }
+    job := q.jobs[0]
+    q.jobs = q.jobs[1:]
+    q.cond.Broadcast()
+    q.mu.Unlock()
+
+    err := job.fn(q.sink)
+    if !job.reading {
+      continue
+    }
+    q.mu.Lock()
+    if err != nil {
+      q.failed++
+    } else {
+      q.succeeded++
+    }
+    q.mu.Unlock()
+  }
+}
+
+// close stops taking reports and waits up to timeout for those waiting to
+// be sent, any still waiting after that are dropped
+func (q *sinkQueue) close(timeout time.Duration) {
+  q.mu.Lock()
+  q.closed = true
+  q.cond.Broadcast()
+  q.mu.Unlock()
+
+  select {
+  case <-q.done:
+    return
+  case <-time.After(timeout):
+  }
+
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  for _, job := range q.jobs {
+    if job.reading {
+      q.dropped++
+    }
+  }
+  log.Printf("Gave up waiting for %s, dropping %d reports", q.sink.Name(), len(q.jobs))
+  q.jobs = nil
+}
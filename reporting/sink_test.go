@@ -0,0 +1,151 @@
+package reporting
+
+import (
+  "sync"
+  "testing"
+  "time"
+  "github.com/NeilBetham/elements/protocol"
+)
+
+// stuckSink doesn't return from a report until released
+type stuckSink struct {
+  fakeSink
+  release chan struct{}
+}
+
+func (s *stuckSink) ReportReading(r protocol.Reading) error {
+  <-s.release
+  return s.fakeSink.ReportReading(r)
+}
+
+func TestDispatcherSlowSink(t *testing.T) {
+  stuck := &stuckSink{release: make(chan struct{})}
+  fast := &fakeSink{}
+  d := newDispatcher([]Sink{stuck, fast}, 5, DropOldest)
+
+  // The fast sink gets every reading while the other is stuck
+  for i := 0; i < 20; i++ {
+    d.ReportReading(numbered(i))
+    waitFor(t, "the fast sink", func() bool {
+      fast.mu.Lock()
+      defer fast.mu.Unlock()
+      return len(fast.received) == i + 1
+    })
+  }
+
+  // The stuck sink has one reading in hand and kept the newest it had room
+  // for
+  close(stuck.release)
+  if err := d.Close(); err != nil {
+    t.Fatal(err)
+  }
+  stuck.mu.Lock()
+  defer stuck.mu.Unlock()
+  if len(stuck.received) != 6 || stuck.received[0].Value != 0 || stuck.received[1].Value != 15 {
+    t.Errorf("stuck sink got %v", stuck.received)
+  }
+
+  stats := d.Stats()
+  if stats[0].Dropped != 14 || stats[0].Succeeded != 6 || stats[0].Queued != 0 {
+    t.Errorf("stuck sink stats %+v", stats[0])
+  }
+  if stats[1].Dropped != 0 || stats[1].Succeeded != 20 {
+    t.Errorf("fast sink stats %+v", stats[1])
+  }
+}
+
+func TestDispatcherOrder(t *testing.T) {
+  var mu sync.Mutex
+  var events []string
+  sink := &recordingSink{record: func(e string) {
+    mu.Lock()
+    defer mu.Unlock()
+    events = append(events, e)
+  }}
+  d := newDispatcher([]Sink{sink}, 10, DropOldest)
+  d.ReportReading(numbered(0))
+  d.ReportSync(false)
+  d.ReportReading(numbered(1))
+  d.ReportHealth(HealthReport{})
+  if err := d.Close(); err != nil {
+    t.Fatal(err)
+  }
+
+  mu.Lock()
+  defer mu.Unlock()
+  want := []string{"reading", "sync", "reading", "health"}
+  if len(events) != len(want) {
+    t.Fatalf("got %v, want %v", events, want)
+  }
+  for i := range want {
+    if events[i] != want[i] {
+      t.Fatalf("got %v, want %v", events, want)
+    }
+  }
+  if stats := d.Stats(); stats[0].Succeeded != 2 {
+    t.Errorf("counted %d readings, want 2", stats[0].Succeeded)
+  }
+}
+
+type recordingSink struct {
+  record func(e string)
+}
+
+func (s *recordingSink) Name() string {
+  return "recording"
+}
+
+func (s *recordingSink) ReportReading(r protocol.Reading) error {
+  s.record("reading")
+  return nil
+}
+
+func (s *recordingSink) ReportHealth(h HealthReport) error {
+  s.record("health")
+  return nil
+}
+
+func (s *recordingSink) ReportSync(inSync bool) error {
+  s.record("sync")
+  return nil
+}
+
+func TestDispatcherWaitsForSlowSink(t *testing.T) {
+  stuck := &stuckSink{release: make(chan struct{})}
+  d := newDispatcher([]Sink{stuck}, 2, Block)
+
+  // One reading in hand and two waiting, the fourth waits for room
+  sent := make(chan int, 10)
+  go func() {
+    for i := 0; i < 6; i++ {
+      d.ReportReading(numbered(i))
+      sent <- i
+    }
+  }()
+  for i := 0; i < 3; i++ {
+    <-sent
+  }
+  select {
+  case i := <-sent:
+    t.Fatalf("reading %d was queued past the sink's room", i)
+  case <-time.After(50 * time.Millisecond):
+  }
+
+  close(stuck.release)
+  for i := 3; i < 6; i++ {
+    <-sent
+  }
+  if err := d.Close(); err != nil {
+    t.Fatal(err)
+  }
+  stuck.mu.Lock()
+  defer stuck.mu.Unlock()
+  for i, r := range stuck.received {
+    if r.Value != float64(i) {
+      t.Fatalf("stuck sink got %v", stuck.received)
+    }
+  }
+  if st := d.Stats()[0]; st.Dropped != 0 || st.Succeeded != 6 {
+    t.Errorf("stuck sink stats %+v", st)
+  }
+}
@@ -0,0 +1,165 @@
+package reporting
+
+import (
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+  "github.com/NeilBetham/elements/config"
+  "github.com/NeilBetham/elements/protocol"
+  "github.com/NeilBetham/elements/weather"
+)
+
+// Weather Underground PWS upload endpoints, RapidFire updates go to their own
+// server
+const (
+  wuUrl = "https://weatherstation.wunderground.com/weatherstation/updateweatherstation.php"
+  wuRapidFireUrl = "https://rtupdate.wunderground.com/weatherstation/updateweatherstation.php"
+
+  defaultWUInterval = 5 * time.Minute
+  // RapidFire is meant for updates at the rate the ISS sends
+  defaultWURapidFireInterval = 2500 * time.Millisecond
+)
+
+// WUSink uploads the current conditions to Weather Underground with the PWS
+// protocol every interval, or every few seconds in RapidFire mode. Readings
+// only trigger uploads, the conditions come from the weather aggregator.
+type WUSink struct {
+  name string
+  Client *http.Client
+  Url string
+  StationID string
+  Password string
+  RapidFire bool
+  Interval time.Duration
+
+  Weather *weather.Aggregator
+  mu sync.Mutex
+  lastUpload time.Time
+}
+
+// NewWUSink sets up a Weather Underground sink uploading the conditions kept
+// by wx
+func NewWUSink(c config.SinkConfig, wx *weather.Aggregator) (w *WUSink, err error) {
+  if wx == nil {
+    return nil, fmt.Errorf("sink %s needs the current conditions", c.Name)
+  }
+  if c.StationID == "" || c.Password == "" {
+    return nil, fmt.Errorf("sink %s needs a station_id and password", c.Name)
+  }
+
+  w = &WUSink{
+    name: c.Name,
+    Client: &http.Client{Timeout: 30 * time.Second},
+    Url: c.Url,
+    StationID: c.StationID,
+    Password: c.Password,
+    RapidFire: c.RapidFire,
+    Interval: c.Interval,
+    Weather: wx,
+  }
+  if w.Url == "" {
+    w.Url = wuUrl
+    if w.RapidFire {
+      w.Url = wuRapidFireUrl
+    }
+  }
+  if w.Interval <= 0 {
+    w.Interval = defaultWUInterval
+    if w.RapidFire {
+      w.Interval = defaultWURapidFireInterval
+    }
+  }
+  return
+}
+
+func (w *WUSink) Name() string {
+  return w.name
+}
+
+// ReportReading uploads the current conditions if an upload is due
+func (w *WUSink) ReportReading(r protocol.Reading) error {
+  now := time.Now()
+  w.mu.Lock()
+  if now.Sub(w.lastUpload) < w.Interval {
+    w.mu.Unlock()
+    return nil
+  }
+  w.lastUpload = now
+  w.mu.Unlock()
+
+  return w.upload(w.Weather.Current(), now)
+}
+
+func (w *WUSink) upload(wx weather.Snapshot, now time.Time) (err error) {
+  params, ok := w.params(wx, now)
+  if !ok {
+    return
+  }
+
+  resp, err := w.Client.Get(w.Url + "?" + params.Encode())
+  if err != nil {
+    return
+  }
+  defer resp.Body.Close()
+  body, err := ioutil.ReadAll(resp.Body)
+  if err != nil {
+    return
+  }
+
+  if resp.StatusCode != http.StatusOK {
+    return errors.New(fmt.Sprintf("Error uploading to Weather Underground, http code: %d", resp.StatusCode))
+  }
+  if reply := strings.TrimSpace(string(body)); !strings.HasPrefix(reply, "success") {
+    return errors.New(fmt.Sprintf("Weather Underground rejected upload: %s", reply))
+  }
+  return
+}
+
+// params the upload query for the conditions, stale values are left out and
+// ok is false if everything is stale
+func (w *WUSink) params(wx weather.Snapshot, now time.Time) (params url.Values, ok bool) {
+  params = url.Values{}
+  set := func(key string, f weather.Field, precision int) {
+    if f.Ok() {
+      params.Set(key, strconv.FormatFloat(f.Value, 'f', precision, 64))
+      ok = true
+    }
+  }
+
+  set("tempf", wx.TempF, 1)
+  set("humidity", wx.Humidity, 0)
+  set("windspeedmph", wx.WindSpeedMph, 0)
+  set("winddir", wx.WindDir, 0)
+  set("windgustmph", wx.WindGustMph, 0)
+  set("windspdmph_avg2m", wx.WindSpeedAvg2MinMph, 0)
+  set("winddir_avg2m", wx.WindDirAvg2Min, 0)
+  set("windgustmph_10m", wx.WindGust10MinMph, 0)
+  set("windgustdir_10m", wx.WindGustDir10Min, 0)
+  set("rainin", wx.RainLastHourIn, 2)
+  set("dailyrainin", wx.RainDailyIn, 2)
+  set("solarradiation", wx.SolarRadiation, 0)
+  set("UV", wx.UVIndex, 1)
+  if dewPoint := wx.DewPointF(); dewPoint.Ok() {
+    params.Set("dewptf", strconv.FormatFloat(dewPoint.Value, 'f', 1, 64))
+  }
+  if !ok {
+    return
+  }
+
+  params.Set("ID", w.StationID)
+  params.Set("PASSWORD", w.Password)
+  params.Set("dateutc", now.UTC().Format("2006-01-02 15:04:05"))
+  params.Set("softwaretype", "elements")
+  params.Set("action", "updateraw")
+  if w.RapidFire {
+    params.Set("realtime", "1")
+    params.Set("rtfreq", strconv.FormatFloat(w.Interval.Seconds(), 'f', 1, 64))
+  }
+  return
+}
@@ -0,0 +1,143 @@
+package reporting
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+  "github.com/NeilBetham/elements/config"
+  "github.com/NeilBetham/elements/protocol"
+  "github.com/NeilBetham/elements/weather"
+)
+
+// conditions an aggregator holding a reading for each sensor the upload
+// sinks send, wind rides along on every ISS reading
+func conditions(tempF float64, humidity float64) *weather.Aggregator {
+  wx := weather.NewAggregator(weather.Config{})
+  now := time.Now()
+  add := func(sensor protocol.Sensor, value float64, derived bool) {
+    wx.HandleReading(protocol.Reading{
+      StationID: 1,
+      Timestamp: now,
+      Sensor: sensor,
+      Value: value,
+      WindSpeed: 5,
+      WindDir: 180,
+      Valid: true,
+      Derived: derived,
+    })
+  }
+  add(protocol.Temperature, tempF, false)
+  add(protocol.Humidity, humidity, false)
+  add(protocol.WindGustSpeed, 12, false)
+  add(protocol.RainLastHour, 0.05, true)
+  add(protocol.RainLast24h, 0.4, true)
+  add(protocol.RainDaily, 0.25, true)
+  return wx
+}
+
+// wuServer records the query of every upload and replies with reply
+func wuServer(reply string) (server *httptest.Server, queries func() []url.Values) {
+  var mu sync.Mutex
+  var got []url.Values
+  server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    mu.Lock()
+    got = append(got, r.URL.Query())
+    mu.Unlock()
+    w.Write([]byte(reply))
+  }))
+  queries = func() []url.Values {
+    mu.Lock()
+    defer mu.Unlock()
+    return append([]url.Values(nil), got...)
+  }
+  return
+}
+
+func TestWUUpload(t *testing.T) {
+  server, queries := wuServer("success\n")
+  defer server.Close()
+
+  w, err := NewWUSink(config.SinkConfig{Name: "wu", StationID: "KXXTEST1", Password: "secret", Url: server.URL}, conditions(72.5, 50))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := w.ReportReading(protocol.Reading{}); err != nil {
+    t.Fatal(err)
+  }
+  // Not due again for five minutes
+  if err := w.ReportReading(protocol.Reading{}); err != nil {
+    t.Fatal(err)
+  }
+
+  got := queries()
+  if len(got) != 1 {
+    t.Fatalf("%d uploads, want 1", len(got))
+  }
+  want := map[string]string{
+    "ID": "KXXTEST1",
+    "PASSWORD": "secret",
+    "action": "updateraw",
+    "tempf": "72.5",
+    "humidity": "50",
+    "dewptf": "52.8",
+    "windspeedmph": "5",
+    "winddir": "180",
+    "windgustmph": "12",
+    "rainin": "0.05",
+    "dailyrainin": "0.25",
+  }
+  for key, value := range want {
+    if got[0].Get(key) != value {
+      t.Errorf("%s was %q, want %q", key, got[0].Get(key), value)
+    }
+  }
+  for _, key := range []string{"solarradiation", "UV", "realtime"} {
+    if _, ok := got[0][key]; ok {
+      t.Errorf("%s sent with no value for it", key)
+    }
+  }
+  if _, err := time.Parse("2006-01-02 15:04:05", got[0].Get("dateutc")); err != nil {
+    t.Errorf("dateutc %q: %s", got[0].Get("dateutc"), err)
+  }
+}
+
+func TestWURapidFire(t *testing.T) {
+  w, err := NewWUSink(config.SinkConfig{Name: "wu", StationID: "KXXTEST1", Password: "secret", RapidFire: true}, conditions(72.5, 50))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if w.Url != wuRapidFireUrl || w.Interval != defaultWURapidFireInterval {
+    t.Errorf("rapid fire uploads to %s every %s", w.Url, w.Interval)
+  }
+  if !strings.HasPrefix(w.Url, "https://rtupdate.wunderground.com/") {
+    t.Errorf("rapid fire url %s isn't the rtupdate server", w.Url)
+  }
+
+  server, queries := wuServer("success\n")
+  defer server.Close()
+  w.Url = server.URL
+  if err := w.ReportReading(protocol.Reading{}); err != nil {
+    t.Fatal(err)
+  }
+  got := queries()
+  if len(got) != 1 || got[0].Get("realtime") != "1" || got[0].Get("rtfreq") != "2.5" {
+    t.Errorf("rapid fire upload was %v", got)
+  }
+}
+
+func TestWURejected(t *testing.T) {
+  server, _ := wuServer("INVALIDPASSWORDID|Password or key and/or id are incorrect\n")
+  defer server.Close()
+
+  w, err := NewWUSink(config.SinkConfig{Name: "wu", StationID: "KXXTEST1", Password: "wrong", Url: server.URL}, conditions(72.5, 50))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := w.ReportReading(protocol.Reading{}); err == nil || !strings.Contains(err.Error(), "INVALIDPASSWORDID") {
+    t.Errorf("rejected upload gave %v", err)
+  }
+}
@@ -0,0 +1,80 @@
+package state
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "time"
+  "github.com/NeilBetham/elements/atomicfile"
+  "github.com/NeilBetham/elements/protocol"
+  "github.com/NeilBetham/elements/rain"
+  "github.com/NeilBetham/elements/wind"
+)
+
+// Version of the state file format written by this build
+const Version = 1
+
+// File everything kept between runs
+type File struct {
+  Version int `json:"version"`
+  SavedAt time.Time `json:"saved_at"`
+  Rain *rain.State `json:"rain,omitempty"`
+  Wind *wind.State `json:"wind,omitempty"`
+  Stats *protocol.Stats `json:"stats,omitempty"`
+}
+
+// Store reads and writes the state file
+type Store struct {
+  Path string
+}
+
+// NewStore sets up a store for the state file at path
+func NewStore(path string) (s Store) {
+  s.Path = path
+  return
+}
+
+// Load reads the state file, a missing file gives an empty state
+func (s Store) Load() (f File, err error) {
+  data, err := ioutil.ReadFile(s.Path)
+  if os.IsNotExist(err) {
+    f.Version = Version
+    err = nil
+    return
+  }
+  if err != nil {
+    return
+  }
+
+  if err = json.Unmarshal(data, &f); err != nil {
+    err = fmt.Errorf("state file %s is corrupt: %s", s.Path, err)
+    return
+  }
+  if f.Version != Version {
+    err = fmt.Errorf("state file %s is version %d, expected %d", s.Path, f.Version, Version)
+  }
+  return
+}
+
+// Quarantine moves a state file that can't be loaded aside so a fresh one can
+// be started without losing it, path is where it went
+func (s Store) Quarantine() (path string, err error) {
+  path = fmt.Sprintf("%s.bad-%s", s.Path, time.Now().Format("20060102T150405"))
+  err = os.Rename(s.Path, path)
+  return
+}
+
+// Save writes the state file atomically, either the old or the new state is
+// on disk if we lose power part way through
+func (s Store) Save(f File) (err error) {
+  f.Version = Version
+  f.SavedAt = time.Now()
+
+  data, err := json.MarshalIndent(f, "", "  ")
+  if err != nil {
+    return
+  }
+
+  return atomicfile.Write(s.Path, data)
+}
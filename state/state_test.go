@@ -0,0 +1,37 @@
+package state
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+func TestQuarantine(t *testing.T) {
+  dir, err := ioutil.TempDir("", "state")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  s := NewStore(filepath.Join(dir, "state.json"))
+  if err := ioutil.WriteFile(s.Path, []byte("{\"version\": 1, \"rain\": "), 0644); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := s.Load(); err == nil {
+    t.Fatal("corrupt state file loaded")
+  }
+
+  path, err := s.Quarantine()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if data, err := ioutil.ReadFile(path); err != nil || string(data) != "{\"version\": 1, \"rain\": " {
+    t.Errorf("state file moved to %s holds %q, %v", path, data, err)
+  }
+
+  f, err := s.Load()
+  if err != nil || f.Version != Version || f.Rain != nil {
+    t.Errorf("after moving the state aside got %+v, %v", f, err)
+  }
+}
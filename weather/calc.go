@@ -0,0 +1,174 @@
+package weather
+
+import (
+  "math"
+  "github.com/NeilBetham/elements/protocol"
+)
+
+// Temperatures are in °F, humidity in %, wind in mph and solar radiation in
+// W/m², the units the ISS sends. The formulas mostly work in metric so they
+// convert on the way in and out.
+
+// Share of the global radiation the ISS measures that a person standing in
+// the sun absorbs, Q in the THSW index. About a quarter of the body faces the
+// sun and skin and clothing absorb about 70% of what reaches them.
+const thswAbsorbedSolar = 0.25 * 0.7
+
+// DewPointF the dew point in °F using the Magnus formula, accurate to a few
+// tenths of a degree over normal weather
+func DewPointF(tempF float64, humidity float64) float64 {
+  const a, b = 17.62, 243.12
+  tempC := fToC(tempF)
+  gamma := math.Log(humidity / 100) + a * tempC / (b + tempC)
+  return cToF(b * gamma / (a - gamma))
+}
+
+// HeatIndexF the heat index in °F with the NWS algorithm, Steadman's simple
+// formula for mild conditions and the Rothfusz regression with its low and
+// high humidity adjustments from 80°F up
+func HeatIndexF(tempF float64, humidity float64) float64 {
+  hi := 0.5 * (tempF + 61 + (tempF - 68) * 1.2 + humidity * 0.094)
+  if (hi + tempF) / 2 < 80 {
+    return hi
+  }
+
+  t, rh := tempF, humidity
+  hi = -42.379 + 2.04901523 * t + 10.14333127 * rh - 0.22475541 * t * rh -
+    0.00683783 * t * t - 0.05481717 * rh * rh + 0.00122874 * t * t * rh +
+    0.00085282 * t * rh * rh - 0.00000199 * t * t * rh * rh
+  if rh < 13 && t >= 80 && t <= 112 {
+    hi -= (13 - rh) / 4 * math.Sqrt((17 - math.Abs(t - 95)) / 17)
+  } else if rh > 85 && t >= 80 && t <= 87 {
+    hi += (rh - 85) / 10 * (87 - t) / 5
+  }
+  return hi
+}
+
+// WindChillF the wind chill in °F with the 2001 NWS formula, it's only
+// defined at 50°F and below with at least 3 mph of wind, otherwise it's the
+// temperature
+func WindChillF(tempF float64, windMph float64) float64 {
+  if tempF > 50 || windMph < 3 {
+    return tempF
+  }
+  v := math.Pow(windMph, 0.16)
+  return 35.74 + 0.6215 * tempF - 35.75 * v + 0.4275 * tempF * v
+}
+
+// THWIndexF the temperature-humidity-wind index in °F, the heat index less
+// 1.072°F for every mph of wind as Davis consoles calculate it
+func THWIndexF(tempF float64, humidity float64, windMph float64) float64 {
+  return HeatIndexF(tempF, humidity) - 1.072 * windMph
+}
+
+// THSWIndexF the temperature-humidity-sun-wind index in °F, Steadman's
+// apparent temperature with its radiation term as the Australian Bureau of
+// Meteorology publishes it at bom.gov.au/info/thermal_stress,
+// AT = Ta + 0.348e - 0.70ws + 0.70Q / (ws + 10) - 4.25. Davis don't publish
+// their formula so a console can read a little differently.
+func THSWIndexF(tempF float64, humidity float64, windMph float64, solar float64) float64 {
+  t := fToC(tempF)
+  e := humidity / 100 * 6.105 * math.Exp(17.27 * t / (237.7 + t))
+  ws := mphToMs(windMph)
+  q := solar * thswAbsorbedSolar
+  return cToF(t + 0.348 * e - 0.70 * ws + 0.70 * q / (ws + 10) - 4.25)
+}
+
+// Humidex the Environment Canada humidex, a number on the Celsius scale that
+// isn't converted to °F as that's how it's always quoted
+func Humidex(tempF float64, humidity float64) float64 {
+  dewPointK := fToC(DewPointF(tempF, humidity)) + 273.15
+  e := 6.11 * math.Exp(5417.7530 * (1 / 273.16 - 1 / dewPointK))
+  return fToC(tempF) + 0.5555 * (e - 10)
+}
+
+// WetBulbF the wet bulb temperature in °F at sea level pressure with Stull's
+// 2011 formula, good to within a degree from 5 to 99% humidity
+func WetBulbF(tempF float64, humidity float64) float64 {
+  t, rh := fToC(tempF), humidity
+  tw := t * math.Atan(0.151977 * math.Sqrt(rh + 8.313659)) +
+    math.Atan(t + rh) - math.Atan(rh - 1.676331) +
+    0.00391838 * math.Pow(rh, 1.5) * math.Atan(0.023101 * rh) - 4.686035
+  return cToF(tw)
+}
+
+// ApparentTemperatureF Steadman's apparent temperature in °F as the
+// Australian Bureau of Meteorology uses it, shade with no radiation term
+func ApparentTemperatureF(tempF float64, humidity float64, windMph float64) float64 {
+  t := fToC(tempF)
+  e := humidity / 100 * 6.105 * math.Exp(17.27 * t / (237.7 + t))
+  return cToF(t + 0.33 * e - 0.70 * mphToMs(windMph) - 4.00)
+}
+
+// Derive the quantities calculated from the current conditions, as readings
+// for the transmitter that sent from. They're only worked out when a
+// temperature, humidity or solar radiation reading comes in, wind alone
+// arrives too often to be worth it. Quantities with a stale input are left
+// out.
+func (a *Aggregator) Derive(from protocol.Reading) (derived []protocol.Reading) {
+  if !from.Valid || from.Derived || from.NoSensor {
+    return
+  }
+  switch from.Sensor {
+  case protocol.Temperature, protocol.Humidity, protocol.SolarRadiation:
+  default:
+    return
+  }
+
+  s := a.Current()
+  if !s.TempF.Ok() {
+    return
+  }
+  t := s.TempF.Value
+  add := func(sensor protocol.Sensor, value float64) {
+    derived = append(derived, derivedReading(from, sensor, value))
+  }
+
+  wind := s.WindSpeedMph.Ok()
+  if wind {
+    add(protocol.WindChill, WindChillF(t, s.WindSpeedMph.Value))
+  }
+  // Every formula using humidity breaks down at 0%, the ISS sends it when
+  // the sensor has failed
+  if !s.Humidity.Ok() || s.Humidity.Value <= 0 {
+    return
+  }
+  rh := s.Humidity.Value
+  add(protocol.DewPoint, DewPointF(t, rh))
+  add(protocol.HeatIndex, HeatIndexF(t, rh))
+  add(protocol.Humidex, Humidex(t, rh))
+  add(protocol.WetBulb, WetBulbF(t, rh))
+  if !wind {
+    return
+  }
+  windMph := s.WindSpeedMph.Value
+  add(protocol.THWIndex, THWIndexF(t, rh, windMph))
+  add(protocol.ApparentTemperature, ApparentTemperatureF(t, rh, windMph))
+  if s.SolarRadiation.Ok() {
+    add(protocol.THSWIndex, THSWIndexF(t, rh, windMph, s.SolarRadiation.Value))
+  }
+  return
+}
+
+func derivedReading(from protocol.Reading, sensor protocol.Sensor, value float64) (rd protocol.Reading) {
+  rd.StationID = from.StationID
+  rd.Timestamp = from.Timestamp
+  rd.Sensor = sensor
+  rd.SensorName = sensor.String()
+  rd.Value = value
+  rd.Valid = true
+  rd.Derived = true
+  return
+}
+
+func fToC(f float64) float64 {
+  return (f - 32) * 5 / 9
+}
+
+func cToF(c float64) float64 {
+  return c * 9 / 5 + 32
+}
+
+func mphToMs(mph float64) float64 {
+  return mph * 0.44704
+}
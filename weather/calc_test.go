@@ -0,0 +1,145 @@
+package weather
+
+import (
+  "math"
+  "testing"
+  "time"
+  "github.com/NeilBetham/elements/protocol"
+)
+
+// Values from the NWS heat index chart
+func TestHeatIndex(t *testing.T) {
+  tests := []struct{
+    tempF, humidity float64
+    want int
+  }{
+    {80, 40, 80},
+    {90, 50, 95},
+    {100, 40, 109},
+    {96, 65, 121},
+    {84, 90, 98},
+    {86, 85, 102},
+    {104, 55, 137},
+  }
+  for _, tt := range tests {
+    if got := HeatIndexF(tt.tempF, tt.humidity); int(math.Round(got)) != tt.want {
+      t.Errorf("%v°F %v%%: got %.1f, want %d", tt.tempF, tt.humidity, got, tt.want)
+    }
+  }
+}
+
+// Values from the NWS wind chill chart
+func TestWindChill(t *testing.T) {
+  tests := []struct{
+    tempF, windMph float64
+    want int
+  }{
+    {40, 5, 36},
+    {35, 25, 23},
+    {30, 10, 21},
+    {5, 60, -26},
+    {0, 15, -19},
+    {-20, 30, -53},
+    // Outside the chart it's the temperature
+    {55, 20, 55},
+    {20, 2, 20},
+  }
+  for _, tt := range tests {
+    if got := WindChillF(tt.tempF, tt.windMph); int(math.Round(got)) != tt.want {
+      t.Errorf("%v°F %v mph: got %.1f, want %d", tt.tempF, tt.windMph, got, tt.want)
+    }
+  }
+}
+
+// Values from the Environment Canada humidex table, which is by dew point
+func TestHumidex(t *testing.T) {
+  tests := []struct{
+    tempC, dewPointC float64
+    want int
+  }{
+    {30, 15, 34},
+    {30, 25, 42},
+  }
+  for _, tt := range tests {
+    // The humidity that gives the dew point, inverting the Magnus formula
+    const a, b = 17.62, 243.12
+    humidity := 100 * math.Exp(a * tt.dewPointC / (b + tt.dewPointC) - a * tt.tempC / (b + tt.tempC))
+    if got := Humidex(cToF(tt.tempC), humidity); int(math.Round(got)) != tt.want {
+      t.Errorf("%v°C dew point %v°C: got %.1f, want %d", tt.tempC, tt.dewPointC, got, tt.want)
+    }
+  }
+}
+
+func TestDewPointWetBulb(t *testing.T) {
+  tests := []struct{
+    name string
+    got, want, tolerance float64
+  }{
+    {"dew point 20°C 50%", fToC(DewPointF(68, 50)), 9.3, 0.1},
+    {"dew point at saturation", fToC(DewPointF(68, 100)), 20, 0.01},
+    // The worked example in Stull's paper
+    {"wet bulb 20°C 50%", fToC(WetBulbF(68, 50)), 13.7, 0.05},
+    // Still air at 30°C 50%, 30 + 0.33 * 21.1 hPa - 4
+    {"apparent temperature", fToC(ApparentTemperatureF(86, 50, 0)), 33.0, 0.05},
+    // The same in the shade with the radiation form, 30 + 0.348 * 21.1 hPa
+    // - 4.25, then in 2 m/s of wind and 800 W/m² of sun absorbing 140 W/m²,
+    // 30 + 7.36 - 1.4 + 0.7 * 140 / 12 - 4.25
+    {"thsw in the shade", fToC(THSWIndexF(86, 50, 0, 0)), 33.1, 0.05},
+    {"thsw in the sun", fToC(THSWIndexF(86, 50, 2 / 0.44704, 800)), 39.9, 0.05},
+  }
+  for _, tt := range tests {
+    if math.Abs(tt.got - tt.want) > tt.tolerance {
+      t.Errorf("%s: got %.2f, want %.2f", tt.name, tt.got, tt.want)
+    }
+  }
+}
+
+func TestDerive(t *testing.T) {
+  a := NewAggregator(Config{})
+  now := time.Now()
+  reading := func(sensor protocol.Sensor, value float64) protocol.Reading {
+    return protocol.Reading{StationID: 2, Timestamp: now, Sensor: sensor, Value: value, WindSpeed: 10, WindDir: 270, Valid: true}
+  }
+
+  temp := reading(protocol.Temperature, 30)
+  a.HandleReading(temp)
+  derived := a.Derive(temp)
+  if len(derived) != 1 || derived[0].Sensor != protocol.WindChill {
+    t.Fatalf("temperature alone derived %v", derived)
+  }
+
+  humidity := reading(protocol.Humidity, 60)
+  a.HandleReading(humidity)
+  got := make(map[protocol.Sensor]protocol.Reading)
+  for _, rd := range a.Derive(humidity) {
+    if !rd.Derived || !rd.Valid || rd.StationID != 2 {
+      t.Errorf("derived reading %v", rd)
+    }
+    got[rd.Sensor] = rd
+  }
+  for _, sensor := range []protocol.Sensor{
+    protocol.WindChill, protocol.DewPoint, protocol.HeatIndex, protocol.Humidex,
+    protocol.WetBulb, protocol.THWIndex, protocol.ApparentTemperature,
+  } {
+    if _, ok := got[sensor]; !ok {
+      t.Errorf("no %s derived", sensor)
+    }
+  }
+  if len(got) != 7 {
+    t.Errorf("derived %d readings, want 7", len(got))
+  }
+
+  // The sun adds the THSW index
+  solar := reading(protocol.SolarRadiation, 500)
+  a.HandleReading(solar)
+  if derived := a.Derive(solar); len(derived) != 8 || derived[7].Sensor != protocol.THSWIndex {
+    t.Errorf("solar radiation derived %v", derived)
+  }
+
+  // A failed humidity sensor sends 0%
+  failed := reading(protocol.Humidity, 0)
+  a.HandleReading(failed)
+  if derived := a.Derive(failed); len(derived) != 1 {
+    t.Errorf("0%% humidity derived %v", derived)
+  }
+}
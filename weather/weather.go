@@ -0,0 +1,248 @@
+// Package weather merges the stream of readings, each carrying wind and a
+// single rotating sensor, into a snapshot of the current conditions
+package weather
+
+import (
+  "sync"
+  "time"
+  "github.com/NeilBetham/elements/protocol"
+)
+
+// Values older than this are stale by default, the ISS sends every sensor at
+// least once a minute or so
+const DefaultMaxAge = 10 * time.Minute
+
+// Config controls when values go stale
+type Config struct {
+  // How long a value is current for after it's received
+  MaxAge time.Duration
+}
+
+// Field a value and when it was received
+type Field struct {
+  Value float64
+  At time.Time
+  // Set when the value is older than the max age, or was never received
+  Stale bool
+}
+
+// Ok whether the field holds a current value
+func (f Field) Ok() bool {
+  return !f.Stale
+}
+
+// Or the field if it's current, otherwise other
+func (f Field) Or(other Field) Field {
+  if f.Ok() {
+    return f
+  }
+  return other
+}
+
+// Snapshot the current conditions in the units the ISS sends them. Values
+// from every transmitter are merged, if two send the same sensor the latest
+// wins.
+type Snapshot struct {
+  // When the latest reading in the snapshot was received
+  Time time.Time
+
+  TempF Field
+  Humidity Field
+  WindSpeedMph Field
+  WindDir Field
+  WindGustMph Field
+  WindSpeedAvg2MinMph Field
+  WindDirAvg2Min Field
+  WindGust10MinMph Field
+  WindGustDir10Min Field
+  RainRateInHr Field
+  RainLastHourIn Field
+  RainLast24hIn Field
+  RainDailyIn Field
+  RainStormIn Field
+  RainYearlyIn Field
+  RainTotalIn Field
+  SolarRadiation Field
+  UVIndex Field
+}
+
+// fields every field in the snapshot by pointer, for updating them all
+func (s *Snapshot) fields() []*Field {
+  return []*Field{
+    &s.TempF, &s.Humidity, &s.WindSpeedMph, &s.WindDir, &s.WindGustMph,
+    &s.WindSpeedAvg2MinMph, &s.WindDirAvg2Min, &s.WindGust10MinMph, &s.WindGustDir10Min,
+    &s.RainRateInHr, &s.RainLastHourIn, &s.RainLast24hIn, &s.RainDailyIn, &s.RainStormIn,
+    &s.RainYearlyIn, &s.RainTotalIn, &s.SolarRadiation, &s.UVIndex,
+  }
+}
+
+// DewPointF the dew point in °F from temperature and humidity, stale if
+// either is
+func (s Snapshot) DewPointF() (f Field) {
+  f.At = s.TempF.At
+  if s.Humidity.At.After(f.At) {
+    f.At = s.Humidity.At
+  }
+  f.Stale = !s.TempF.Ok() || !s.Humidity.Ok() || s.Humidity.Value <= 0
+  if !f.Stale {
+    f.Value = DewPointF(s.TempF.Value, s.Humidity.Value)
+  }
+  return
+}
+
+// Aggregator keeps the current conditions up to date from readings, it's
+// safe to use from any goroutine
+type Aggregator struct {
+  cfg Config
+
+  mu sync.Mutex
+  snapshot Snapshot
+  subscribers map[chan Snapshot]bool
+}
+
+// NewAggregator sets up an aggregator with nothing received
+func NewAggregator(cfg Config) (a *Aggregator) {
+  if cfg.MaxAge <= 0 {
+    cfg.MaxAge = DefaultMaxAge
+  }
+
+  a = &Aggregator{cfg: cfg}
+  a.subscribers = make(map[chan Snapshot]bool)
+  return
+}
+
+// HandleReading records the values a reading carries, subscribers are told
+// if anything changed
+func (a *Aggregator) HandleReading(r protocol.Reading) {
+  if !r.Valid {
+    return
+  }
+
+  at := r.Timestamp
+  if at.IsZero() {
+    at = time.Now()
+  }
+
+  a.mu.Lock()
+  defer a.mu.Unlock()
+
+  updated := false
+  set := func(f *Field, v float64) {
+    // Readings can arrive late from a queue, don't let them replace newer
+    // ones
+    if at.Before(f.At) {
+      return
+    }
+    f.Value = v
+    f.At = at
+    updated = true
+  }
+
+  s := &a.snapshot
+  if !r.Derived {
+    set(&s.WindSpeedMph, r.WindSpeed)
+    if !r.NoWindDir {
+      set(&s.WindDir, r.WindDir)
+    }
+  }
+  if !r.NoSensor {
+    switch r.Sensor {
+    case protocol.Temperature:
+      set(&s.TempF, r.Value)
+    case protocol.Humidity:
+      set(&s.Humidity, r.Value)
+    case protocol.WindGustSpeed:
+      set(&s.WindGustMph, r.Value)
+    case protocol.WindSpeedAvg2Min:
+      set(&s.WindSpeedAvg2MinMph, r.Value)
+    case protocol.WindDirAvg2Min:
+      set(&s.WindDirAvg2Min, r.Value)
+    case protocol.WindGust10Min:
+      set(&s.WindGust10MinMph, r.Value)
+    case protocol.WindGustDir10Min:
+      set(&s.WindGustDir10Min, r.Value)
+    case protocol.RainRate:
+      set(&s.RainRateInHr, r.RainRateInHr)
+    case protocol.RainLastHour:
+      set(&s.RainLastHourIn, r.Value)
+    case protocol.RainLast24h:
+      set(&s.RainLast24hIn, r.Value)
+    case protocol.RainDaily:
+      set(&s.RainDailyIn, r.Value)
+    case protocol.RainStorm:
+      set(&s.RainStormIn, r.Value)
+    case protocol.RainYearly:
+      set(&s.RainYearlyIn, r.Value)
+    case protocol.RainTotal:
+      set(&s.RainTotalIn, r.Value)
+    case protocol.SolarRadiation:
+      set(&s.SolarRadiation, r.Value)
+    case protocol.UVIndex:
+      set(&s.UVIndex, r.Value)
+    }
+  }
+  if !updated {
+    return
+  }
+  if at.After(s.Time) {
+    s.Time = at
+  }
+
+  current := a.current(time.Now())
+  for ch := range a.subscribers {
+    notify(ch, current)
+  }
+}
+
+// Current the conditions now, with stale values marked
+func (a *Aggregator) Current() Snapshot {
+  a.mu.Lock()
+  defer a.mu.Unlock()
+  return a.current(time.Now())
+}
+
+func (a *Aggregator) current(now time.Time) (s Snapshot) {
+  s = a.snapshot
+  for _, f := range s.fields() {
+    f.Stale = f.At.IsZero() || now.Sub(f.At) > a.cfg.MaxAge
+  }
+  return
+}
+
+// Subscribe returns a channel that gets the new snapshot whenever a reading
+// changes it. Slow subscribers only see the latest, snapshots they haven't
+// taken are replaced. cancel stops the notifications and closes the channel.
+func (a *Aggregator) Subscribe() (updates <-chan Snapshot, cancel func()) {
+  ch := make(chan Snapshot, 1)
+
+  a.mu.Lock()
+  a.subscribers[ch] = true
+  a.mu.Unlock()
+
+  var once sync.Once
+  cancel = func() {
+    once.Do(func() {
+      a.mu.Lock()
+      delete(a.subscribers, ch)
+      a.mu.Unlock()
+      close(ch)
+    })
+  }
+  return ch, cancel
+}
+
+// notify hands a snapshot to a subscriber without blocking, replacing any it
+// hasn't taken yet. Only called with the aggregator locked so there's a
+// single sender.
+func notify(ch chan Snapshot, s Snapshot) {
+  select {
+  case ch <- s:
+    return
+  default:
+  }
+  select {
+  case <-ch:
+  default:
+  }
+  ch <- s
+}
@@ -0,0 +1,170 @@
+package weather
+
+import (
+  "testing"
+  "time"
+  "github.com/NeilBetham/elements/protocol"
+)
+
+func reading(sensor protocol.Sensor, value float64, at time.Time) protocol.Reading {
+  return protocol.Reading{
+    StationID: 1,
+    Timestamp: at,
+    Sensor: sensor,
+    Value: value,
+    WindSpeed: 4,
+    WindDir: 90,
+    Valid: true,
+  }
+}
+
+func TestStaleness(t *testing.T) {
+  a := NewAggregator(Config{MaxAge: time.Minute})
+  start := time.Now()
+  a.HandleReading(reading(protocol.Temperature, 70, start))
+  a.HandleReading(reading(protocol.Humidity, 50, start.Add(30 * time.Second)))
+
+  tests := []struct {
+    now time.Duration
+    temp, humidity, dewPoint bool
+  }{
+    {0, true, true, true},
+    {time.Minute, true, true, true},
+    {time.Minute + time.Second, false, true, false},
+    {90 * time.Second, false, true, false},
+    {91 * time.Second, false, false, false},
+  }
+  for _, test := range tests {
+    s := a.current(start.Add(test.now))
+    if s.TempF.Ok() != test.temp || s.Humidity.Ok() != test.humidity || s.DewPointF().Ok() != test.dewPoint {
+      t.Errorf("After %s: temp %t humidity %t dew point %t, want %t %t %t", test.now,
+        s.TempF.Ok(), s.Humidity.Ok(), s.DewPointF().Ok(), test.temp, test.humidity, test.dewPoint)
+    }
+    // Values stay put whether they're stale or not
+    if s.TempF.Value != 70 || s.Humidity.Value != 50 {
+      t.Errorf("After %s: values %v %v", test.now, s.TempF.Value, s.Humidity.Value)
+    }
+    // Never received is always stale
+    if s.UVIndex.Ok() || !s.UVIndex.At.IsZero() {
+      t.Errorf("After %s: UV index %+v", test.now, s.UVIndex)
+    }
+  }
+
+  if got := NewAggregator(Config{}).cfg.MaxAge; got != DefaultMaxAge {
+    t.Errorf("Default max age %s", got)
+  }
+}
+
+func TestOutOfOrder(t *testing.T) {
+  a := NewAggregator(Config{})
+  now := time.Now()
+  a.HandleReading(reading(protocol.Temperature, 71, now))
+  a.HandleReading(reading(protocol.Temperature, 68, now.Add(-time.Minute)))
+  a.HandleReading(reading(protocol.Humidity, 40, now.Add(-time.Minute)))
+
+  s := a.Current()
+  if s.TempF.Value != 71 || !s.TempF.At.Equal(now) {
+    t.Errorf("Late reading replaced temperature: %+v", s.TempF)
+  }
+  // A late reading still fills in what's older or missing
+  if s.Humidity.Value != 40 {
+    t.Errorf("Humidity %+v", s.Humidity)
+  }
+  if !s.Time.Equal(now) {
+    t.Errorf("Snapshot time %s, want %s", s.Time, now)
+  }
+
+  // Late wind doesn't replace newer wind either
+  late := reading(protocol.Humidity, 41, now.Add(-30 * time.Second))
+  late.WindSpeed = 20
+  a.HandleReading(late)
+  if s = a.Current(); s.WindSpeedMph.Value != 4 || s.Humidity.Value != 41 {
+    t.Errorf("Wind %v humidity %v", s.WindSpeedMph.Value, s.Humidity.Value)
+  }
+}
+
+func TestReadingFields(t *testing.T) {
+  a := NewAggregator(Config{})
+  now := time.Now()
+
+  r := reading(protocol.SolarRadiation, 0, now)
+  r.NoSensor = true
+  r.NoWindDir = true
+  a.HandleReading(r)
+  s := a.Current()
+  if s.SolarRadiation.Ok() || s.WindDir.Ok() || !s.WindSpeedMph.Ok() {
+    t.Errorf("Missing sensor or vane recorded: %+v", s)
+  }
+
+  r = reading(protocol.RainRate, 0, now)
+  r.RainRateInHr = 0.42
+  a.HandleReading(r)
+  if s = a.Current(); s.RainRateInHr.Value != 0.42 {
+    t.Errorf("Rain rate %v", s.RainRateInHr.Value)
+  }
+
+  // Derived readings carry no wind
+  r = reading(protocol.RainDaily, 0.3, now.Add(time.Second))
+  r.Derived = true
+  r.WindSpeed = 30
+  a.HandleReading(r)
+  if s = a.Current(); s.RainDailyIn.Value != 0.3 || s.WindSpeedMph.Value != 4 {
+    t.Errorf("Rain %v wind %v", s.RainDailyIn.Value, s.WindSpeedMph.Value)
+  }
+
+  r = reading(protocol.Temperature, 99, now.Add(time.Second))
+  r.Valid = false
+  a.HandleReading(r)
+  if s = a.Current(); s.TempF.Ok() {
+    t.Errorf("Invalid reading recorded: %+v", s.TempF)
+  }
+}
+
+func TestSubscribe(t *testing.T) {
+  a := NewAggregator(Config{})
+  updates, cancel := a.Subscribe()
+  other, cancelOther := a.Subscribe()
+  defer cancelOther()
+  now := time.Now()
+
+  a.HandleReading(reading(protocol.Temperature, 70, now))
+  select {
+  case s := <-updates:
+    if s.TempF.Value != 70 || !s.TempF.Ok() {
+      t.Errorf("Update %+v", s.TempF)
+    }
+  default:
+    t.Fatal("No update")
+  }
+
+  // A reading that changes nothing isn't sent
+  a.HandleReading(reading(protocol.Temperature, 60, now.Add(-time.Minute)))
+  select {
+  case s := <-updates:
+    t.Errorf("Update for a late reading: %+v", s.TempF)
+  default:
+  }
+
+  // Slow subscribers get the latest without holding up the rest
+  a.HandleReading(reading(protocol.Temperature, 71, now.Add(time.Second)))
+  a.HandleReading(reading(protocol.Temperature, 72, now.Add(2 * time.Second)))
+  if s := <-updates; s.TempF.Value != 72 {
+    t.Errorf("Got %v, want the latest", s.TempF.Value)
+  }
+  if s := <-other; s.TempF.Value != 72 {
+    t.Errorf("Other subscriber got %v, want the latest", s.TempF.Value)
+  }
+
+  cancel()
+  cancel()
+  if _, ok := <-updates; ok {
+    t.Error("Channel open after cancel")
+  }
+  a.HandleReading(reading(protocol.Temperature, 73, now.Add(3 * time.Second)))
+  if s := <-other; s.TempF.Value != 73 {
+    t.Errorf("Other subscriber got %v after cancel", s.TempF.Value)
+  }
+  if len(a.subscribers) != 1 {
+    t.Errorf("%d subscribers after cancel", len(a.subscribers))
+  }
+}
@@ -0,0 +1,392 @@
+// Package wind turns the instantaneous wind in every packet into rolling
+// averages, gusts and a daily wind rose
+package wind
+
+import (
+  "math"
+  "sync"
+  "time"
+  "github.com/NeilBetham/elements/protocol"
+)
+
+// Averaging windows, 2 minutes is what aviation reports use and 10 minutes
+// the WMO standard for wind and gusts
+const (
+  shortWindow = 2 * time.Minute
+  longWindow = 10 * time.Minute
+)
+
+// Readings are derived this often by default, every packet would swamp the
+// sinks with values that barely move
+const DefaultInterval = time.Minute
+
+// Points the rose is split into, N, NNE, NE and so on clockwise
+const RosePoints = 16
+
+// Speeds below this in mph count as calm, the direction means nothing then
+const calmMph = 1
+
+// Upper limits in m/s of each Beaufort force below 12
+var beaufortLimits = []float64{0.5, 1.6, 3.4, 5.5, 8.0, 10.8, 13.9, 17.2, 20.8, 24.5, 28.5, 32.7}
+
+// Config controls how often readings are derived and when the rose day
+// rolls over
+type Config struct {
+  Interval time.Duration
+  // Zone the rose day is kept in
+  Location *time.Location
+  // Time after local midnight the rose day starts, 0 for midnight
+  DayStart time.Duration
+}
+
+type sample struct {
+  at time.Time
+  speed float64
+  dir float64
+  // Set when the vane wasn't reporting, the speed still counts
+  noDir bool
+}
+
+// hasDir whether the sample's direction means anything
+func (s sample) hasDir() bool {
+  return !s.noDir && s.speed >= calmMph
+}
+
+// Rose how many packets had the wind from each compass point over a day,
+// calm packets are counted apart as they have no direction
+type Rose struct {
+  Day time.Time `json:"day"`
+  Counts [RosePoints]int `json:"counts"`
+  Calm int `json:"calm"`
+}
+
+// Summary the wind statistics for a transmitter, speeds in mph and
+// directions in degrees. Scalar averages weigh every packet the same, vector
+// averages weigh the direction by the speed and cancel out wind from
+// opposite sides.
+type Summary struct {
+  SpeedAvg2Min float64
+  DirAvg2Min float64
+  VectorSpeed2Min float64
+  VectorDir2Min float64
+  SpeedAvg10Min float64
+  DirAvg10Min float64
+  VectorSpeed10Min float64
+  VectorDir10Min float64
+  Gust10Min float64
+  GustDir10Min float64
+  // Yamartino estimate of the spread in direction over 10 minutes
+  DirStdDev10Min float64
+  // Beaufort force of the 10 minute average
+  Beaufort int
+}
+
+type transmitter struct {
+  samples []sample
+  gusts []sample
+  lastDerived time.Time
+  rose Rose
+}
+
+// Tracker keeps the wind history of each transmitter, it's safe to use from
+// any goroutine
+type Tracker struct {
+  cfg Config
+
+  mu sync.Mutex
+  transmitters map[int]*transmitter
+}
+
+// NewTracker sets up a tracker with no wind seen
+func NewTracker(cfg Config) (t *Tracker) {
+  if cfg.Interval <= 0 {
+    cfg.Interval = DefaultInterval
+  }
+  if cfg.Location == nil {
+    cfg.Location = time.Local
+  }
+
+  t = &Tracker{cfg: cfg}
+  t.transmitters = make(map[int]*transmitter)
+  return
+}
+
+// HandleReading records the wind in a reading and returns the derived wind
+// readings when they're due. Gust readings count towards the peak gust,
+// their direction is the one the packet carries.
+func (t *Tracker) HandleReading(r protocol.Reading) (derived []protocol.Reading) {
+  if !r.Valid || r.Derived {
+    return
+  }
+  at := r.Timestamp
+  if at.IsZero() {
+    at = time.Now()
+  }
+
+  t.mu.Lock()
+  defer t.mu.Unlock()
+
+  tx := t.transmitters[r.StationID]
+  if tx == nil {
+    tx = &transmitter{}
+    t.transmitters[r.StationID] = tx
+  }
+
+  s := sample{at, r.WindSpeed, r.WindDir, r.NoWindDir}
+  tx.samples = append(tx.samples, s)
+  if r.Sensor == protocol.WindGustSpeed && !r.NoSensor {
+    tx.gusts = append(tx.gusts, sample{at, r.Value, r.WindDir, r.NoWindDir})
+  }
+  tx.trim(at)
+  t.countRose(tx, s)
+
+  if at.Sub(tx.lastDerived) < t.cfg.Interval {
+    return
+  }
+  tx.lastDerived = at
+
+  sum := tx.summary(at)
+  add := func(sensor protocol.Sensor, value float64) {
+    derived = append(derived, reading(r, sensor, value))
+  }
+  add(protocol.WindSpeedAvg2Min, sum.SpeedAvg2Min)
+  add(protocol.WindDirAvg2Min, sum.DirAvg2Min)
+  add(protocol.WindVectorSpeed2Min, sum.VectorSpeed2Min)
+  add(protocol.WindVectorDir2Min, sum.VectorDir2Min)
+  add(protocol.WindSpeedAvg10Min, sum.SpeedAvg10Min)
+  add(protocol.WindDirAvg10Min, sum.DirAvg10Min)
+  add(protocol.WindVectorSpeed10Min, sum.VectorSpeed10Min)
+  add(protocol.WindVectorDir10Min, sum.VectorDir10Min)
+  add(protocol.WindGust10Min, sum.Gust10Min)
+  add(protocol.WindGustDir10Min, sum.GustDir10Min)
+  add(protocol.WindDirStdDev10Min, sum.DirStdDev10Min)
+  add(protocol.Beaufort, float64(sum.Beaufort))
+  return
+}
+
+// Summary the current wind statistics for a transmitter, ok is false if
+// nothing has been heard from it
+func (t *Tracker) Summary(stationID int) (sum Summary, ok bool) {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+
+  tx := t.transmitters[stationID]
+  if tx == nil || len(tx.samples) == 0 {
+    return
+  }
+  return tx.summary(tx.samples[len(tx.samples) - 1].at), true
+}
+
+// Roses today's wind rose for each transmitter
+func (t *Tracker) Roses() (roses map[int]Rose) {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+
+  roses = make(map[int]Rose)
+  for id, tx := range t.transmitters {
+    roses[id] = tx.rose
+  }
+  return
+}
+
+// State the wind roses, the averages aren't worth keeping across a restart
+type State struct {
+  Roses map[int]Rose `json:"roses"`
+}
+
+// State returns a copy of today's roses
+func (t *Tracker) State() State {
+  return State{Roses: t.Roses()}
+}
+
+// Restore replaces the roses with a saved state, a day that ended while we
+// were stopped rolls over on the next reading
+func (t *Tracker) Restore(s State) {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+
+  for id, rose := range s.Roses {
+    tx := t.transmitters[id]
+    if tx == nil {
+      tx = &transmitter{}
+      t.transmitters[id] = tx
+    }
+    tx.rose = rose
+  }
+}
+
+// countRose adds a sample to the rose, starting a new one if the day rolled
+// over. Samples without a direction aren't counted.
+func (t *Tracker) countRose(tx *transmitter, s sample) {
+  day := t.roseDay(s.at)
+  if !day.Equal(tx.rose.Day) {
+    tx.rose = Rose{Day: day}
+  }
+  if s.noDir {
+    return
+  }
+  if s.speed < calmMph {
+    tx.rose.Calm++
+    return
+  }
+  tx.rose.Counts[RosePoint(s.dir)]++
+}
+
+// roseDay the date of the rose day that at falls in
+func (t *Tracker) roseDay(at time.Time) time.Time {
+  l := at.In(t.cfg.Location).Add(-t.cfg.DayStart)
+  return time.Date(l.Year(), l.Month(), l.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// trim drops samples older than the long window
+func (tx *transmitter) trim(now time.Time) {
+  cutoff := now.Add(-longWindow)
+  for len(tx.samples) > 0 && !tx.samples[0].at.After(cutoff) {
+    tx.samples = tx.samples[1:]
+  }
+  for len(tx.gusts) > 0 && !tx.gusts[0].at.After(cutoff) {
+    tx.gusts = tx.gusts[1:]
+  }
+}
+
+func (tx *transmitter) summary(now time.Time) (sum Summary) {
+  short := since(tx.samples, now.Add(-shortWindow))
+  sum.SpeedAvg2Min, sum.DirAvg2Min = scalarAverage(short)
+  sum.VectorSpeed2Min, sum.VectorDir2Min = vectorAverage(short)
+  sum.SpeedAvg10Min, sum.DirAvg10Min = scalarAverage(tx.samples)
+  sum.VectorSpeed10Min, sum.VectorDir10Min = vectorAverage(tx.samples)
+  sum.DirStdDev10Min = dirStdDev(tx.samples)
+  sum.Beaufort = Beaufort(sum.SpeedAvg10Min)
+
+  // The ISS only sends its gust every so often, the fastest packet since
+  // may have beaten it. The direction is the last one known at the time if
+  // the vane wasn't reporting.
+  var dir float64
+  peak := func(s sample) {
+    if !s.noDir {
+      dir = s.dir
+    }
+    if s.speed > sum.Gust10Min {
+      sum.Gust10Min = s.speed
+      sum.GustDir10Min = dir
+    }
+  }
+  g := 0
+  for _, s := range tx.samples {
+    for ; g < len(tx.gusts) && !tx.gusts[g].at.After(s.at); g++ {
+      peak(tx.gusts[g])
+    }
+    peak(s)
+  }
+  for ; g < len(tx.gusts); g++ {
+    peak(tx.gusts[g])
+  }
+  return
+}
+
+// since the samples after cutoff, they're in time order
+func since(samples []sample, cutoff time.Time) []sample {
+  for i, s := range samples {
+    if s.at.After(cutoff) {
+      return samples[i:]
+    }
+  }
+  return nil
+}
+
+// scalarAverage the mean speed and the mean direction of the packets that
+// weren't calm and had one, each direction counting the same
+func scalarAverage(samples []sample) (speed float64, dir float64) {
+  if len(samples) == 0 {
+    return
+  }
+  var x, y float64
+  for _, s := range samples {
+    speed += s.speed
+    if s.hasDir() {
+      x += math.Sin(radians(s.dir))
+      y += math.Cos(radians(s.dir))
+    }
+  }
+  return speed / float64(len(samples)), bearing(x, y)
+}
+
+// vectorAverage the resultant of the wind vectors, its speed and direction.
+// Packets without a direction are left out as they have no vector.
+func vectorAverage(samples []sample) (speed float64, dir float64) {
+  var x, y float64
+  n := 0
+  for _, s := range samples {
+    if s.noDir {
+      continue
+    }
+    x += s.speed * math.Sin(radians(s.dir))
+    y += s.speed * math.Cos(radians(s.dir))
+    n++
+  }
+  if n == 0 {
+    return
+  }
+  return math.Hypot(x, y) / float64(n), bearing(x, y)
+}
+
+// dirStdDev the standard deviation of direction with the Yamartino method,
+// calm packets and those without a direction are left out
+func dirStdDev(samples []sample) float64 {
+  var sa, ca float64
+  n := 0
+  for _, s := range samples {
+    if !s.hasDir() {
+      continue
+    }
+    sa += math.Sin(radians(s.dir))
+    ca += math.Cos(radians(s.dir))
+    n++
+  }
+  if n == 0 {
+    return 0
+  }
+  sa /= float64(n)
+  ca /= float64(n)
+  eps := math.Sqrt(math.Max(0, 1 - (sa * sa + ca * ca)))
+  return math.Asin(eps) * (1 + (2 / math.Sqrt(3) - 1) * eps * eps * eps) * 180 / math.Pi
+}
+
+// Beaufort the Beaufort force of a speed in mph
+func Beaufort(mph float64) (force int) {
+  ms := mph * 0.44704
+  for force < len(beaufortLimits) && ms >= beaufortLimits[force] {
+    force++
+  }
+  return
+}
+
+// RosePoint the compass point a direction falls in, 0 for north counting
+// clockwise
+func RosePoint(dir float64) int {
+  return int(math.Floor(math.Mod(dir + 360.0 / RosePoints / 2, 360) / (360.0 / RosePoints))) % RosePoints
+}
+
+// bearing the compass direction of a vector made of east and north parts,
+// 0 to 360
+func bearing(x float64, y float64) float64 {
+  if x == 0 && y == 0 {
+    return 0
+  }
+  return math.Mod(math.Atan2(x, y) * 180 / math.Pi + 360, 360)
+}
+
+func radians(deg float64) float64 {
+  return deg * math.Pi / 180
+}
+
+func reading(from protocol.Reading, sensor protocol.Sensor, value float64) (rd protocol.Reading) {
+  rd.StationID = from.StationID
+  rd.Timestamp = from.Timestamp
+  rd.Sensor = sensor
+  rd.SensorName = sensor.String()
+  rd.Value = value
+  rd.Valid = true
+  rd.Derived = true
+  return
+}
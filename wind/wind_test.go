@@ -0,0 +1,199 @@
+package wind
+
+import (
+  "math"
+  "testing"
+  "time"
+  "github.com/NeilBetham/elements/protocol"
+)
+
+var start = time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func packet(at time.Time, speed float64, dir float64) protocol.Reading {
+  return protocol.Reading{StationID: 1, Timestamp: at, Sensor: protocol.Temperature, WindSpeed: speed, WindDir: dir, Valid: true}
+}
+
+func gust(at time.Time, speed float64, dir float64) protocol.Reading {
+  r := packet(at, 0, dir)
+  r.Sensor = protocol.WindGustSpeed
+  r.Value = speed
+  return r
+}
+
+// angle the difference between two directions, 0 to 180
+func angle(a float64, b float64) float64 {
+  d := math.Mod(math.Abs(a - b), 360)
+  return math.Min(d, 360 - d)
+}
+
+func summary(t *testing.T, rs ...protocol.Reading) Summary {
+  t.Helper()
+  tr := NewTracker(Config{Interval: time.Hour, Location: time.UTC})
+  for _, r := range rs {
+    tr.HandleReading(r)
+  }
+  sum, ok := tr.Summary(1)
+  if !ok {
+    t.Fatal("no summary")
+  }
+  return sum
+}
+
+func TestAveragesAcrossNorth(t *testing.T) {
+  sum := summary(t,
+    packet(start, 10, 350),
+    packet(start.Add(10 * time.Second), 10, 10),
+  )
+  if angle(sum.DirAvg2Min, 0) > 1e-6 || angle(sum.VectorDir2Min, 0) > 1e-6 {
+    t.Errorf("directions either side of north averaged to %v scalar %v vector", sum.DirAvg2Min, sum.VectorDir2Min)
+  }
+  if math.Abs(sum.SpeedAvg2Min - 10) > 1e-9 || math.Abs(sum.VectorSpeed2Min - 10 * math.Cos(10 * math.Pi / 180)) > 1e-9 {
+    t.Errorf("got speed %v vector speed %v", sum.SpeedAvg2Min, sum.VectorSpeed2Min)
+  }
+
+  // Wind from opposite sides cancels out in the vector average only
+  sum = summary(t,
+    packet(start, 10, 90),
+    packet(start.Add(10 * time.Second), 10, 270),
+  )
+  if sum.SpeedAvg10Min != 10 || sum.VectorSpeed10Min > 1e-9 {
+    t.Errorf("opposite winds got speed %v vector speed %v", sum.SpeedAvg10Min, sum.VectorSpeed10Min)
+  }
+
+  // The 2 minute averages only look back 2 minutes
+  sum = summary(t,
+    packet(start, 20, 180),
+    packet(start.Add(5 * time.Minute), 10, 90),
+  )
+  if sum.SpeedAvg2Min != 10 || sum.SpeedAvg10Min != 15 || angle(sum.DirAvg2Min, 90) > 1e-6 {
+    t.Errorf("got 2 minute %v from %v, 10 minute %v", sum.SpeedAvg2Min, sum.DirAvg2Min, sum.SpeedAvg10Min)
+  }
+}
+
+func TestDirStdDev(t *testing.T) {
+  tests := []struct{
+    name string
+    dirs []float64
+    want float64
+  }{
+    {"steady", []float64{90, 90, 90}, 0},
+    // Yamartino's estimate for two directions 20° apart, eps is sin 10°
+    {"either side of north", []float64{350, 10}, 10 * (1 + (2 / math.Sqrt(3) - 1) * math.Pow(math.Sin(10 * math.Pi / 180), 3))},
+  }
+  for _, tt := range tests {
+    var rs []protocol.Reading
+    for i, dir := range tt.dirs {
+      rs = append(rs, packet(start.Add(time.Duration(i) * time.Second), 10, dir))
+    }
+    // Calm isn't counted
+    rs = append(rs, packet(start.Add(time.Minute), 0, 180))
+    if got := summary(t, rs...).DirStdDev10Min; math.Abs(got - tt.want) > 1e-6 {
+      t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+    }
+  }
+}
+
+func TestGust(t *testing.T) {
+  tr := NewTracker(Config{Interval: time.Hour, Location: time.UTC})
+  tr.HandleReading(packet(start, 5, 10))
+  tr.HandleReading(packet(start.Add(time.Minute), 12, 20))
+  tr.HandleReading(gust(start.Add(2 * time.Minute), 18, 45))
+  noVane := packet(start.Add(3 * time.Minute), 25, 0)
+  noVane.NoWindDir = true
+  tr.HandleReading(noVane)
+
+  // The fastest packet beat the ISS's gust, with no vane the direction is
+  // the last known
+  sum, _ := tr.Summary(1)
+  if sum.Gust10Min != 25 || sum.GustDir10Min != 45 {
+    t.Errorf("got gust %v from %v, want 25 from 45", sum.Gust10Min, sum.GustDir10Min)
+  }
+
+  // 10 minutes on they've all dropped out
+  tr.HandleReading(packet(start.Add(14 * time.Minute), 3, 200))
+  sum, _ = tr.Summary(1)
+  if sum.Gust10Min != 3 || sum.GustDir10Min != 200 {
+    t.Errorf("after 10 minutes got gust %v from %v, want 3 from 200", sum.Gust10Min, sum.GustDir10Min)
+  }
+}
+
+func TestDerivedInterval(t *testing.T) {
+  tr := NewTracker(Config{Interval: time.Minute, Location: time.UTC})
+  if derived := tr.HandleReading(packet(start, 5, 90)); len(derived) != 12 {
+    t.Fatalf("first packet derived %d readings", len(derived))
+  }
+  if derived := tr.HandleReading(packet(start.Add(30 * time.Second), 5, 90)); len(derived) != 0 {
+    t.Errorf("derived %d readings inside the interval", len(derived))
+  }
+  derived := tr.HandleReading(packet(start.Add(time.Minute), 5, 90))
+  if len(derived) != 12 || !derived[0].Derived || derived[0].StationID != 1 {
+    t.Errorf("derived %v after the interval", derived)
+  }
+}
+
+func TestBeaufort(t *testing.T) {
+  tests := []struct{
+    ms float64
+    force int
+  }{
+    {0, 0}, {0.49, 0}, {0.51, 1}, {1.5, 1}, {1.7, 2}, {3.3, 2}, {3.5, 3},
+    {5.4, 3}, {5.6, 4}, {7.9, 4}, {8.1, 5}, {10.7, 5}, {10.9, 6}, {13.8, 6},
+    {14.0, 7}, {17.1, 7}, {17.3, 8}, {20.7, 8}, {20.9, 9}, {24.4, 9},
+    {24.6, 10}, {28.4, 10}, {28.6, 11}, {32.6, 11}, {32.8, 12}, {60, 12},
+  }
+  for _, tt := range tests {
+    if got := Beaufort(tt.ms / 0.44704); got != tt.force {
+      t.Errorf("%v m/s got force %d, want %d", tt.ms, got, tt.force)
+    }
+  }
+}
+
+func TestRosePoint(t *testing.T) {
+  tests := []struct{
+    dir float64
+    point int
+  }{
+    {0, 0}, {11.2, 0}, {11.25, 1}, {22.5, 1}, {90, 4}, {180, 8}, {270, 12},
+    {348.7, 15}, {348.75, 0}, {359.9, 0}, {360, 0},
+  }
+  for _, tt := range tests {
+    if got := RosePoint(tt.dir); got != tt.point {
+      t.Errorf("%v° got point %d, want %d", tt.dir, got, tt.point)
+    }
+  }
+}
+
+func TestRoseDay(t *testing.T) {
+  cfg := Config{Interval: time.Hour, Location: time.UTC, DayStart: 9 * time.Hour}
+  tr := NewTracker(cfg)
+  noVane := packet(start, 20, 0)
+  noVane.NoWindDir = true
+  for _, r := range []protocol.Reading{
+    packet(start, 5, 90),
+    packet(start, 0, 270),
+    noVane,
+    // Before 9am the next morning is still the same rose day
+    packet(start.Add(20 * time.Hour + 59 * time.Minute), 5, 180),
+  } {
+    tr.HandleReading(r)
+  }
+  rose := tr.Roses()[1]
+  if !rose.Day.Equal(time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)) || rose.Counts[4] != 1 || rose.Counts[8] != 1 || rose.Calm != 1 {
+    t.Errorf("got rose %+v", rose)
+  }
+
+  // A restart carries on the same rose
+  restored := NewTracker(cfg)
+  restored.Restore(tr.State())
+  restored.HandleReading(packet(start.Add(20 * time.Hour + 59 * time.Minute), 5, 90))
+  if rose := restored.Roses()[1]; rose.Counts[4] != 2 || rose.Counts[8] != 1 || rose.Calm != 1 {
+    t.Errorf("restored rose %+v", rose)
+  }
+
+  // 9am starts a new one
+  restored.HandleReading(packet(start.Add(21 * time.Hour), 5, 0))
+  rose = restored.Roses()[1]
+  if !rose.Day.Equal(time.Date(2026, 6, 2, 0, 0, 0, 0, time.UTC)) || rose.Counts[0] != 1 || rose.Counts[4] != 0 || rose.Calm != 0 {
+    t.Errorf("rose after the day start %+v", rose)
+  }
+}